@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-migrate/migrator"
+)
+
+// copyMain runs the copy command, which copies all of the Raft data
+// between any two registered backends, selected by URI.
+func copyMain(args []string) int {
+	var overwrite bool
+	flags := flag.NewFlagSet("copy", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(copyUsage()) }
+	flags.BoolVar(&overwrite, "overwrite", false, "")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	if flags.NArg() != 2 {
+		fmt.Println(copyUsage())
+		return 1
+	}
+
+	// Open both of the backends, with the source read-only
+	src, err := migrator.OpenBackendReadOnly(flags.Arg(0))
+	if err != nil {
+		fmt.Printf("Error opening source: %s\n", err)
+		return 1
+	}
+	defer src.Close()
+
+	// A destination created by the copy is removed if the copy fails
+	dstPath := migrator.BackendPath(flags.Arg(1))
+	created := false
+	if dstPath != "" {
+		_, err := os.Stat(dstPath)
+		created = os.IsNotExist(err)
+	}
+	dst, err := migrator.OpenBackend(flags.Arg(1))
+	if err != nil {
+		fmt.Printf("Error opening destination: %s\n", err)
+		return 1
+	}
+
+	// Handle progress output
+	m := migrator.NewCopier()
+	m.Observer = newProgressHandler(levelNormal)
+	m.Overwrite = overwrite
+
+	// Perform the copy. The destination is closed explicitly since
+	// some backends only persist their data once closed.
+	start := time.Now()
+	if err := m.Copy(src, dst); err != nil {
+		dst.Close()
+		fmt.Printf("Copy failed: %s\n", err)
+		switch {
+		case created:
+			if err := os.RemoveAll(dstPath); err != nil {
+				fmt.Printf("Error removing incomplete destination '%s': %s\n", dstPath, err)
+			}
+		case dstPath != "":
+			fmt.Printf("Destination '%s' is incomplete and should not be used\n", dstPath)
+		}
+		return 1
+	}
+	if err := dst.Close(); err != nil {
+		fmt.Printf("Error closing destination: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("Copied %d logs in %s\n", m.Report().LogsCopied, time.Now().Sub(start))
+	return 0
+}
+
+func copyUsage() string {
+	return `Usage: consul-migrate copy [options] <src-uri> <dst-uri>
+
+Copies all of the Raft data from one storage backend into another. Each
+backend is selected with a URI, where the scheme is the backend name and
+the path is its location on disk, for example:
+
+  consul-migrate copy mdb:///var/consul/raft bolt:///tmp/raft.db
+
+The "mdb" backend takes the raft directory containing the "mdb" folder,
+or an LMDB directory such as "mdb.backup", which is only read.
+The source is opened read-only, and the copy is refused if the
+destination already holds logs or stable store keys, unless -overwrite
+is given. If the copy fails, a destination it created is removed, and
+an existing one is left incomplete.
+
+Export files can have their log data encrypted with AES-GCM by giving a
+base64-encoded key with the "key-file" or "key-env" query parameter. The
+same key is needed to read the file back, for example:
+
+  consul-migrate copy mdb:///var/consul/raft \
+    'export-file:///backup/raft.export?key-file=/etc/consul-migrate.key'
+
+Available backends: ` + strings.Join(migrator.Backends(), ", ") + `
+
+Options:
+
+  -overwrite             Copy into a destination which already holds data.
+`
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/hashicorp/consul-migrate/migrator"
+)
+
+// decryptMain runs the decrypt command, which decrypts a file encrypted
+// by a migration, such as a compressed backup of the LMDB data.
+func decryptMain(args []string) int {
+	var keyFile, keyEnv string
+	flags := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(decryptUsage()) }
+	flags.StringVar(&keyFile, "key-file", "", "")
+	flags.StringVar(&keyEnv, "key-env", "", "")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	if flags.NArg() != 2 {
+		fmt.Println(decryptUsage())
+		return 1
+	}
+
+	key, err := loadKey(keyFile, keyEnv)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if key == nil {
+		fmt.Println("One of -key-file or -key-env is required")
+		return 1
+	}
+
+	src, dst := flags.Arg(0), flags.Arg(1)
+	if err := migrator.DecryptFile(src, dst, key); err != nil {
+		fmt.Printf("Decryption failed: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Decrypted '%s' to '%s' with key %s\n", src, dst, key.ID())
+	return 0
+}
+
+// loadKey loads the encryption key given by the -key-file or -key-env
+// flags of a command. Returns nil if neither was given.
+func loadKey(file, env string) (*migrator.EncryptionKey, error) {
+	switch {
+	case file != "" && env != "":
+		return nil, fmt.Errorf("Only one of a key file or a key environment variable may be given")
+	case file != "":
+		return migrator.ReadEncryptionKey(file)
+	case env != "":
+		return migrator.EncryptionKeyFromEnv(env)
+	}
+	return nil, nil
+}
+
+func decryptUsage() string {
+	return `Usage: consul-migrate decrypt [options] <src> <dst>
+
+Decrypts a file encrypted by a migration, such as a compressed backup of
+the LMDB data written with -encrypt-key-file, so that it can be restored.
+The decrypted file is written to dst. Every chunk of the file is
+authenticated, so decryption fails if the file was modified or truncated.
+
+Keys are 16, 24 or 32 random bytes, base64 encoded, as generated by
+"consul keygen". The ID of the key a file was encrypted with is recorded
+in the migration manifest.
+
+Options:
+
+  -key-file=<path>       File holding the encryption key.
+
+  -key-env=<name>        Environment variable holding the encryption key.
+`
+}
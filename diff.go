@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul-migrate/migrator"
+)
+
+// diffMain runs the diff command, which compares the Raft data in any
+// two stores, selected by URI. Returns 0 if they are the same, 2 if
+// they differ, and 1 for errors, like diff(1).
+func diffMain(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(diffUsage()) }
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	if flags.NArg() != 2 {
+		fmt.Println(diffUsage())
+		return 1
+	}
+
+	a, err := migrator.OpenBackendReadOnly(flags.Arg(0))
+	if err != nil {
+		fmt.Printf("Error opening store A: %s\n", err)
+		return 1
+	}
+	defer a.Close()
+
+	b, err := migrator.OpenBackendReadOnly(flags.Arg(1))
+	if err != nil {
+		fmt.Printf("Error opening store B: %s\n", err)
+		return 1
+	}
+	defer b.Close()
+
+	res, err := migrator.Diff(a, b)
+	if err != nil {
+		fmt.Printf("Diff failed: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("Store A has %s, store B has %s\n",
+		describeIndexes(res.FirstIndexA, res.LastIndexA),
+		describeIndexes(res.FirstIndexB, res.LastIndexB))
+	for _, r := range res.MissingA {
+		fmt.Printf("Missing from A: logs %s\n", r)
+	}
+	for _, r := range res.MissingB {
+		fmt.Printf("Missing from B: logs %s\n", r)
+	}
+	for _, d := range res.LogDiffs {
+		fmt.Printf("Log %d differs: %s\n", d.Index, describeLogDiff(d))
+	}
+	if more := res.LogsDiffering - len(res.LogDiffs); more > 0 {
+		fmt.Printf("... and %d more differing logs\n", more)
+	}
+	for _, d := range res.StableKeyDiffs {
+		fmt.Printf("Stable key '%s' differs: %s in A, %s in B\n", d.Key,
+			formatStableValue(d.Key, d.ValueA), formatStableValue(d.Key, d.ValueB))
+	}
+
+	fmt.Printf("Compared %d logs and %d stable store keys\n", res.LogsCompared, res.StableKeysCompared)
+	if !res.Equal() {
+		fmt.Println("Stores differ")
+		return 2
+	}
+	fmt.Println("Stores are the same")
+	return 0
+}
+
+// describeIndexes describes the range of indexes in a store.
+func describeIndexes(first, last uint64) string {
+	if first == 0 && last == 0 {
+		return "no logs"
+	}
+	return fmt.Sprintf("indexes %d to %d", first, last)
+}
+
+// describeLogDiff lists what differs between two logs.
+func describeLogDiff(d *migrator.LogDiff) string {
+	var parts []string
+	for _, field := range d.Fields {
+		switch field {
+		case "term":
+			parts = append(parts, fmt.Sprintf("term %d != %d", d.TermA, d.TermB))
+		case "type":
+			parts = append(parts, fmt.Sprintf("type %d != %d", d.TypeA, d.TypeB))
+		case "data":
+			parts = append(parts, fmt.Sprintf("data (%d and %d bytes)", d.SizeA, d.SizeB))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatStableValue formats a stable store value for display. Terms
+// are stored as big-endian integers.
+func formatStableValue(key string, val []byte) string {
+	switch {
+	case val == nil:
+		return "missing"
+	case strings.HasSuffix(key, "Term") && len(val) == 8:
+		return fmt.Sprintf("%d", binary.BigEndian.Uint64(val))
+	default:
+		return fmt.Sprintf("%q", val)
+	}
+}
+
+func diffUsage() string {
+	return `Usage: consul-migrate diff <uri-a> <uri-b>
+
+Compares all of the Raft data in two stores, which may use any backend,
+and reports the ranges of logs missing from either store, logs whose term,
+type or data differ, and stable store keys with differing values. This can
+compare servers against each other, or an old backup against current data.
+Both stores are opened read-only, so neither is modified, but Consul must
+not be using either of them.
+
+Each store is selected with a URI, as for the copy command, for example:
+
+  consul-migrate diff bolt:///tmp/server1/raft.db bolt:///tmp/server2/raft.db
+
+Backups of the LMDB data can be compared by giving an "mdb.backup"
+directory to the "mdb" backend, or a compressed backup to the
+"mdb-archive" backend, along with the "key-file" or "key-env" query
+parameter if it is encrypted:
+
+  consul-migrate diff mdb-archive:///var/consul/raft/mdb.backup.tar.gz \
+    bolt:///var/consul/raft/raft.db
+
+Returns 0 if the stores are the same, 2 if they differ, and 1 for errors.
+
+Available backends: ` + strings.Join(migrator.Backends(), ", ") + `
+`
+}
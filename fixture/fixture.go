@@ -0,0 +1,252 @@
+// Package fixture generates synthetic LMDB Raft stores, in the format
+// written by Consul 0.5.0 and earlier, for testing and benchmarking the
+// migrator against stores which are larger or stranger than the
+// fixture checked into the repository.
+package fixture
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-mdb"
+)
+
+const (
+	// minMapSize is the smallest LMDB map used for a fixture
+	minMapSize = 64 * 1024 * 1024
+
+	// logOverhead is a generous estimate of the space taken by each
+	// log on top of its data, used to size the LMDB map
+	logOverhead = 256
+)
+
+// Gap is a range of indexes which are left out of the log store, as if
+// they were lost. The first log is never left out.
+type Gap struct {
+	Start  uint64
+	Length uint64
+}
+
+// Config describes a store to generate. Generation is deterministic,
+// so the same Config always produces the same logs.
+type Config struct {
+	// FirstIndex is the index of the first log, which is above 1 for
+	// stores that have been compacted. Defaults to 1.
+	FirstIndex uint64
+
+	// Logs is the number of logs written, not counting gaps.
+	Logs int
+
+	// MinSize and MaxSize bound the size of the data in each log, which
+	// is chosen at random between them.
+	MinSize int
+	MaxSize int
+
+	// Types weights the log types which are generated. Defaults to only
+	// writing LogCommand logs.
+	Types map[raft.LogType]int
+
+	// TermEvery starts a new term every TermEvery logs. Zero keeps every
+	// log in term 1.
+	TermEvery int
+
+	// Gaps are left out of the log store.
+	Gaps []Gap
+
+	// Stable and StableUint64 are written to the stable store, with Set
+	// and SetUint64 respectively.
+	Stable       map[string][]byte
+	StableUint64 map[string]uint64
+
+	// Seed seeds the generation of log data.
+	Seed int64
+}
+
+// DefaultConfig returns the configuration of a small, well-formed store
+// like the ones written by a healthy Consul server.
+func DefaultConfig() *Config {
+	return &Config{
+		FirstIndex: 1,
+		Logs:       100,
+		MinSize:    16,
+		MaxSize:    256,
+		Types: map[raft.LogType]int{
+			raft.LogCommand:    90,
+			raft.LogNoop:       5,
+			raft.LogAddPeer:    3,
+			raft.LogRemovePeer: 2,
+		},
+		TermEvery: 25,
+		Stable: map[string][]byte{
+			"LastVoteCand": []byte("127.0.0.1:8300"),
+		},
+		StableUint64: map[string]uint64{
+			"CurrentTerm":  4,
+			"LastVoteTerm": 4,
+		},
+		Seed: 1,
+	}
+}
+
+// Result summarises a generated store.
+type Result struct {
+	FirstIndex uint64
+	LastIndex  uint64
+	Logs       int
+	Bytes      int64
+
+	// Missing holds the indexes left out by gaps, in order.
+	Missing []uint64
+}
+
+// Generate writes a store described by conf into the Raft directory of
+// a Consul data-dir, which is created if needed. The LMDB data ends up
+// in the "mdb" directory beneath it, which must not already exist.
+func Generate(raftDir string, conf *Config) (*Result, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(raftDir, "mdb")); err == nil {
+		return nil, fmt.Errorf("LMDB data already exists in '%s'", raftDir)
+	}
+	if err := os.MkdirAll(raftDir, 0755); err != nil {
+		return nil, err
+	}
+
+	store, err := raftmdb.NewMDBStoreWithSize(raftDir, conf.mapSize())
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	// Write the stable store
+	for key, val := range conf.Stable {
+		if err := store.Set([]byte(key), val); err != nil {
+			return nil, fmt.Errorf("Error setting key '%s': %s", key, err)
+		}
+	}
+	for key, val := range conf.StableUint64 {
+		if err := store.SetUint64([]byte(key), val); err != nil {
+			return nil, fmt.Errorf("Error setting key '%s': %s", key, err)
+		}
+	}
+
+	// Write the logs in batches, skipping over gaps
+	rng := rand.New(rand.NewSource(conf.Seed))
+	types := conf.typeTable()
+	res := &Result{FirstIndex: conf.firstIndex()}
+	batch := make([]*raft.Log, 0, 256)
+	index := res.FirstIndex
+	for written := 0; written < conf.Logs; index++ {
+		if conf.inGap(index) {
+			res.Missing = append(res.Missing, index)
+			continue
+		}
+		log := &raft.Log{
+			Index: index,
+			Term:  conf.term(written),
+			Type:  types[rng.Intn(len(types))],
+			Data:  make([]byte, conf.MinSize+rng.Intn(conf.MaxSize-conf.MinSize+1)),
+		}
+		rng.Read(log.Data)
+		batch = append(batch, log)
+		res.Bytes += int64(len(log.Data))
+		written++
+
+		if len(batch) == cap(batch) {
+			if err := store.StoreLogs(batch); err != nil {
+				return nil, fmt.Errorf("Error storing logs: %s", err)
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := store.StoreLogs(batch); err != nil {
+			return nil, fmt.Errorf("Error storing logs: %s", err)
+		}
+	}
+	res.Logs = conf.Logs
+	res.LastIndex = index - 1
+	return res, nil
+}
+
+// validate checks that the configuration describes a store which can
+// be generated.
+func (c *Config) validate() error {
+	if c.Logs <= 0 {
+		return fmt.Errorf("At least one log must be generated")
+	}
+	if c.MinSize < 0 || c.MaxSize < c.MinSize {
+		return fmt.Errorf("Invalid log size range %d to %d", c.MinSize, c.MaxSize)
+	}
+	for typ, weight := range c.Types {
+		if weight < 0 {
+			return fmt.Errorf("Invalid weight %d for log type %d", weight, typ)
+		}
+	}
+	for _, gap := range c.Gaps {
+		if gap.Start <= c.firstIndex() {
+			return fmt.Errorf("Gap at %d must start after the first index", gap.Start)
+		}
+	}
+	return nil
+}
+
+func (c *Config) firstIndex() uint64 {
+	if c.FirstIndex == 0 {
+		return 1
+	}
+	return c.FirstIndex
+}
+
+// typeTable expands the type weights into a table to pick from.
+func (c *Config) typeTable() []raft.LogType {
+	var keys []int
+	for typ := range c.Types {
+		keys = append(keys, int(typ))
+	}
+	sort.Ints(keys)
+
+	var table []raft.LogType
+	for _, typ := range keys {
+		for i := 0; i < c.Types[raft.LogType(typ)]; i++ {
+			table = append(table, raft.LogType(typ))
+		}
+	}
+	if len(table) == 0 {
+		table = []raft.LogType{raft.LogCommand}
+	}
+	return table
+}
+
+// term returns the term of the n'th log written.
+func (c *Config) term(n int) uint64 {
+	if c.TermEvery <= 0 {
+		return 1
+	}
+	return uint64(n/c.TermEvery) + 1
+}
+
+// inGap returns whether an index is left out by a gap.
+func (c *Config) inGap(index uint64) bool {
+	for _, gap := range c.Gaps {
+		if index >= gap.Start && index < gap.Start+gap.Length {
+			return true
+		}
+	}
+	return false
+}
+
+// mapSize returns an LMDB map size big enough to hold every log at its
+// largest size twice over, since LMDB needs room for copy-on-write.
+func (c *Config) mapSize() uint64 {
+	size := 2 * uint64(c.Logs) * uint64(c.MaxSize+logOverhead)
+	if size < minMapSize {
+		size = minMapSize
+	}
+	return size
+}
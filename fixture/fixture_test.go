@@ -0,0 +1,149 @@
+package fixture
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-mdb"
+)
+
+func TestGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	raftDir := filepath.Join(dir, "raft")
+
+	conf := DefaultConfig()
+	conf.FirstIndex = 10
+	conf.Logs = 50
+	conf.Gaps = []Gap{{Start: 20, Length: 3}}
+	res, err := Generate(raftDir, conf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if res.FirstIndex != 10 || res.LastIndex != 62 || res.Logs != 50 {
+		t.Fatalf("bad: %#v", res)
+	}
+	if !reflect.DeepEqual(res.Missing, []uint64{20, 21, 22}) {
+		t.Fatalf("bad: %v", res.Missing)
+	}
+
+	// Generating over existing data fails
+	if _, err := Generate(raftDir, conf); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	store, err := raftmdb.NewMDBStoreWithSize(raftDir, conf.mapSize())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	first, err := store.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != res.FirstIndex || last != res.LastIndex {
+		t.Fatalf("bad: %d %d", first, last)
+	}
+
+	var bytesRead int64
+	for i := first; i <= last; i++ {
+		log := &raft.Log{}
+		err := store.GetLog(i, log)
+		if conf.inGap(i) {
+			if err != raft.ErrLogNotFound {
+				t.Fatalf("log %d: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("log %d: %s", i, err)
+		}
+		if len(log.Data) < conf.MinSize || len(log.Data) > conf.MaxSize {
+			t.Fatalf("log %d: bad size %d", i, len(log.Data))
+		}
+		bytesRead += int64(len(log.Data))
+	}
+	if bytesRead != res.Bytes {
+		t.Fatalf("bad: %d %d", bytesRead, res.Bytes)
+	}
+
+	val, err := store.Get([]byte("LastVoteCand"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(val, conf.Stable["LastVoteCand"]) {
+		t.Fatalf("bad: %q", val)
+	}
+	term, err := store.GetUint64([]byte("CurrentTerm"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if term != conf.StableUint64["CurrentTerm"] {
+		t.Fatalf("bad: %d", term)
+	}
+}
+
+func TestConfig_validate(t *testing.T) {
+	cases := map[string]func(*Config){
+		"no logs":        func(c *Config) { c.Logs = 0 },
+		"negative size":  func(c *Config) { c.MinSize = -1 },
+		"inverted sizes": func(c *Config) { c.MinSize, c.MaxSize = 10, 5 },
+		"negative weight": func(c *Config) {
+			c.Types = map[raft.LogType]int{raft.LogNoop: -1}
+		},
+		"gap at first index": func(c *Config) { c.Gaps = []Gap{{Start: 1, Length: 1}} },
+	}
+	for name, mutate := range cases {
+		conf := DefaultConfig()
+		mutate(conf)
+		if err := conf.validate(); err == nil {
+			t.Fatalf("%s: should fail", name)
+		}
+	}
+	if err := DefaultConfig().validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestConfig_typeTable(t *testing.T) {
+	conf := &Config{}
+	if table := conf.typeTable(); !reflect.DeepEqual(table, []raft.LogType{raft.LogCommand}) {
+		t.Fatalf("bad: %v", table)
+	}
+
+	conf.Types = map[raft.LogType]int{
+		raft.LogNoop:    1,
+		raft.LogCommand: 2,
+		raft.LogBarrier: 0,
+	}
+	expect := []raft.LogType{raft.LogCommand, raft.LogCommand, raft.LogNoop}
+	if table := conf.typeTable(); !reflect.DeepEqual(table, expect) {
+		t.Fatalf("bad: %v", table)
+	}
+}
+
+func TestConfig_term(t *testing.T) {
+	conf := &Config{}
+	if term := conf.term(100); term != 1 {
+		t.Fatalf("bad: %d", term)
+	}
+	conf.TermEvery = 10
+	for n, expect := range map[int]uint64{0: 1, 9: 1, 10: 2, 25: 3} {
+		if term := conf.term(n); term != expect {
+			t.Fatalf("%d: bad: %d", n, term)
+		}
+	}
+}
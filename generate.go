@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul-migrate/fixture"
+	"github.com/hashicorp/raft"
+)
+
+// logTypeNames maps the names accepted by -types to Raft log types.
+var logTypeNames = map[string]raft.LogType{
+	"command":     raft.LogCommand,
+	"noop":        raft.LogNoop,
+	"add-peer":    raft.LogAddPeer,
+	"remove-peer": raft.LogRemovePeer,
+	"barrier":     raft.LogBarrier,
+}
+
+// generateMain runs the generate-fixture command, which writes a
+// synthetic LMDB store into a data-dir for testing. It is left out of
+// the usage since it is only meant for development.
+func generateMain(args []string) int {
+	conf := fixture.DefaultConfig()
+	var types, gaps string
+	var stable, stableUint64 stringsFlag
+	flags := flag.NewFlagSet("generate-fixture", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(generateUsage()) }
+	flags.Uint64Var(&conf.FirstIndex, "first-index", conf.FirstIndex, "")
+	flags.IntVar(&conf.Logs, "logs", conf.Logs, "")
+	flags.IntVar(&conf.MinSize, "min-size", conf.MinSize, "")
+	flags.IntVar(&conf.MaxSize, "max-size", conf.MaxSize, "")
+	flags.IntVar(&conf.TermEvery, "term-every", conf.TermEvery, "")
+	flags.StringVar(&types, "types", "", "")
+	flags.StringVar(&gaps, "gaps", "", "")
+	flags.Var(&stable, "stable", "")
+	flags.Var(&stableUint64, "stable-uint64", "")
+	flags.Int64Var(&conf.Seed, "seed", conf.Seed, "")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	if flags.NArg() != 1 {
+		fmt.Println(generateUsage())
+		return 1
+	}
+
+	var err error
+	if types != "" {
+		if conf.Types, err = parseLogTypes(types); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	if gaps != "" {
+		if conf.Gaps, err = parseGaps(gaps); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	// Stable store values replace the defaults if any are given
+	if len(stable) > 0 || len(stableUint64) > 0 {
+		conf.Stable = make(map[string][]byte)
+		conf.StableUint64 = make(map[string]uint64)
+	}
+	for _, kv := range stable {
+		key, val, err := splitKeyValue(kv)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		conf.Stable[key] = []byte(val)
+	}
+	for _, kv := range stableUint64 {
+		key, val, err := splitKeyValue(kv)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		n, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			fmt.Printf("Invalid value for stable key '%s': %s\n", key, err)
+			return 1
+		}
+		conf.StableUint64[key] = n
+	}
+
+	res, err := fixture.Generate(filepath.Join(flags.Arg(0), "raft"), conf)
+	if err != nil {
+		fmt.Printf("Error generating fixture: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Wrote %d logs (indexes %d to %d, %d bytes of data) with %d missing\n",
+		res.Logs, res.FirstIndex, res.LastIndex, res.Bytes, len(res.Missing))
+	return 0
+}
+
+// parseLogTypes parses weighted log types, such as "command=9,noop=1".
+func parseLogTypes(s string) (map[raft.LogType]int, error) {
+	types := make(map[raft.LogType]int)
+	for _, kv := range strings.Split(s, ",") {
+		name, val, err := splitKeyValue(kv)
+		if err != nil {
+			return nil, err
+		}
+		typ, ok := logTypeNames[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown log type '%s'", name)
+		}
+		weight, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid weight for log type '%s': %s", name, err)
+		}
+		types[typ] = weight
+	}
+	return types, nil
+}
+
+// parseGaps parses gaps given as start:length, such as "50:10,200:1".
+func parseGaps(s string) ([]fixture.Gap, error) {
+	var gaps []fixture.Gap
+	for _, gap := range strings.Split(s, ",") {
+		parts := strings.SplitN(gap, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid gap '%s', expected start:length", gap)
+		}
+		start, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid gap '%s': %s", gap, err)
+		}
+		length, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid gap '%s': %s", gap, err)
+		}
+		gaps = append(gaps, fixture.Gap{Start: start, Length: length})
+	}
+	return gaps, nil
+}
+
+// splitKeyValue splits a key=value pair.
+func splitKeyValue(kv string) (string, string, error) {
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("Invalid value '%s', expected key=value", kv)
+	}
+	return parts[0], parts[1], nil
+}
+
+func generateUsage() string {
+	return `Usage: consul-migrate generate-fixture [options] <data-dir>
+
+Writes a synthetic LMDB Raft store, like the one used by Consul 0.5.0 and
+earlier, into the given data-dir for testing and benchmarking migrations.
+The same options always generate the same data.
+
+Options:
+
+  -logs=<count>          Number of logs to write. Defaults to 100.
+
+  -first-index=<index>   Index of the first log. Defaults to 1.
+
+  -min-size=<bytes>      Smallest and largest size of the data in each log,
+  -max-size=<bytes>      which is chosen at random. Default to 16 and 256.
+
+  -types=<type=weight>   Weighted mix of log types, separated by commas. Types
+                         are command, noop, add-peer, remove-peer and barrier.
+
+  -term-every=<count>    Start a new term every count logs. Defaults to 25.
+
+  -gaps=<start:length>   Ranges of indexes to leave out, separated by commas.
+
+  -stable=<key=value>    Stable store values, set as strings or uint64s. May
+  -stable-uint64=<k=v>   be repeated, and replace the defaults if given.
+
+  -seed=<seed>           Seed for the generated data. Defaults to 1.
+`
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/consul-migrate/migrator"
+	"github.com/hashicorp/logutils"
+)
+
+// logLevels are the supported values of the -log-level flag, in order
+// of increasing severity.
+var logLevels = []logutils.LogLevel{"DEBUG", "INFO", "WARN", "ERR"}
+
+// setupLogger creates the logger passed to the migrator. Nothing is
+// logged unless a level or a file is given. Logs go to the file if one
+// is set, or to stderr otherwise, so they never mix with the regular
+// output. If a log file was opened, it is returned so it can be closed.
+func setupLogger(level, path string) (*log.Logger, *os.File, error) {
+	if level == "" && path == "" {
+		return log.New(ioutil.Discard, "", 0), nil, nil
+	}
+	if level == "" {
+		level = "INFO"
+	}
+
+	level = strings.ToUpper(level)
+	valid := false
+	for _, l := range logLevels {
+		if logutils.LogLevel(level) == l {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, nil, fmt.Errorf("Invalid log level '%s', must be one of %v", level, logLevels)
+	}
+
+	var w io.Writer = os.Stderr
+	var fh *os.File
+	if path != "" {
+		var err error
+		fh, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error opening log file: %s", err)
+		}
+		w = fh
+	}
+
+	filter := &logutils.LevelFilter{
+		Levels:   logLevels,
+		MinLevel: logutils.LogLevel(level),
+		Writer:   w,
+	}
+	return log.New(filter, "", log.LstdFlags|log.Lmicroseconds), fh, nil
+}
+
+// setupMetrics creates the metrics sink for the -statsd-addr and
+// -prometheus-file flags. Returns nil if neither is set. Metrics are
+// tagged with the host name so a fleet-wide dashboard can tell the
+// servers apart. The returned function must be called when done.
+func setupMetrics(statsdAddr, promFile string) (migrator.MetricsSink, func(), error) {
+	if statsdAddr == "" && promFile == "" {
+		return nil, func() {}, nil
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	var sinks migrator.FanoutSink
+	cleanup := func() {}
+	if statsdAddr != "" {
+		prefix := "consul-migrate." + strings.Replace(host, ".", "_", -1)
+		statsd, err := migrator.NewStatsdSink(statsdAddr, prefix)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error creating statsd sink: %s", err)
+		}
+		sinks = append(sinks, statsd)
+		cleanup = func() { statsd.Close() }
+	}
+	if promFile != "" {
+		labels := map[string]string{"host": host}
+		sinks = append(sinks, migrator.NewPrometheusFileSink(promFile, labels))
+	}
+	return sinks, cleanup, nil
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/consul-migrate/migrator"
@@ -13,32 +15,183 @@ func main() {
 }
 
 func realMain(args []string) int {
-	if len(args) != 2 {
+	if len(args) < 2 {
 		fmt.Println(usage())
 		return 1
 	}
 
-	// Observe the help flags
-	if args[1] == "-h" || args[1] == "--help" {
+	// Dispatch to sub-commands
+	switch args[1] {
+	case "copy":
+		return copyMain(args[2:])
+	case "verify":
+		return verifyMain(args[2:])
+	case "diff":
+		return diffMain(args[2:])
+	case "decrypt":
+		return decryptMain(args[2:])
+	case "generate-fixture":
+		return generateMain(args[2:])
+	}
+
+	// Parse the flags. The help flags are observed by the flag set.
+	var compact bool
+	var trailingLogs uint64
+	var archiveFormat, archivePath, format string
+	var encryptKeyFile, encryptKeyEnv string
+	var quiet, verbose bool
+	var logLevel, logFile string
+	var statsdAddr, promFile string
+	var salvage bool
+	var quarantinePath string
+	var copySource bool
+	var scratchDir string
+	var mapSize uint64
+	var discardPartial bool
+	var validation string
+	var rewriteAddrs stringsFlag
+	var preHooks, postHooks, failureHooks stringsFlag
+	var hookTimeout time.Duration
+	flags := flag.NewFlagSet("consul-migrate", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(usage()) }
+	flags.BoolVar(&compact, "compact", false, "")
+	flags.Uint64Var(&trailingLogs, "trailing-logs", migrator.DefaultTrailingLogs, "")
+	flags.StringVar(&archiveFormat, "archive-format", migrator.ArchiveRename, "")
+	flags.StringVar(&archivePath, "archive-path", "", "")
+	flags.StringVar(&encryptKeyFile, "encrypt-key-file", "", "")
+	flags.StringVar(&encryptKeyEnv, "encrypt-key-env", "", "")
+	flags.StringVar(&format, "format", formatText, "")
+	flags.BoolVar(&quiet, "quiet", false, "")
+	flags.BoolVar(&verbose, "verbose", false, "")
+	flags.StringVar(&logLevel, "log-level", "", "")
+	flags.StringVar(&logFile, "log-file", "", "")
+	flags.StringVar(&statsdAddr, "statsd-addr", "", "")
+	flags.StringVar(&promFile, "prometheus-file", "", "")
+	flags.BoolVar(&salvage, "salvage", false, "")
+	flags.StringVar(&quarantinePath, "quarantine-path", "", "")
+	flags.BoolVar(&copySource, "copy-source", false, "")
+	flags.StringVar(&scratchDir, "scratch-dir", "", "")
+	flags.Uint64Var(&mapSize, "map-size", 0, "")
+	flags.BoolVar(&discardPartial, "discard-partial", false, "")
+	flags.StringVar(&validation, "validate", migrator.ValidateWarn, "")
+	flags.Var(&rewriteAddrs, "rewrite-address", "")
+	flags.Var(&preHooks, "pre-hook", "")
+	flags.Var(&postHooks, "post-hook", "")
+	flags.Var(&failureHooks, "failure-hook", "")
+	flags.DurationVar(&hookTimeout, "hook-timeout", migrator.DefaultHookTimeout, "")
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	if flags.NArg() != 1 {
 		fmt.Println(usage())
-		return 0
+		return 1
+	}
+	if format != formatText && format != formatJSON {
+		fmt.Printf("Unsupported output format '%s'\n", format)
+		return 1
+	}
+	dataDir := flags.Arg(0)
+
+	// Set up the output handler first, so that any configuration error
+	// is reported in the requested format
+	var jsonOut *jsonHandler
+	if format == formatJSON {
+		jsonOut = newJSONHandler(os.Stdout)
+	}
+	configError := func(err error) int {
+		if jsonOut != nil {
+			jsonOut.result(dataDir, false, nil, err, migrator.ErrClassConfig)
+		} else {
+			fmt.Println(err)
+		}
+		return 1
+	}
+
+	if quiet && verbose {
+		return configError(fmt.Errorf("The -quiet and -verbose flags cannot be used together"))
+	}
+	level := levelNormal
+	switch {
+	case quiet:
+		level = levelQuiet
+	case verbose:
+		level = levelVerbose
+	}
+	addressMap, err := parseAddressMap(rewriteAddrs)
+	if err != nil {
+		return configError(err)
+	}
+	encryptionKey, err := loadKey(encryptKeyFile, encryptKeyEnv)
+	if err != nil {
+		return configError(err)
 	}
 
+	// Set up logging
+	logger, logFh, err := setupLogger(logLevel, logFile)
+	if err != nil {
+		return configError(err)
+	}
+	if logFh != nil {
+		defer logFh.Close()
+	}
+
+	// Set up metrics
+	metrics, metricsCleanup, err := setupMetrics(statsdAddr, promFile)
+	if err != nil {
+		return configError(err)
+	}
+	defer metricsCleanup()
+
 	// Create the migrator
-	m, err := migrator.New(args[1])
+	m, err := migrator.New(dataDir)
 	if err != nil {
-		fmt.Printf("Error creating migrator: %s\n", err)
+		if jsonOut != nil {
+			jsonOut.result(dataDir, false, nil, err, migrator.ErrClassConfig)
+		} else {
+			fmt.Printf("Error creating migrator: %s\n", err)
+		}
 		return 1
 	}
+	m.Logger = logger
+	m.Metrics = metrics
+	m.Compact = compact
+	m.TrailingLogs = trailingLogs
+	m.ArchiveFormat = archiveFormat
+	m.ArchivePath = archivePath
+	m.EncryptionKey = encryptionKey
+	m.Salvage = salvage
+	m.QuarantinePath = quarantinePath
+	m.CopySource = copySource
+	m.ScratchDir = scratchDir
+	m.MapSize = mapSize
+	m.DiscardPartial = discardPartial
+	m.Validation = validation
+	m.AddressMap = addressMap
+	m.PreHooks = preHooks
+	m.PostHooks = postHooks
+	m.FailureHooks = failureHooks
+	m.HookTimeout = hookTimeout
 
 	// Handle progress output
-	doneCh := make(chan struct{})
-	defer close(doneCh)
-	go handleProgress(m.ProgressCh, doneCh)
+	if jsonOut != nil {
+		m.Observer = jsonOut
+	} else {
+		m.Observer = newProgressHandler(level)
+	}
 
 	// Perform the migration
-	start := time.Now()
 	migrated, err := m.Migrate()
+	report := m.Report()
+	if jsonOut != nil {
+		jsonOut.result(dataDir, migrated, report, err, migrator.ErrorClassOf(err))
+		if err != nil {
+			return 1
+		}
+		return 0
+	}
 	if err != nil {
 		fmt.Printf("Migration failed: %s\n", err)
 		return 1
@@ -46,48 +199,90 @@ func realMain(args []string) int {
 
 	// Check the result
 	if migrated {
-		fmt.Printf("Migration completed in %s\n", time.Now().Sub(start))
+		if report.LogsResumed > 0 {
+			fmt.Printf("Resumed after %d logs verified in a partial BoltDB file from an earlier run\n",
+				report.LogsResumed)
+		}
+		if report.SourceChecksum != "" {
+			fmt.Printf("Original LMDB data was not modified (sha256 %s)\n", report.SourceChecksum)
+		}
+		if report.LogsDropped > 0 {
+			fmt.Printf("Dropped %d logs: %s\n", report.LogsDropped, report.DropReason)
+		}
+		if report.ViolationCount > 0 {
+			fmt.Printf("Found %d Raft invariant violations in the source data:\n", report.ViolationCount)
+			for _, v := range report.Violations {
+				fmt.Printf("  %s\n", v)
+			}
+		}
+		if len(report.Rewrites) > 0 {
+			fmt.Printf("Rewrote %d server addresses:\n", len(report.Rewrites))
+			for _, r := range report.Rewrites {
+				fmt.Printf("  %s\n", r)
+			}
+		}
+		if len(report.Quarantined) > 0 {
+			fmt.Printf("Lost %d unreadable logs, quarantined to '%s':\n",
+				len(report.Quarantined), report.QuarantinePath)
+			for _, q := range report.Quarantined {
+				fmt.Printf("  Index %d: %s\n", q.Index, q.Error)
+			}
+		}
+		if report.ArchiveChecksum != "" {
+			fmt.Printf("LMDB data archived to '%s' (sha256 %s)\n",
+				report.ArchivePath, report.ArchiveChecksum)
+		}
+		if report.ArchiveKeyID != "" {
+			fmt.Printf("Archive encrypted with key %s\n", report.ArchiveKeyID)
+		}
+		if report.ManifestPath != "" {
+			fmt.Printf("Migration manifest written to '%s'\n", report.ManifestPath)
+		}
+		fmt.Printf("Migration completed in %s\n", report.Duration)
 	} else {
-		fmt.Printf("Nothing to do for directory '%s'\n", args[1])
+		fmt.Printf("Nothing to do for directory '%s'\n", dataDir)
 	}
 	return 0
 }
 
-// handleProgress is used to dump progress information to the console while
-// a migration is in flight. This allows the user to monitor a migration.
-func handleProgress(ch <-chan *migrator.ProgressUpdate, doneCh <-chan struct{}) {
-	var lastOp string
-	var lastProgress float64
-	lastFlush := time.Now()
-	for {
-		select {
-		case update := <-ch:
-			switch {
-			case lastOp != update.Op:
-				lastProgress = update.Progress
-				lastOp = update.Op
-				fmt.Println(update.Op)
-				fmt.Printf("%.2f%%\n", update.Progress)
-
-			case update.Progress-lastProgress >= 5:
-				fallthrough
-
-			case time.Now().Sub(lastFlush) > time.Second:
-				fallthrough
-
-			case update.Progress == 100:
-				lastFlush = time.Now()
-				lastProgress = update.Progress
-				fmt.Printf("%.2f%%\n", update.Progress)
-			}
-		case <-doneCh:
-			return
+// parseAddressMap parses the old=new address pairs given to the
+// -rewrite-address flag.
+func parseAddressMap(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	addrs := make(map[string]string)
+	for _, pair := range pairs {
+		old, new, err := splitKeyValue(pair)
+		if err != nil {
+			return nil, err
 		}
+		if _, ok := addrs[old]; ok {
+			return nil, fmt.Errorf("Address '%s' is rewritten more than once", old)
+		}
+		addrs[old] = new
 	}
+	return addrs, nil
+}
+
+// stringsFlag is a flag which may be given multiple times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
 
 func usage() string {
-	return `Usage: consul-migrate <data-dir>
+	return `Usage: consul-migrate [options] <data-dir>
+       consul-migrate copy <src-uri> <dst-uri>
+       consul-migrate verify [options] [<data-dir>]
+       consul-migrate diff <uri-a> <uri-b>
+       consul-migrate decrypt [options] <src> <dst>
 
 Consul-migrate is a tool for moving Consul server data from LMDB to BoltDB.
 This is a prerequisite for upgrading to Consul >= 0.5.1.
@@ -98,11 +293,137 @@ migration process. If any part of the migration fails, it is safe to try again.
 This command is also idempotent, and will not re-attempt a migration which has
 already been completed.
 
-Upon successful migration, the MDB data directory will be renamed so that it
-includes the ".backup" extension. Once you have verified Consul is operational
-after the migration, and contains all of the expected data, it is safe to
-archive the "mdb.backup" directory and remove it from the Consul server.
+Upon successful migration, the MDB data directory is archived. By default it
+is renamed so that it includes the ".backup" extension. With the "gzip"
+archive format, it is instead compressed into "mdb.backup.tar.gz", which is
+checked against the original files before the MDB directory is removed. Once
+you have verified Consul is operational after the migration, and contains all
+of the expected data, it is safe to move the archive off the Consul server.
 
 Returns 0 on successful migration or no-op, 1 for errors.
+
+Commands:
+
+  copy                   Copy Raft data between any two storage backends.
+                         Run "consul-migrate copy -h" for details.
+
+  verify                 Check a migrated BoltDB store against the manifest
+                         written by the migration.
+
+  diff                   Compare the Raft data in any two stores.
+                         Run "consul-migrate diff -h" for details.
+
+  decrypt                Decrypt an encrypted backup of the LMDB data.
+                         Run "consul-migrate decrypt -h" for details.
+
+Options:
+
+  -compact               Skip logs which are already covered by the latest
+                         Raft snapshot, producing a smaller BoltDB file.
+  -trailing-logs=<n>     Number of logs to keep before the snapshot index
+                         when compacting. Defaults to 10240.
+
+  -archive-format=<fmt>  How to archive the LMDB data after migrating. The
+                         default "rename" moves it to "mdb.backup". Using
+                         "gzip" writes a verified, checksummed tarball and
+                         removes the original LMDB directory.
+
+  -archive-path=<path>   Location of the tarball when using the "gzip"
+                         archive format. Defaults to "mdb.backup.tar.gz"
+                         in the raft directory.
+
+  -encrypt-key-file=<path>
+                         Encrypt the tarball with AES-GCM, using the
+                         base64-encoded key in the given file. Requires
+                         the "gzip" archive format. The key ID is recorded
+                         in the manifest.
+
+  -encrypt-key-env=<name>
+                         Like -encrypt-key-file, but reads the key from
+                         the given environment variable.
+
+  -format=<fmt>          Output format, either "text" (the default) or
+                         "json". JSON output is one event object per line,
+                         ending with a "result" event.
+
+  -quiet                 Only print warnings and the final result.
+
+  -verbose               Print every progress update on its own line, and
+                         the time taken by each phase.
+
+  -log-level=<level>     Write diagnostic logs at the given level or above.
+                         One of DEBUG, INFO, WARN or ERR. Defaults to INFO
+                         if only -log-file is given.
+
+  -log-file=<path>       Append diagnostic logs to the given file instead
+                         of writing them to stderr.
+
+  -map-size=<bytes>      Map size to open the LMDB environment with. By
+                         default it is derived from the size of the data.
+
+  -copy-source           Migrate from a point-in-time copy of the LMDB
+                         environment instead of the live data. Consul must
+                         still be stopped. The original data.mdb is
+                         checksummed before and after to make sure it was
+                         not modified.
+
+  -scratch-dir=<path>    Directory to make the copy in when using
+                         -copy-source. Defaults to the system temp
+                         directory, and needs as much free space as the
+                         LMDB data.
+
+  -discard-partial       Always discard a "raft.db.temp" file left behind
+                         by an earlier run which was killed. By default,
+                         if it was synced, its logs are checked against
+                         LMDB, and the copy resumes after them if they
+                         all match.
+
+  -salvage               Keep going if some logs can't be read from LMDB.
+                         Each unreadable log is written, with its raw
+                         bytes, to a quarantine file and left out of the
+                         new store. Use with care, since Raft expects its
+                         logs to have no gaps.
+
+  -quarantine-path=<path>
+                         Location of the quarantine file when salvaging.
+                         Defaults to "quarantine.json" in the raft
+                         directory.
+
+  -validate=<mode>       How to check the source data against the Raft
+                         invariants, such as logs having no gaps and terms
+                         never decreasing. "warn" reports problems, "strict"
+                         also fails the migration on any error, and "off"
+                         skips the checks. Defaults to "warn".
+
+  -rewrite-address=<old>=<new>
+                         Rewrite a server address while migrating, for
+                         servers rebuilt on a new network. Either both are
+                         host:port, or both are a host and the port is
+                         kept. LastVoteCand, peers.json, peer changes in
+                         the logs and snapshot metadata are rewritten. May
+                         be repeated.
+
+  -pre-hook=<command>    Shell command to run before the migration starts,
+                         such as stopping the Consul agent. If it fails,
+                         the migration is aborted. May be given multiple
+                         times to run several commands in order.
+
+  -post-hook=<command>   Shell command to run once the migration has been
+                         completed and verified. May be repeated.
+
+  -failure-hook=<command>
+                         Shell command to run if the migration fails. May
+                         be repeated.
+
+  -hook-timeout=<dur>    How long each hook may run before it is killed,
+                         along with anything it started. Defaults to 5m.
+
+  -statsd-addr=<addr>    Send timing and throughput metrics to the statsd
+                         server at the given host:port over UDP.
+
+  -prometheus-file=<path>
+                         Write metrics in the Prometheus text format to the
+                         given file, for the node exporter's textfile
+                         collector.
 `
 }
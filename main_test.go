@@ -1,12 +1,75 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/hashicorp/consul-migrate/fixture"
+	"github.com/hashicorp/consul-migrate/migrator"
+	"github.com/hashicorp/raft"
 )
 
+// testDataDir creates a Consul data-dir containing a copy of the MDB
+// fixture data from the migrator package.
+func testDataDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	mdbPath := filepath.Join(dir, "raft", "mdb")
+	if err := os.MkdirAll(mdbPath, 0700); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, file := range []string{"data.mdb", "lock.mdb"} {
+		src, err := os.Open(filepath.Join("migrator", "test-fixtures", "raft", "mdb", file))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		dest, err := os.Create(filepath.Join(mdbPath, file))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if _, err := io.Copy(dest, src); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		src.Close()
+		dest.Close()
+	}
+	return dir
+}
+
+// captureStdout redirects stdout into a temp file while fn runs, and
+// returns everything written.
+func captureStdout(t *testing.T, fn func()) string {
+	fh, err := ioutil.TempFile("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(fh.Name())
+
+	stdoutOrig := *os.Stdout
+	os.Stdout = fh
+	fn()
+	os.Stdout = &stdoutOrig
+
+	if _, err := fh.Seek(0, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	out, err := ioutil.ReadAll(fh)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return string(out)
+}
+
 func TestMain_fails(t *testing.T) {
 	// Returns 1 on bad args
 	if code := realMain([]string{}); code != 1 {
@@ -82,3 +145,606 @@ func TestMain_noop(t *testing.T) {
 		t.Fatalf("bad: %s", string(out))
 	}
 }
+
+func TestMain_copy(t *testing.T) {
+	dir := testDataDir(t)
+	defer os.RemoveAll(dir)
+
+	// Fails on bad args and unknown backends
+	if code := realMain([]string{"consul-migrate", "copy", "inmem://"}); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if code := realMain([]string{"consul-migrate", "copy", "nope://", "inmem://"}); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	// Copy the MDB data into an export file
+	export := filepath.Join(dir, "raft.export")
+	var code int
+	out := captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "copy",
+			"mdb://" + filepath.Join(dir, "raft"), "export-file://" + export})
+	})
+	if code != 0 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+	if !strings.Contains(out, "Copied") {
+		t.Fatalf("bad: %s", out)
+	}
+	if _, err := os.Stat(export); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The source should not be modified
+	if _, err := os.Stat(filepath.Join(dir, "raft", "mdb")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The export file can be used as a source
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "copy",
+			"export-file://" + export, "inmem://"})
+	})
+	if code != 0 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+
+	// Copying into the export file again needs -overwrite
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "copy",
+			"mdb://" + filepath.Join(dir, "raft"), "export-file://" + export})
+	})
+	if code != 1 || !strings.Contains(out, "already holds") {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "copy", "-overwrite",
+			"mdb://" + filepath.Join(dir, "raft"), "export-file://" + export})
+	})
+	if code != 0 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+
+	// A destination created by a failed copy is removed
+	empty := filepath.Join(dir, "empty.export")
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "copy", "inmem://", "export-file://" + empty})
+	})
+	if code != 1 || !strings.Contains(out, "Copy failed") {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+	if _, err := os.Stat(empty); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The source is not created if it is missing
+	missing := filepath.Join(dir, "missing")
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "copy", "mdb://" + missing, "inmem://"})
+	})
+	if code != 1 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+// parseJSONEvents decodes newline-delimited JSON output.
+func parseJSONEvents(t *testing.T, out string) []map[string]interface{} {
+	var events []map[string]interface{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		var event map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("bad line %q: %s", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		t.Fatalf("no events in output")
+	}
+	return events
+}
+
+func TestMain_json(t *testing.T) {
+	dir := testDataDir(t)
+	defer os.RemoveAll(dir)
+
+	var code int
+	out := captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "-format=json", dir})
+	})
+	if code != 0 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+
+	events := parseJSONEvents(t, out)
+	if events[0]["event"] != "phase_started" || events[0]["phase"] != "stable-store" {
+		t.Fatalf("bad: %v", events[0])
+	}
+	seen := make(map[string]bool)
+	for _, event := range events {
+		seen[event["event"].(string)] = true
+	}
+	for _, kind := range []string{"progress", "phase_completed"} {
+		if !seen[kind] {
+			t.Fatalf("missing %s event", kind)
+		}
+	}
+
+	result := events[len(events)-1]
+	if result["event"] != "result" || result["status"] != "migrated" {
+		t.Fatalf("bad: %v", result)
+	}
+	if result["logs_copied"].(float64) < 1 || result["last_index"].(float64) < 1 {
+		t.Fatalf("bad: %v", result)
+	}
+	if _, ok := result["duration"]; !ok {
+		t.Fatalf("missing duration: %v", result)
+	}
+	durations, ok := result["phase_durations"].(map[string]interface{})
+	if !ok || len(durations) != 4 {
+		t.Fatalf("bad: %v", result)
+	}
+
+	// Running again is a no-op
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "-format=json", dir})
+	})
+	if code != 0 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+	events = parseJSONEvents(t, out)
+	if len(events) != 1 || events[0]["status"] != "noop" {
+		t.Fatalf("bad: %v", events)
+	}
+}
+
+func TestMain_json_fails(t *testing.T) {
+	var code int
+	out := captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "-format=json", "/unicorns"})
+	})
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	events := parseJSONEvents(t, out)
+	result := events[len(events)-1]
+	if result["status"] != "failed" || result["error_class"] != "config" || result["error"] == "" {
+		t.Fatalf("bad: %v", result)
+	}
+
+	// Configuration errors are reported as a result event too
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "-format=json", "-quiet", "-verbose", "/unicorns"})
+	})
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	events = parseJSONEvents(t, out)
+	if len(events) != 1 || events[0]["status"] != "failed" || events[0]["error_class"] != "config" {
+		t.Fatalf("bad: %v", events)
+	}
+
+	// Fails on an unknown format
+	if code := realMain([]string{"consul-migrate", "-format=xml", "/unicorns"}); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+}
+
+func TestMain_quiet(t *testing.T) {
+	dir := testDataDir(t)
+	defer os.RemoveAll(dir)
+
+	// Can't be both quiet and verbose
+	if code := realMain([]string{"consul-migrate", "-quiet", "-verbose", dir}); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	var code int
+	out := captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "-quiet", dir})
+	})
+	if code != 0 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+	if !strings.HasPrefix(out, "Migration completed") {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestMain_logFile(t *testing.T) {
+	dir := testDataDir(t)
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "migrate.log")
+
+	// Fails on a bad log level
+	if code := realMain([]string{"consul-migrate", "-log-level=loud", dir}); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	var code int
+	out := captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "-log-file=" + logFile, dir})
+	})
+	if code != 0 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+
+	buf, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	logs := string(buf)
+	if !strings.Contains(logs, "[INFO] migrator: Source log store has indexes") {
+		t.Fatalf("bad: %s", logs)
+	}
+	if strings.Contains(logs, "[DEBUG]") {
+		t.Fatalf("should not log debug: %s", logs)
+	}
+
+	// Log lines never end up in the regular output
+	if strings.Contains(out, "[INFO]") {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestMain_verify(t *testing.T) {
+	dir := testDataDir(t)
+	defer os.RemoveAll(dir)
+
+	// Fails without a manifest
+	if code := realMain([]string{"consul-migrate", "verify"}); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if code := realMain([]string{"consul-migrate", "verify", dir}); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	// Migrate, which writes the manifest
+	var code int
+	out := captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", dir})
+	})
+	if code != 0 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+	if !strings.Contains(out, "Migration manifest written") {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// Verify using the data-dir, and the manifest path
+	manifest := filepath.Join(dir, "raft", "migration-manifest.json")
+	for _, args := range [][]string{{dir}, {"-manifest=" + manifest}} {
+		out = captureStdout(t, func() {
+			code = realMain(append([]string{"consul-migrate", "verify"}, args...))
+		})
+		if code != 0 {
+			t.Fatalf("bad: %d %s", code, out)
+		}
+		if !strings.Contains(out, "Verification passed") {
+			t.Fatalf("bad: %s", out)
+		}
+	}
+}
+
+func TestMain_generateFixture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var code int
+	out := captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "generate-fixture",
+			"-logs=500", "-first-index=10", "-types=command=3,noop=1",
+			"-gaps=100:2", "-stable-uint64=CurrentTerm=7", dir})
+	})
+	if code != 0 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+	if !strings.Contains(out, "Wrote 500 logs (indexes 10 to 511") {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// The generated store can be migrated
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "-salvage", dir})
+	})
+	if code != 0 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+}
+
+func TestParseGenerateOptions(t *testing.T) {
+	types, err := parseLogTypes("command=9,add-peer=1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(types) != 2 || types[raft.LogCommand] != 9 || types[raft.LogAddPeer] != 1 {
+		t.Fatalf("bad: %v", types)
+	}
+	for _, bad := range []string{"command", "bogus=1", "noop=x"} {
+		if _, err := parseLogTypes(bad); err == nil {
+			t.Fatalf("%s: should fail", bad)
+		}
+	}
+
+	gaps, err := parseGaps("50:10,200:1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expect := []fixture.Gap{{Start: 50, Length: 10}, {Start: 200, Length: 1}}
+	if !reflect.DeepEqual(gaps, expect) {
+		t.Fatalf("bad: %v", gaps)
+	}
+	for _, bad := range []string{"50", "x:1", "50:y"} {
+		if _, err := parseGaps(bad); err == nil {
+			t.Fatalf("%s: should fail", bad)
+		}
+	}
+}
+
+// testExportFile writes an export file holding logs 1 to last.
+func testExportFile(t *testing.T, path string, last uint64, term uint64) {
+	store, err := migrator.OpenBackend("export-file://" + path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for i := uint64(1); i <= last; i++ {
+		if err := store.StoreLog(&raft.Log{Index: i, Term: term, Data: []byte("foo")}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := store.Set([]byte("CurrentTerm"), []byte{0, 0, 0, 0, 0, 0, 0, byte(term)}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestMain_diff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a.export")
+	b := filepath.Join(dir, "b.export")
+	testExportFile(t, a, 10, 1)
+	testExportFile(t, b, 12, 2)
+
+	// The same store is always the same
+	var code int
+	out := captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "diff", "export-file://" + a, "export-file://" + a})
+	})
+	if code != 0 || !strings.Contains(out, "Stores are the same") {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "diff", "export-file://" + a, "export-file://" + b})
+	})
+	if code != 2 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+	for _, expect := range []string{
+		"Store A has indexes 1 to 10, store B has indexes 1 to 12",
+		"Missing from A: logs 11 to 12",
+		"Log 1 differs: term 1 != 2",
+		"Stable key 'CurrentTerm' differs: 1 in A, 2 in B",
+		"Stores differ",
+	} {
+		if !strings.Contains(out, expect) {
+			t.Fatalf("missing %q: %s", expect, out)
+		}
+	}
+
+	// Needs exactly two stores
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "diff", "export-file://" + a})
+	})
+	if code != 1 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+}
+
+func TestMain_diff_backups(t *testing.T) {
+	// A renamed backup can be compared with the migrated store
+	dir := testDataDir(t)
+	defer os.RemoveAll(dir)
+	raftPath := filepath.Join(dir, "raft")
+	if code := realMain([]string{"consul-migrate", "-quiet", dir}); code != 0 {
+		t.Fatalf("bad: %d", code)
+	}
+	var code int
+	out := captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "diff",
+			"mdb://" + filepath.Join(raftPath, "mdb.backup"), "bolt://" + filepath.Join(raftPath, "raft.db")})
+	})
+	if code != 0 || !strings.Contains(out, "Stores are the same") {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+
+	// So can an encrypted archive, given the key
+	dir = testDataDir(t)
+	defer os.RemoveAll(dir)
+	raftPath = filepath.Join(dir, "raft")
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=\n"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if code := realMain([]string{"consul-migrate", "-quiet", "-archive-format=gzip",
+		"-encrypt-key-file=" + keyFile, dir}); code != 0 {
+		t.Fatalf("bad: %d", code)
+	}
+	archive := "mdb-archive://" + filepath.Join(raftPath, "mdb.backup.tar.gz")
+	bolt := "bolt://" + filepath.Join(raftPath, "raft.db")
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "diff", archive + "?key-file=" + keyFile, bolt})
+	})
+	if code != 0 || !strings.Contains(out, "Stores are the same") {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "diff", archive, bolt})
+	})
+	if code != 1 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+}
+
+func TestMain_validate(t *testing.T) {
+	dir := testDataDir(t)
+	defer os.RemoveAll(dir)
+
+	var code int
+	out := captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "-validate=bogus", dir})
+	})
+	if code != 1 || !strings.Contains(out, "Unsupported validation mode 'bogus'") {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+
+	// Generate a store whose CurrentTerm is behind its logs
+	genDir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(genDir)
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "generate-fixture",
+			"-term-every=10", "-stable-uint64=CurrentTerm=1", genDir})
+	})
+	if code != 0 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+
+	// Strict validation refuses to migrate it
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "-validate=strict", "-format=json", genDir})
+	})
+	if code != 1 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	var result map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &result); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result["error_class"] != "validation" {
+		t.Fatalf("bad: %v", result)
+	}
+	violations, ok := result["violations"].([]interface{})
+	if !ok || len(violations) != 1 {
+		t.Fatalf("bad: %v", result["violations"])
+	}
+
+	// By default it is migrated with a warning
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", genDir})
+	})
+	if code != 0 || !strings.Contains(out, "CurrentTerm 1 is lower than term 10 of the last log") {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+}
+
+func TestParseAddressMap(t *testing.T) {
+	addrs, err := parseAddressMap([]string{"10.0.0.1:8300=10.1.0.1:8300", "10.0.0.2=10.1.0.2"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expect := map[string]string{"10.0.0.1:8300": "10.1.0.1:8300", "10.0.0.2": "10.1.0.2"}
+	if !reflect.DeepEqual(addrs, expect) {
+		t.Fatalf("bad: %v", addrs)
+	}
+	if addrs, err := parseAddressMap(nil); err != nil || addrs != nil {
+		t.Fatalf("bad: %v %v", addrs, err)
+	}
+	for _, bad := range [][]string{{"10.0.0.1"}, {"=10.1.0.1"}, {"10.0.0.1=10.1.0.1", "10.0.0.1=10.1.0.2"}} {
+		if _, err := parseAddressMap(bad); err == nil {
+			t.Fatalf("%v: should fail", bad)
+		}
+	}
+}
+
+func TestMain_encryptedExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=\n"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	plain := filepath.Join(dir, "plain.export")
+	testExportFile(t, plain, 10, 1)
+
+	// Copy into an encrypted export file and read it back with the key
+	encrypted := "export-file://" + filepath.Join(dir, "encrypted.export") + "?key-file=" + keyFile
+	var code int
+	out := captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "copy", "export-file://" + plain, encrypted})
+	})
+	if code != 0 {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "diff", "export-file://" + plain, encrypted})
+	})
+	if code != 0 || !strings.Contains(out, "Stores are the same") {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+
+	// It can't be opened without the key
+	out = captureStdout(t, func() {
+		code = realMain([]string{"consul-migrate", "diff", "export-file://" + plain,
+			"export-file://" + filepath.Join(dir, "encrypted.export")})
+	})
+	if code != 1 || !strings.Contains(out, "no key was given") {
+		t.Fatalf("bad: %d %s", code, out)
+	}
+}
+
+func TestMain_decrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "plain")
+	if err := ioutil.WriteFile(src, []byte("hello"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []struct {
+		args   []string
+		expect string
+	}{
+		{[]string{src, filepath.Join(dir, "out")}, "One of -key-file or -key-env is required"},
+		{[]string{"-key-file=" + keyFile, "-key-env=FOO", src, filepath.Join(dir, "out")}, "Only one of"},
+		{[]string{"-key-file=" + keyFile, src, filepath.Join(dir, "out")}, "data is not encrypted"},
+		{[]string{"-key-file=" + keyFile, src}, "Usage: consul-migrate decrypt"},
+	}
+	for _, c := range cases {
+		var code int
+		out := captureStdout(t, func() {
+			code = realMain(append([]string{"consul-migrate", "decrypt"}, c.args...))
+		})
+		if code != 1 || !strings.Contains(out, c.expect) {
+			t.Fatalf("%v: bad: %d %s", c.args, code, out)
+		}
+	}
+}
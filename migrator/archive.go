@@ -0,0 +1,374 @@
+package migrator
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Supported formats for archiving the LMDB data after a migration.
+	// ArchiveRename moves the directory aside, while ArchiveGzip writes
+	// a compressed tarball and removes the original directory.
+	ArchiveRename = "rename"
+	ArchiveGzip   = "gzip"
+
+	// Default name of the compressed archive in the raft directory, and
+	// the suffix of the checksum file written next to it.
+	mdbArchiveFile     = "mdb.backup.tar.gz"
+	archiveChecksumExt = ".sha256"
+	archiveTempExt     = ".temp"
+)
+
+// validArchiveFormat checks if the given archive format is supported.
+func validArchiveFormat(format string) bool {
+	switch format {
+	case ArchiveRename, ArchiveGzip:
+		return true
+	}
+	return false
+}
+
+// archivePath returns the path the compressed archive is written to.
+func (m *Migrator) archivePath() string {
+	if m.ArchivePath != "" {
+		return m.ArchivePath
+	}
+	return filepath.Join(m.raftPath, mdbArchiveFile)
+}
+
+// compressMDBStore writes the LMDB data directory into a gzip-compressed
+// tarball, along with a file containing its SHA-256 checksum. The archive
+// is read back and compared against the original files before the LMDB
+// directory is removed, so a bad archive never costs us the only copy.
+// If an EncryptionKey is set, the archive is encrypted with it.
+func (m *Migrator) compressMDBStore() error {
+	path := m.archivePath()
+	tempPath := path + archiveTempExt
+	defer os.Remove(tempPath)
+
+	// Write the archive to a temporary location first
+	checksum, fileSums, err := writeArchive(m.mdbPath, tempPath, m.EncryptionKey, func(done, total int) {
+		m.sendProgress(PhaseArchive, done, total+1)
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing archive: %s", err)
+	}
+
+	// Read the archive back to make sure it is intact
+	if err := verifyArchive(tempPath, checksum, fileSums, m.EncryptionKey); err != nil {
+		return fmt.Errorf("Error verifying archive: %s", err)
+	}
+
+	// Write out the checksum in the same format as sha256sum
+	sumLine := fmt.Sprintf("%s  %s\n", checksum, filepath.Base(path))
+	if err := m.fs.WriteFile(path+archiveChecksumExt, []byte(sumLine), 0600); err != nil {
+		return fmt.Errorf("Error writing checksum: %s", err)
+	}
+
+	// Move the archive into place and remove the original data
+	if err := m.fs.Rename(tempPath, path); err != nil {
+		os.Remove(path + archiveChecksumExt)
+		return err
+	}
+	m.Logger.Printf("[INFO] migrator: Verified archive '%s' (sha256 %s)", path, checksum)
+	m.report.ArchivePath = path
+	m.report.ArchiveChecksum = checksum
+	if m.EncryptionKey != nil {
+		m.report.ArchiveKeyID = m.EncryptionKey.ID()
+	}
+
+	// The data is safe in the archive by now, and some of it may already
+	// be gone, so failing to remove it must not fail the migration
+	if err := m.fs.RemoveAll(m.mdbPath); err != nil {
+		m.warn(fmt.Sprintf("LMDB data was archived to '%s' but '%s' could not be removed "+
+			"and must be removed by hand: %s", path, m.mdbPath, err))
+		return nil
+	}
+	m.Logger.Printf("[INFO] migrator: Removed LMDB data in '%s'", m.mdbPath)
+	return nil
+}
+
+// writeArchive creates a gzip-compressed tarball at path containing all
+// of the files in dir, encrypted if a key is given. Returns the SHA-256
+// checksum of the archive, and the checksums of each of the archived
+// files, keyed by entry name.
+func writeArchive(dir, path string, key *EncryptionKey,
+	progress func(done, total int)) (string, map[string]string, error) {
+	files, err := archiveFiles(dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", nil, err
+	}
+	defer fh.Close()
+
+	archiveHash := sha256.New()
+	var w io.Writer = io.MultiWriter(fh, archiveHash)
+	var enc *encryptWriter
+	if key != nil {
+		if enc, err = newEncryptWriter(w, key); err != nil {
+			return "", nil, err
+		}
+		w = enc
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	fileSums := make(map[string]string, len(files))
+	for i, file := range files {
+		name, sum, err := archiveFile(tw, dir, file)
+		if err != nil {
+			return "", nil, err
+		}
+		fileSums[name] = sum
+		progress(i+1, len(files))
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return "", nil, err
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := fh.Sync(); err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(archiveHash.Sum(nil)), fileSums, nil
+}
+
+// archiveFiles returns the regular files within dir, recursively.
+func archiveFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// archiveFile writes a single file into the tarball. Returns the name
+// of the tar entry and the SHA-256 checksum of the file contents.
+func archiveFile(tw *tar.Writer, dir, path string) (string, string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer fh.Close()
+
+	info, err := fh.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return "", "", err
+	}
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return "", "", err
+	}
+	hdr.Name = filepath.ToSlash(filepath.Join(mdbDir, rel))
+	if err := tw.WriteHeader(hdr); err != nil {
+		return "", "", err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, hash), fh); err != nil {
+		return "", "", err
+	}
+	return hdr.Name, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readArchive reads every entry of an archive, decrypting it with the
+// given key, to make sure it is intact.
+func readArchive(path string, key *EncryptionKey) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	var r io.Reader = fh
+	if key != nil {
+		if r, err = newDecryptReader(fh, key); err != nil {
+			return err
+		}
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// extractArchive extracts an archive created by writeArchive into dir,
+// decrypting it with the given key, so that the LMDB data is at
+// dir/mdb. Entries outside of the mdb directory are refused.
+func extractArchive(path, dir string, key *EncryptionKey) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	var r io.Reader = fh
+	if id, ok, err := EncryptedKeyID(path); err != nil {
+		return err
+	} else if ok {
+		if err := checkKeyID(id, key); err != nil {
+			return err
+		}
+		if r, err = newDecryptReader(fh, key); err != nil {
+			return err
+		}
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if rel, err := filepath.Rel(mdbDir, name); err != nil || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("archive entry '%s' is outside of the '%s' directory", hdr.Name, mdbDir)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		target := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+
+	// Read to the end so the gzip checksum is checked, and an encrypted
+	// archive is fully authenticated
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// verifyArchive reads back an archive created by writeArchive, given
+// the key it was encrypted with, if any. The checksum of the archive
+// itself must match, and every expected file must be present with the
+// same contents.
+func verifyArchive(path, checksum string, fileSums map[string]string, key *EncryptionKey) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	archiveHash := sha256.New()
+	src := io.TeeReader(fh, archiveHash)
+	var r io.Reader = src
+	if key != nil {
+		if r, err = newDecryptReader(src, key); err != nil {
+			return err
+		}
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	seen := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		expect, ok := fileSums[hdr.Name]
+		if !ok {
+			return fmt.Errorf("unexpected entry '%s'", hdr.Name)
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, tr); err != nil {
+			return err
+		}
+		if sum := hex.EncodeToString(hash.Sum(nil)); sum != expect {
+			return fmt.Errorf("checksum mismatch for '%s'", hdr.Name)
+		}
+		seen++
+	}
+	if seen != len(fileSums) {
+		return fmt.Errorf("expected %d entries, found %d", len(fileSums), seen)
+	}
+
+	// Drain any trailing data so the whole file is hashed
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, src); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(archiveHash.Sum(nil)); sum != checksum {
+		return fmt.Errorf("archive checksum mismatch")
+	}
+	return nil
+}
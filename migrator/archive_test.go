@@ -0,0 +1,346 @@
+package migrator
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrator_migrate_gzipArchive(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	// Create the migrator
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.ArchiveFormat = ArchiveGzip
+
+	// Perform the migration
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The LMDB dir should be gone, and no backup dir created
+	if _, err := os.Stat(m.mdbPath); !os.IsNotExist(err) {
+		t.Fatalf("MDB dir was not removed")
+	}
+	if _, err := os.Stat(m.mdbBackupPath); !os.IsNotExist(err) {
+		t.Fatalf("should not create backup dir")
+	}
+
+	// Check the checksum file against the archive
+	path := filepath.Join(m.raftPath, mdbArchiveFile)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sum := sha256.Sum256(buf)
+	checksum := hex.EncodeToString(sum[:])
+	sumLine, err := ioutil.ReadFile(path + archiveChecksumExt)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.HasPrefix(string(sumLine), checksum) {
+		t.Fatalf("bad: %s", sumLine)
+	}
+	if report := m.Report(); report.ArchiveChecksum != checksum || report.ArchivePath != path {
+		t.Fatalf("bad: %#v", report)
+	}
+
+	// Ensure the original files are in the archive
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer fh.Close()
+	gz, err := gzip.NewReader(fh)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tr := tar.NewReader(gz)
+	found := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		found[hdr.Name] = true
+	}
+	for _, name := range []string{"mdb/data.mdb", "mdb/lock.mdb"} {
+		if !found[name] {
+			t.Fatalf("missing %s in archive", name)
+		}
+	}
+
+	// Running again should be a no-op
+	migrated, err := m.Migrate()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if migrated {
+		t.Fatalf("should not have migrated")
+	}
+}
+
+func TestMigrator_migrate_badArchiveFormat(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.ArchiveFormat = "rar"
+
+	if _, err := m.Migrate(); err == nil || !strings.Contains(err.Error(), "archive format") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Nothing should have been touched
+	if _, err := os.Stat(m.mdbPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(m.boltTempPath); !os.IsNotExist(err) {
+		t.Fatalf("should not create temp bolt file")
+	}
+}
+
+func TestVerifyArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0700); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "data.mdb"), []byte("hello"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	path := filepath.Join(dir, "archive.tar.gz")
+	checksum, fileSums, err := writeArchive(src, path, nil, func(int, int) {})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := verifyArchive(path, checksum, fileSums, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Fails on a checksum mismatch
+	if err := verifyArchive(path, "nope", fileSums, nil); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Fails if file contents differ
+	fileSums["mdb/data.mdb"] = "nope"
+	if err := verifyArchive(path, checksum, fileSums, nil); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Fails if files are missing
+	fileSums["mdb/lock.mdb"] = "nope"
+	if err := verifyArchive(path, checksum, fileSums, nil); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestMigrator_migrate_encryptedArchive(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	key := testKey(t, 1)
+	m.ArchiveFormat = ArchiveGzip
+	m.EncryptionKey = key
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The archive can only be read with the key
+	report := m.Report()
+	if report.ArchiveKeyID != key.ID() {
+		t.Fatalf("bad: %#v", report)
+	}
+	if id, ok, err := EncryptedKeyID(report.ArchivePath); err != nil || !ok || id != key.ID() {
+		t.Fatalf("bad: %s %v %v", id, ok, err)
+	}
+	if err := readArchive(report.ArchivePath, nil); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := readArchive(report.ArchivePath, key); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The key ID is in the manifest, and verify decrypts the archive
+	man, err := ReadManifest(report.ManifestPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if man.Files[1].KeyID != key.ID() {
+		t.Fatalf("bad: %#v", man.Files[1])
+	}
+	result, err := VerifyManifestWithKey(report.ManifestPath, key)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !result.OK() || result.FilesDecrypted != 1 {
+		t.Fatalf("bad: %#v", result)
+	}
+	result, err = VerifyManifest(report.ManifestPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !result.OK() || len(result.FilesNotDecrypted) != 1 {
+		t.Fatalf("bad: %#v", result)
+	}
+	if _, err := VerifyManifestWithKey(report.ManifestPath, testKey(t, 2)); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestMigrator_migrate_encryptRequiresGzip(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.EncryptionKey = testKey(t, 1)
+
+	_, err = m.Migrate()
+	if ErrorClassOf(err) != ErrClassConfig {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := os.Stat(m.mdbPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestVerifyArchive_encrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0700); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "data.mdb"), []byte("hello"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	key := testKey(t, 1)
+	path := filepath.Join(dir, "archive.tar.gz")
+	checksum, fileSums, err := writeArchive(src, path, key, func(int, int) {})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := verifyArchive(path, checksum, fileSums, key); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The checksum covers the encrypted file
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if sum := sha256.Sum256(buf); hex.EncodeToString(sum[:]) != checksum {
+		t.Fatalf("bad: %s", checksum)
+	}
+
+	// It can't be read without the right key
+	if err := verifyArchive(path, checksum, fileSums, nil); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := verifyArchive(path, checksum, fileSums, testKey(t, 2)); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Decrypting it gives a plain archive
+	plain := filepath.Join(dir, "plain.tar.gz")
+	if err := DecryptFile(path, plain, key); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := readArchive(plain, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0700); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "data.mdb"), []byte("hello"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	key := testKey(t, 1)
+	path := filepath.Join(dir, "archive.tar.gz")
+	if _, _, err := writeArchive(src, path, key, func(int, int) {}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// It can't be extracted without the right key
+	out := filepath.Join(dir, "out")
+	if err := extractArchive(path, out, nil); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := extractArchive(path, out, key); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(out, mdbDir, "data.mdb"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("bad: %q", buf)
+	}
+
+	// Entries outside of the mdb directory are refused
+	evil := filepath.Join(dir, "evil.tar.gz")
+	fh, err := os.Create(evil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	gz := gzip.NewWriter(fh)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "mdb/../../evil", Mode: 0600, Size: 4, Typeflag: tar.TypeReg})
+	tw.Write([]byte("evil"))
+	tw.Close()
+	gz.Close()
+	fh.Close()
+	if err := extractArchive(evil, out, nil); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil")); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package migrator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+	"github.com/hashicorp/raft-mdb"
+)
+
+// Backend is a Raft storage format which data can be copied out of or
+// into. It provides both the log store and the stable store, since
+// Raft keeps both in the same place.
+type Backend interface {
+	raft.LogStore
+	raft.StableStore
+	Close() error
+}
+
+// BackendFactory opens a Backend given the URI it was selected with.
+// The path portion of the URI is usually the location on disk, and
+// the query may carry backend-specific options.
+type BackendFactory func(u *url.URL) (Backend, error)
+
+var (
+	// backends holds the registered backend factories by name
+	backends     = make(map[string]BackendFactory)
+	backendsLock sync.RWMutex
+)
+
+func init() {
+	RegisterBackend("mdb", mdbBackend)
+	RegisterBackend("bolt", boltBackend)
+	RegisterBackend("inmem", inmemBackend)
+	RegisterBackend("export-file", exportBackend)
+	RegisterBackend("mdb-archive", archiveBackend)
+}
+
+// RegisterBackend makes a backend available under the given name, so
+// that it can be selected using URIs like "name:///path". Registering
+// the same name twice is a programming error and panics.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if factory == nil {
+		panic("migrator: RegisterBackend factory is nil")
+	}
+	if _, ok := backends[name]; ok {
+		panic("migrator: RegisterBackend called twice for " + name)
+	}
+	backends[name] = factory
+}
+
+// Backends returns the sorted names of all registered backends.
+func Backends() []string {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenBackend parses the given URI and opens the backend it selects,
+// for example "bolt:///var/consul/raft/raft.db". The scheme is the
+// name the backend was registered with.
+func OpenBackend(uri string) (Backend, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid backend URI '%s': %s", uri, err)
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("Missing backend name in URI '%s'", uri)
+	}
+
+	backendsLock.RLock()
+	factory, ok := backends[u.Scheme]
+	backendsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown backend '%s'", u.Scheme)
+	}
+	return factory(u)
+}
+
+// OpenBackendReadOnly is like OpenBackend, but asks the backend to open
+// the store read-only, by setting the "read-only" query parameter. The
+// mdb and bolt backends then leave the files on disk unchanged, and the
+// other built-in backends never change anything unless written to.
+func OpenBackendReadOnly(uri string) (Backend, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid backend URI '%s': %s", uri, err)
+	}
+	query := u.Query()
+	query.Set("read-only", "true")
+	u.RawQuery = query.Encode()
+	return OpenBackend(u.String())
+}
+
+// backendReadOnly returns whether a backend URI asks for the store to
+// be opened read-only.
+func backendReadOnly(u *url.URL) (bool, error) {
+	raw := u.Query().Get("read-only")
+	if raw == "" {
+		return false, nil
+	}
+	readOnly, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("Invalid read-only value '%s': %s", raw, err)
+	}
+	return readOnly, nil
+}
+
+// BackendPath returns the filesystem path given in a backend URI, or an
+// empty string if it has none, such as for the inmem backend.
+func BackendPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	path, _ := backendPath(u)
+	return path
+}
+
+// backendPath returns the filesystem path from a backend URI. Both the
+// absolute form (bolt:///abs/raft.db) and relative forms (bolt:raft.db
+// or bolt://raft.db) are accepted.
+func backendPath(u *url.URL) (string, error) {
+	path := u.Host + u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return "", fmt.Errorf("Missing path for backend '%s'", u.Scheme)
+	}
+	return path, nil
+}
+
+// mdbBackend opens an LMDB store. The path is the raft directory which
+// contains the "mdb" sub-directory, or an LMDB directory itself, such
+// as an "mdb.backup" directory, which is always opened read-only. The
+// map size is derived from the data unless given using the "size" query
+// parameter, in bytes.
+func mdbBackend(u *url.URL) (Backend, error) {
+	path, err := backendPath(u)
+	if err != nil {
+		return nil, err
+	}
+	readOnly, err := backendReadOnly(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var size uint64
+	if raw := u.Query().Get("size"); raw != "" {
+		if size, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid map size '%s': %s", raw, err)
+		}
+	}
+
+	// raft-mdb always opens the "mdb" sub-directory for writing
+	dir := filepath.Join(path, mdbDir)
+	if _, err := os.Stat(filepath.Join(path, mdbDataFile)); err == nil {
+		dir, readOnly = path, true
+	}
+	if size, err = mdbMapSize(dir, size); err != nil {
+		return nil, err
+	}
+	if readOnly {
+		return newMDBReadStore(dir, size)
+	}
+	return raftmdb.NewMDBStoreWithSize(path, size)
+}
+
+// archiveBackend opens the LMDB data in a compressed archive written by
+// a migration, such as "mdb.backup.tar.gz", read-only. The archive is
+// extracted to a temporary directory, after decrypting it with the key
+// given by the "key-file" or "key-env" query parameter if encrypted.
+func archiveBackend(u *url.URL) (Backend, error) {
+	path, err := backendPath(u)
+	if err != nil {
+		return nil, err
+	}
+	key, err := backendKey(u)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		return nil, err
+	}
+	if err := extractArchive(path, dir, key); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("Error extracting '%s': %s", path, err)
+	}
+	mdbPath := filepath.Join(dir, mdbDir)
+	size, err := mdbMapSize(mdbPath, 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	store, err := newMDBReadStore(mdbPath, size)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &archiveStore{mdbReadStore: store, dir: dir}, nil
+}
+
+// boltBackend opens a BoltDB file at the given path.
+func boltBackend(u *url.URL) (Backend, error) {
+	path, err := backendPath(u)
+	if err != nil {
+		return nil, err
+	}
+	readOnly, err := backendReadOnly(u)
+	if err != nil {
+		return nil, err
+	}
+	if readOnly {
+		return newReadOnlyBoltStore(path)
+	}
+	return raftboltdb.NewBoltStore(path)
+}
+
+// inmemBackend creates a volatile in-memory store. This is mostly
+// useful as a destination to test reading a source end to end.
+func inmemBackend(u *url.URL) (Backend, error) {
+	return &inmemStore{raft.NewInmemStore()}, nil
+}
+
+// inmemStore adds a no-op Close to the Raft in-memory store.
+type inmemStore struct {
+	*raft.InmemStore
+}
+
+func (i *inmemStore) Close() error {
+	return nil
+}
@@ -0,0 +1,104 @@
+package migrator
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRegisterBackend(t *testing.T) {
+	RegisterBackend("test-backend", inmemBackend)
+	defer func() {
+		backendsLock.Lock()
+		delete(backends, "test-backend")
+		backendsLock.Unlock()
+	}()
+
+	found := false
+	for _, name := range Backends() {
+		if name == "test-backend" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("missing backend: %v", Backends())
+	}
+
+	// Registering twice panics
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("should panic")
+		}
+	}()
+	RegisterBackend("test-backend", inmemBackend)
+}
+
+func TestOpenBackend(t *testing.T) {
+	// Fails on a missing or unknown backend name
+	if _, err := OpenBackend("/var/consul"); err == nil || !strings.Contains(err.Error(), "Missing") {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := OpenBackend("unicorns:///var/consul"); err == nil || !strings.Contains(err.Error(), "Unknown") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Fails if a path is required but not given
+	if _, err := OpenBackend("bolt://"); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Opens an in-memory backend
+	b, err := OpenBackend("inmem://")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestOpenBackendReadOnly(t *testing.T) {
+	dir, path := testBoltPath(t)
+	defer os.RemoveAll(dir)
+
+	// A missing file is not created
+	if _, err := OpenBackendReadOnly("bolt://" + path); err == nil {
+		t.Fatalf("should fail")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Fails on a bad read-only value
+	if _, err := OpenBackend("bolt://" + path + "?read-only=maybe"); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestBackendPath(t *testing.T) {
+	cases := map[string]string{
+		"bolt:///var/consul/raft/raft.db": "/var/consul/raft/raft.db",
+		"bolt://raft/raft.db":             "raft/raft.db",
+		"bolt:raft/raft.db":               "raft/raft.db",
+	}
+	for uri, expect := range cases {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		path, err := backendPath(u)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if path != expect {
+			t.Fatalf("bad: %s => %s", uri, path)
+		}
+		if path := BackendPath(uri); path != expect {
+			t.Fatalf("bad: %s => %s", uri, path)
+		}
+	}
+	if path := BackendPath("inmem://"); path != "" {
+		t.Fatalf("bad: %s", path)
+	}
+}
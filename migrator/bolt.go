@@ -0,0 +1,231 @@
+package migrator
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// logBatchSize is the number of logs written in each transaction
+	// when copying the log store.
+	logBatchSize = 1024
+
+	// bulkFillPercent packs pages full, since logs are only ever
+	// appended in index order during a bulk load.
+	bulkFillPercent = 1.0
+
+	// boltOpenTimeout is how long to wait for the lock on a BoltDB
+	// file, which is held by any other process using it.
+	boltOpenTimeout = time.Second
+)
+
+var (
+	// Bucket names used by raft-boltdb
+	boltLogsBucket = []byte("logs")
+	boltConfBucket = []byte("conf")
+)
+
+// boltBucket returns the named bucket, or an error if the file doesn't have
+// it, such as a BoltDB file which was not written by raft-boltdb.
+func boltBucket(tx *bolt.Tx, name []byte) (*bolt.Bucket, error) {
+	b := tx.Bucket(name)
+	if b == nil {
+		return nil, fmt.Errorf("BoltDB file has no '%s' bucket", name)
+	}
+	return b, nil
+}
+
+// bulkBoltStore writes a BoltDB file in the same format as raft-boltdb,
+// tuned for a one-off bulk load. Commits are not synced to disk, and
+// pages are filled completely since logs are appended in order. The
+// file must be synced with Sync before it can be relied on, and should
+// be discarded if anything fails before that.
+type bulkBoltStore struct {
+	conn *bolt.DB
+}
+
+// newBulkBoltStore opens or creates a BoltDB file for bulk loading.
+func newBulkBoltStore(path string) (*bulkBoltStore, error) {
+	conn, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	conn.NoSync = true
+
+	// Create the buckets, like raft-boltdb does
+	err = conn.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltLogsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltConfBucket)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &bulkBoltStore{conn: conn}, nil
+}
+
+// Sync flushes everything written so far to disk.
+func (b *bulkBoltStore) Sync() error {
+	return b.conn.Sync()
+}
+
+func (b *bulkBoltStore) Close() error {
+	return b.conn.Close()
+}
+
+func (b *bulkBoltStore) FirstIndex() (uint64, error) {
+	var index uint64
+	err := b.conn.View(func(tx *bolt.Tx) error {
+		logs, err := boltBucket(tx, boltLogsBucket)
+		if err != nil {
+			return err
+		}
+		if first, _ := logs.Cursor().First(); first != nil {
+			index = bytesToUint64(first)
+		}
+		return nil
+	})
+	return index, err
+}
+
+func (b *bulkBoltStore) LastIndex() (uint64, error) {
+	var index uint64
+	err := b.conn.View(func(tx *bolt.Tx) error {
+		logs, err := boltBucket(tx, boltLogsBucket)
+		if err != nil {
+			return err
+		}
+		if last, _ := logs.Cursor().Last(); last != nil {
+			index = bytesToUint64(last)
+		}
+		return nil
+	})
+	return index, err
+}
+
+func (b *bulkBoltStore) GetLog(index uint64, log *raft.Log) error {
+	var val []byte
+	err := b.conn.View(func(tx *bolt.Tx) error {
+		logs, err := boltBucket(tx, boltLogsBucket)
+		if err != nil {
+			return err
+		}
+		if v := logs.Get(uint64ToBytes(index)); v != nil {
+			val = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return raft.ErrLogNotFound
+	}
+	return codec.NewDecoder(bytes.NewReader(val), &codec.MsgpackHandle{}).Decode(log)
+}
+
+func (b *bulkBoltStore) StoreLog(log *raft.Log) error {
+	return b.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs writes all of the logs in a single transaction.
+func (b *bulkBoltStore) StoreLogs(logs []*raft.Log) error {
+	return b.conn.Update(func(tx *bolt.Tx) error {
+		bucket, err := boltBucket(tx, boltLogsBucket)
+		if err != nil {
+			return err
+		}
+		bucket.FillPercent = bulkFillPercent
+		for _, log := range logs {
+			var buf bytes.Buffer
+			if err := codec.NewEncoder(&buf, &codec.MsgpackHandle{}).Encode(log); err != nil {
+				return fmt.Errorf("Error encoding log %d: %s", log.Index, err)
+			}
+			if err := bucket.Put(uint64ToBytes(log.Index), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *bulkBoltStore) DeleteRange(min, max uint64) error {
+	return b.conn.Update(func(tx *bolt.Tx) error {
+		logs, err := boltBucket(tx, boltLogsBucket)
+		if err != nil {
+			return err
+		}
+		cursor := logs.Cursor()
+		for k, _ := cursor.Seek(uint64ToBytes(min)); k != nil; k, _ = cursor.Next() {
+			if bytesToUint64(k) > max {
+				break
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *bulkBoltStore) Set(key []byte, val []byte) error {
+	return b.conn.Update(func(tx *bolt.Tx) error {
+		conf, err := boltBucket(tx, boltConfBucket)
+		if err != nil {
+			return err
+		}
+		return conf.Put(key, val)
+	})
+}
+
+func (b *bulkBoltStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := b.conn.View(func(tx *bolt.Tx) error {
+		conf, err := boltBucket(tx, boltConfBucket)
+		if err != nil {
+			return err
+		}
+		if v := conf.Get(key); v != nil {
+			val = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, errNotFound
+	}
+	return val, nil
+}
+
+func (b *bulkBoltStore) SetUint64(key []byte, val uint64) error {
+	return b.Set(key, uint64ToBytes(val))
+}
+
+func (b *bulkBoltStore) GetUint64(key []byte) (uint64, error) {
+	val, err := b.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return bytesToUint64(val), nil
+}
+
+// truncate removes all of the logs by recreating their bucket.
+func (b *bulkBoltStore) truncate() error {
+	return b.conn.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltLogsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(boltLogsBucket)
+		return err
+	})
+}
@@ -0,0 +1,170 @@
+package migrator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+)
+
+func testBoltPath(t testing.TB) (string, string) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return dir, filepath.Join(dir, boltFile)
+}
+
+func TestBulkBoltStore(t *testing.T) {
+	dir, path := testBoltPath(t)
+	defer os.RemoveAll(dir)
+
+	store, err := newBulkBoltStore(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: 2, Type: raft.LogCommand, Data: []byte("foo")})
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("CurrentTerm"), uint64ToBytes(2)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.DeleteRange(1, 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := store.Get([]byte("nope")); !isNotFound(err) {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The file can be read by raft-boltdb
+	bolt, err := raftboltdb.NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer bolt.Close()
+
+	first, _ := bolt.FirstIndex()
+	last, _ := bolt.LastIndex()
+	if first != 3 || last != 10 {
+		t.Fatalf("bad: %d %d", first, last)
+	}
+	log := &raft.Log{}
+	if err := bolt.GetLog(5, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if log.Index != 5 || log.Term != 2 || !bytes.Equal(log.Data, []byte("foo")) {
+		t.Fatalf("bad: %#v", log)
+	}
+	term, err := bolt.GetUint64([]byte("CurrentTerm"))
+	if err != nil || term != 2 {
+		t.Fatalf("bad: %d %v", term, err)
+	}
+}
+
+func TestBulkBoltStore_noBuckets(t *testing.T) {
+	dir, path := testBoltPath(t)
+	defer os.RemoveAll(dir)
+
+	// A BoltDB file which wasn't written by raft-boltdb
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	store, err := newReadOnlyBoltStore(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if _, err := store.FirstIndex(); err == nil || !strings.Contains(err.Error(), "bucket") {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := store.LastIndex(); err == nil || !strings.Contains(err.Error(), "bucket") {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := store.GetLog(1, &raft.Log{}); err == nil || !strings.Contains(err.Error(), "bucket") {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := store.Get([]byte("CurrentTerm")); err == nil || !strings.Contains(err.Error(), "bucket") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+// benchmarkLogs returns n logs with a typical payload size.
+func benchmarkLogs(n int) []*raft.Log {
+	data := bytes.Repeat([]byte("x"), 512)
+	logs := make([]*raft.Log, n)
+	for i := range logs {
+		logs[i] = &raft.Log{Index: uint64(i + 1), Term: 1, Data: data}
+	}
+	return logs
+}
+
+// storeBatches writes the logs in batches of logBatchSize.
+func storeBatches(b *testing.B, store raft.LogStore, logs []*raft.Log) {
+	for len(logs) > 0 {
+		n := logBatchSize
+		if n > len(logs) {
+			n = len(logs)
+		}
+		if err := store.StoreLogs(logs[:n]); err != nil {
+			b.Fatalf("err: %s", err)
+		}
+		logs = logs[n:]
+	}
+}
+
+// BenchmarkBoltStore_storeLogs writes batches of logs with a synced
+// commit for each, so it only differs from the bulk store by syncing.
+func BenchmarkBoltStore_storeLogs(b *testing.B) {
+	dir, path := testBoltPath(b)
+	defer os.RemoveAll(dir)
+	store, err := raftboltdb.NewBoltStore(path)
+	if err != nil {
+		b.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	logs := benchmarkLogs(b.N)
+	b.ResetTimer()
+	storeBatches(b, store, logs)
+}
+
+// BenchmarkBulkBoltStore_storeLogs writes the same batches of logs
+// without syncing, followed by the single final sync.
+func BenchmarkBulkBoltStore_storeLogs(b *testing.B) {
+	dir, path := testBoltPath(b)
+	defer os.RemoveAll(dir)
+	store, err := newBulkBoltStore(path)
+	if err != nil {
+		b.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	logs := benchmarkLogs(b.N)
+	b.ResetTimer()
+	storeBatches(b, store, logs)
+	if err := store.Sync(); err != nil {
+		b.Fatalf("err: %s", err)
+	}
+}
@@ -0,0 +1,236 @@
+package migrator
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// maxLogDiffs is the number of differing logs recorded in detail by
+	// Diff. Any more are only counted.
+	maxLogDiffs = 100
+)
+
+// IndexRange is an inclusive range of log indexes.
+type IndexRange struct {
+	First uint64
+	Last  uint64
+}
+
+func (r *IndexRange) String() string {
+	if r.First == r.Last {
+		return fmt.Sprintf("%d", r.First)
+	}
+	return fmt.Sprintf("%d to %d", r.First, r.Last)
+}
+
+// LogDiff describes a log which exists in both stores but differs.
+// Fields lists what differs, out of "term", "type" and "data".
+type LogDiff struct {
+	Index  uint64
+	Fields []string
+	TermA  uint64
+	TermB  uint64
+	TypeA  raft.LogType
+	TypeB  raft.LogType
+	SizeA  int
+	SizeB  int
+}
+
+// StableKeyDiff describes a stable store key whose value differs, or
+// which only exists in one of the stores. Values are nil if missing.
+type StableKeyDiff struct {
+	Key    string
+	ValueA []byte
+	ValueB []byte
+}
+
+// DiffResult holds the differences between two stores, A and B.
+type DiffResult struct {
+	FirstIndexA uint64
+	LastIndexA  uint64
+	FirstIndexB uint64
+	LastIndexB  uint64
+
+	// LogsCompared is the number of logs found in both stores.
+	LogsCompared int
+
+	// MissingA holds the ranges of logs which are only in B, and
+	// MissingB those which are only in A.
+	MissingA []*IndexRange
+	MissingB []*IndexRange
+
+	// LogsDiffering counts the logs which differ, the first of which
+	// are described in LogDiffs.
+	LogsDiffering int
+	LogDiffs      []*LogDiff
+
+	StableKeysCompared int
+	StableKeyDiffs     []*StableKeyDiff
+}
+
+// Equal returns whether no differences were found.
+func (d *DiffResult) Equal() bool {
+	return len(d.MissingA) == 0 && len(d.MissingB) == 0 &&
+		d.LogsDiffering == 0 && len(d.StableKeyDiffs) == 0
+}
+
+// Diff compares all of the Raft data in two stores. Unlike verifying
+// a migration, neither store needs to have been created from the other,
+// so it can compare servers against each other or a backup against the
+// current data. Diff only reads from the stores, so they may be opened
+// with OpenBackendReadOnly.
+func Diff(a, b Backend) (*DiffResult, error) {
+	res := &DiffResult{}
+	if err := diffStableStores(a, b, res); err != nil {
+		return nil, err
+	}
+	if err := diffLogStores(a, b, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// diffStableStores compares the well-known stable store keys, since the
+// stores can't list their keys.
+func diffStableStores(a, b Backend, res *DiffResult) error {
+	for _, key := range stableStoreKeys {
+		valA, errA := a.Get(key)
+		if errA != nil && !isNotFound(errA) {
+			return fmt.Errorf("Error getting key '%s' from store A: %s", key, errA)
+		}
+		valB, errB := b.Get(key)
+		if errB != nil && !isNotFound(errB) {
+			return fmt.Errorf("Error getting key '%s' from store B: %s", key, errB)
+		}
+		res.StableKeysCompared++
+
+		// Some stores return a nil value rather than an error if missing
+		foundA, foundB := errA == nil && valA != nil, errB == nil && valB != nil
+		if foundA == foundB && bytes.Equal(valA, valB) {
+			continue
+		}
+		res.StableKeyDiffs = append(res.StableKeyDiffs, &StableKeyDiff{
+			Key:    string(key),
+			ValueA: valA,
+			ValueB: valB,
+		})
+	}
+	return nil
+}
+
+// diffLogStores compares every index which is in either store.
+func diffLogStores(a, b Backend, res *DiffResult) error {
+	var err error
+	if res.FirstIndexA, res.LastIndexA, err = indexRange(a); err != nil {
+		return fmt.Errorf("Error reading indexes of store A: %s", err)
+	}
+	if res.FirstIndexB, res.LastIndexB, err = indexRange(b); err != nil {
+		return fmt.Errorf("Error reading indexes of store B: %s", err)
+	}
+
+	// Cover both ranges, ignoring a store with no logs
+	first, last := res.FirstIndexA, res.LastIndexA
+	if first == 0 || (res.FirstIndexB != 0 && res.FirstIndexB < first) {
+		first = res.FirstIndexB
+	}
+	if res.LastIndexB > last {
+		last = res.LastIndexB
+	}
+	if first == 0 {
+		return nil
+	}
+
+	for i := first; i <= last; i++ {
+		logA, err := getLog(a, i)
+		if err != nil {
+			return fmt.Errorf("Error reading log %d from store A: %s", i, err)
+		}
+		logB, err := getLog(b, i)
+		if err != nil {
+			return fmt.Errorf("Error reading log %d from store B: %s", i, err)
+		}
+
+		switch {
+		case logA == nil && logB == nil:
+		case logA == nil:
+			res.MissingA = addIndex(res.MissingA, i)
+		case logB == nil:
+			res.MissingB = addIndex(res.MissingB, i)
+		default:
+			res.LogsCompared++
+			if diff := diffLogs(logA, logB); diff != nil {
+				res.LogsDiffering++
+				if len(res.LogDiffs) < maxLogDiffs {
+					res.LogDiffs = append(res.LogDiffs, diff)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// indexRange returns the first and last index of a store.
+func indexRange(store Backend) (uint64, uint64, error) {
+	first, err := store.FirstIndex()
+	if err != nil {
+		return 0, 0, err
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, last, nil
+}
+
+// getLog reads a log, returning nil if it does not exist.
+func getLog(store Backend, index uint64) (*raft.Log, error) {
+	log := &raft.Log{}
+	if err := store.GetLog(index, log); err != nil {
+		if err == raft.ErrLogNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return log, nil
+}
+
+// diffLogs compares two logs with the same index, returning nil if they
+// are the same.
+func diffLogs(a, b *raft.Log) *LogDiff {
+	var fields []string
+	if a.Term != b.Term {
+		fields = append(fields, "term")
+	}
+	if a.Type != b.Type {
+		fields = append(fields, "type")
+	}
+	if !bytes.Equal(a.Data, b.Data) {
+		fields = append(fields, "data")
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return &LogDiff{
+		Index:  a.Index,
+		Fields: fields,
+		TermA:  a.Term,
+		TermB:  b.Term,
+		TypeA:  a.Type,
+		TypeB:  b.Type,
+		SizeA:  len(a.Data),
+		SizeB:  len(b.Data),
+	}
+}
+
+// addIndex adds an index to a list of ranges, extending the last range
+// if the index follows on from it. Indexes must be added in order.
+func addIndex(ranges []*IndexRange, index uint64) []*IndexRange {
+	if n := len(ranges); n > 0 && ranges[n-1].Last+1 == index {
+		ranges[n-1].Last = index
+		return ranges
+	}
+	return append(ranges, &IndexRange{First: index, Last: index})
+}
@@ -0,0 +1,161 @@
+package migrator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// testDiffStore returns an in-memory store holding logs first to last,
+// skipping any indexes in skip.
+func testDiffStore(t *testing.T, first, last uint64, skip ...uint64) *inmemStore {
+	store := &inmemStore{raft.NewInmemStore()}
+	skipped := make(map[uint64]bool)
+	for _, index := range skip {
+		skipped[index] = true
+	}
+	for i := first; i <= last; i++ {
+		if skipped[i] {
+			continue
+		}
+		log := &raft.Log{Index: i, Term: 1, Type: raft.LogCommand, Data: []byte("foo")}
+		if err := store.StoreLog(log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := store.Set([]byte("CurrentTerm"), uint64ToBytes(1)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return store
+}
+
+func TestDiff_equal(t *testing.T) {
+	res, err := Diff(testDiffStore(t, 1, 10), testDiffStore(t, 1, 10))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !res.Equal() {
+		t.Fatalf("bad: %#v", res)
+	}
+	if res.LogsCompared != 10 || res.StableKeysCompared != len(stableStoreKeys) {
+		t.Fatalf("bad: %#v", res)
+	}
+}
+
+func TestDiff_missing(t *testing.T) {
+	a := testDiffStore(t, 1, 20, 5, 6, 7)
+	b := testDiffStore(t, 3, 15, 10)
+
+	res, err := Diff(a, b)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if res.Equal() {
+		t.Fatalf("should differ")
+	}
+	if res.FirstIndexA != 1 || res.LastIndexA != 20 || res.FirstIndexB != 3 || res.LastIndexB != 15 {
+		t.Fatalf("bad: %#v", res)
+	}
+	expectA := []*IndexRange{{5, 7}}
+	if !reflect.DeepEqual(res.MissingA, expectA) {
+		t.Fatalf("bad: %v", res.MissingA)
+	}
+	expectB := []*IndexRange{{1, 2}, {10, 10}, {16, 20}}
+	if !reflect.DeepEqual(res.MissingB, expectB) {
+		t.Fatalf("bad: %v", res.MissingB)
+	}
+	if res.LogsCompared != 9 {
+		t.Fatalf("bad: %d", res.LogsCompared)
+	}
+}
+
+func TestDiff_logs(t *testing.T) {
+	a := testDiffStore(t, 1, 5)
+	b := testDiffStore(t, 1, 5)
+	changed := []*raft.Log{
+		{Index: 2, Term: 2, Type: raft.LogCommand, Data: []byte("foo")},
+		{Index: 3, Term: 1, Type: raft.LogNoop, Data: []byte("bar")},
+	}
+	if err := b.StoreLogs(changed); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	res, err := Diff(a, b)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if res.LogsDiffering != 2 || len(res.LogDiffs) != 2 {
+		t.Fatalf("bad: %#v", res)
+	}
+	if diff := res.LogDiffs[0]; diff.Index != 2 || !reflect.DeepEqual(diff.Fields, []string{"term"}) ||
+		diff.TermA != 1 || diff.TermB != 2 {
+		t.Fatalf("bad: %#v", diff)
+	}
+	if diff := res.LogDiffs[1]; diff.Index != 3 || !reflect.DeepEqual(diff.Fields, []string{"type", "data"}) {
+		t.Fatalf("bad: %#v", diff)
+	}
+}
+
+func TestDiff_stableKeys(t *testing.T) {
+	a := testDiffStore(t, 1, 5)
+	b := testDiffStore(t, 1, 5)
+	if err := b.Set([]byte("CurrentTerm"), uint64ToBytes(2)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := a.Set([]byte("LastVoteCand"), []byte("127.0.0.1:8300")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	res, err := Diff(a, b)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(res.StableKeyDiffs) != 2 {
+		t.Fatalf("bad: %#v", res.StableKeyDiffs)
+	}
+	term := res.StableKeyDiffs[0]
+	if term.Key != "CurrentTerm" || bytesToUint64(term.ValueA) != 1 || bytesToUint64(term.ValueB) != 2 {
+		t.Fatalf("bad: %#v", term)
+	}
+	cand := res.StableKeyDiffs[1]
+	if cand.Key != "LastVoteCand" || string(cand.ValueA) != "127.0.0.1:8300" || cand.ValueB != nil {
+		t.Fatalf("bad: %#v", cand)
+	}
+}
+
+func TestDiff_empty(t *testing.T) {
+	empty := &inmemStore{raft.NewInmemStore()}
+	res, err := Diff(empty, testDiffStore(t, 1, 3))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(res.MissingA, []*IndexRange{{1, 3}}) || len(res.MissingB) != 0 {
+		t.Fatalf("bad: %#v", res)
+	}
+
+	res, err = Diff(empty, &inmemStore{raft.NewInmemStore()})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !res.Equal() || res.LogsCompared != 0 {
+		t.Fatalf("bad: %#v", res)
+	}
+}
+
+func TestDiff_maxLogDiffs(t *testing.T) {
+	a := testDiffStore(t, 1, maxLogDiffs+10)
+	b := &inmemStore{raft.NewInmemStore()}
+	for i := uint64(1); i <= maxLogDiffs+10; i++ {
+		if err := b.StoreLog(&raft.Log{Index: i, Term: 2}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	res, err := Diff(a, b)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if res.LogsDiffering != maxLogDiffs+10 || len(res.LogDiffs) != maxLogDiffs {
+		t.Fatalf("bad: %d %d", res.LogsDiffering, len(res.LogDiffs))
+	}
+}
@@ -0,0 +1,362 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// encryptedMagic starts every file encrypted by encryptWriter. It is
+	// followed by the length of the key ID and the key ID itself.
+	encryptedMagic = "CMENC1"
+
+	// encryptChunkSize is the amount of plaintext sealed at a time when
+	// encrypting a stream.
+	encryptChunkSize = 64 * 1024
+)
+
+// EncryptionKey is an AES key used to encrypt Raft data at rest with
+// AES-GCM. Its ID is derived from the key, and is recorded alongside
+// encrypted data so the right key can be found to decrypt it.
+type EncryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewEncryptionKey creates a key from 16, 24 or 32 raw bytes, selecting
+// AES-128, AES-192 or AES-256.
+func NewEncryptionKey(raw []byte) (*EncryptionKey, error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid encryption key: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &EncryptionKey{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// ParseEncryptionKey creates a key from its base64 encoding, the same
+// format as the keys generated by "consul keygen".
+func ParseEncryptionKey(encoded string) (*EncryptionKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("Encryption key is not valid base64: %s", err)
+	}
+	return NewEncryptionKey(raw)
+}
+
+// ReadEncryptionKey reads a base64-encoded key from a file.
+func ReadEncryptionKey(path string) (*EncryptionKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseEncryptionKey(string(buf))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading key file '%s': %s", path, err)
+	}
+	return key, nil
+}
+
+// EncryptionKeyFromEnv reads a base64-encoded key from the environment
+// variable with the given name.
+func EncryptionKeyFromEnv(name string) (*EncryptionKey, error) {
+	encoded := os.Getenv(name)
+	if encoded == "" {
+		return nil, fmt.Errorf("Environment variable '%s' is not set", name)
+	}
+	key, err := ParseEncryptionKey(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading key from '%s': %s", name, err)
+	}
+	return key, nil
+}
+
+// ID returns the key ID, which identifies the key without revealing it.
+func (k *EncryptionKey) ID() string {
+	return k.id
+}
+
+// seal encrypts and authenticates data along with the associated data,
+// which is not stored. A random nonce is prepended to the result.
+func (k *EncryptionKey) seal(data, ad []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, data, ad), nil
+}
+
+// open decrypts data created by seal, given the same associated data.
+func (k *EncryptionKey) open(sealed, ad []byte) ([]byte, error) {
+	size := k.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, fmt.Errorf("encrypted data is too short")
+	}
+	data, err := k.aead.Open(nil, sealed[:size], sealed[size:], ad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data, it may have been modified")
+	}
+	return data, nil
+}
+
+// checkKeyID makes sure data encrypted with the given key ID can be
+// decrypted with the key.
+func checkKeyID(id string, key *EncryptionKey) error {
+	if key == nil {
+		return fmt.Errorf("data is encrypted with key %s, but no key was given", id)
+	}
+	if key.ID() != id {
+		return fmt.Errorf("data is encrypted with key %s, but key %s was given", id, key.ID())
+	}
+	return nil
+}
+
+// encryptedHeader returns the header of a stream encrypted with the
+// given key ID.
+func encryptedHeader(id string) []byte {
+	header := append([]byte(encryptedMagic), byte(len(id)))
+	return append(header, id...)
+}
+
+// chunkAD returns the associated data of a chunk of an encrypted
+// stream. It binds each chunk to the stream header and its position,
+// and marks the last one so a truncated stream can't pass as complete.
+func chunkAD(header []byte, n uint64, final bool) []byte {
+	ad := make([]byte, len(header)+9)
+	copy(ad, header)
+	binary.BigEndian.PutUint64(ad[len(header):], n)
+	if final {
+		ad[len(ad)-1] = 1
+	}
+	return ad
+}
+
+// encryptWriter encrypts a stream in chunks. After the header, each
+// chunk is written as a flag byte marking the last chunk, the length
+// of the sealed chunk as a uint32, and the sealed chunk. Close must be
+// called to write the last chunk, but does not close the underlying
+// writer.
+type encryptWriter struct {
+	w      io.Writer
+	key    *EncryptionKey
+	header []byte
+	buf    []byte
+	n      uint64
+}
+
+// newEncryptWriter writes the header of an encrypted stream to w.
+func newEncryptWriter(w io.Writer, key *EncryptionKey) (*encryptWriter, error) {
+	header := encryptedHeader(key.ID())
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, key: key, header: header, buf: make([]byte, 0, encryptChunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Only write a full chunk once there is more data, so the last
+		// chunk is always written by Close
+		if len(e.buf) == encryptChunkSize {
+			if err := e.writeChunk(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the last chunk.
+func (e *encryptWriter) Close() error {
+	return e.writeChunk(true)
+}
+
+func (e *encryptWriter) writeChunk(final bool) error {
+	sealed, err := e.key.seal(e.buf, chunkAD(e.header, e.n, final))
+	if err != nil {
+		return err
+	}
+	var header [5]byte
+	if final {
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(sealed)))
+	if _, err := e.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.buf = e.buf[:0]
+	e.n++
+	return nil
+}
+
+// readEncryptedHeader reads the header of an encrypted stream, and
+// returns the ID of the key it was encrypted with. Returns false if the
+// stream is not encrypted, in which case the bytes read are lost.
+func readEncryptedHeader(r *bufio.Reader) (string, bool, error) {
+	magic, err := r.Peek(len(encryptedMagic))
+	if err == io.EOF || (err == nil && !bytes.Equal(magic, []byte(encryptedMagic))) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := r.Discard(len(encryptedMagic)); err != nil {
+		return "", false, err
+	}
+	size, err := r.ReadByte()
+	if err != nil {
+		return "", false, err
+	}
+	id := make([]byte, size)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return "", false, err
+	}
+	return string(id), true, nil
+}
+
+// decryptReader decrypts a stream written by encryptWriter. It returns
+// an error if any chunk was modified, or the stream was truncated.
+type decryptReader struct {
+	r      *bufio.Reader
+	key    *EncryptionKey
+	header []byte
+	buf    []byte
+	n      uint64
+	done   bool
+}
+
+// newDecryptReader reads the header of an encrypted stream, checking
+// that it was encrypted with the given key.
+func newDecryptReader(r io.Reader, key *EncryptionKey) (*decryptReader, error) {
+	br := bufio.NewReader(r)
+	id, ok, err := readEncryptedHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("data is not encrypted")
+	}
+	if err := checkKeyID(id, key); err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: br, key: key, header: encryptedHeader(id)}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) readChunk() error {
+	var header [5]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("encrypted data is truncated")
+		}
+		return err
+	}
+	final := header[0] == 1
+
+	// Check the length before allocating, since it hasn't been
+	// authenticated yet
+	size := binary.BigEndian.Uint32(header[1:])
+	if max := d.key.aead.NonceSize() + encryptChunkSize + d.key.aead.Overhead(); int64(size) > int64(max) {
+		return fmt.Errorf("encrypted chunk of %d bytes is larger than the limit of %d", size, max)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return err
+	}
+	data, err := d.key.open(sealed, chunkAD(d.header, d.n, final))
+	if err != nil {
+		return err
+	}
+	if final {
+		if _, err := d.r.ReadByte(); err != io.EOF {
+			return fmt.Errorf("unexpected data after the end of the encrypted data")
+		}
+		d.done = true
+	}
+	d.buf = data
+	d.n++
+	return nil
+}
+
+// EncryptedKeyID returns the ID of the key the file at path was
+// encrypted with, or false if it is not encrypted.
+func EncryptedKeyID(path string) (string, bool, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer fh.Close()
+	return readEncryptedHeader(bufio.NewReader(fh))
+}
+
+// DecryptFile decrypts a file encrypted by the migrator, such as a
+// compressed backup of the LMDB data, writing the result to dst.
+func DecryptFile(src, dst string, key *EncryptionKey) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dec, err := newDecryptReader(in, key)
+	if err != nil {
+		return fmt.Errorf("Error decrypting '%s': %s", src, err)
+	}
+
+	tempPath := dst + ".temp"
+	out, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	if _, err := io.Copy(out, dec); err != nil {
+		out.Close()
+		return fmt.Errorf("Error decrypting '%s': %s", src, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, dst)
+}
@@ -0,0 +1,199 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKey returns a key made of the given byte repeated.
+func testKey(t *testing.T, b byte) *EncryptionKey {
+	key, err := NewEncryptionKey(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return key
+}
+
+// encryptBytes encrypts data as a stream.
+func encryptBytes(t *testing.T, key *EncryptionKey, data []byte) []byte {
+	var buf bytes.Buffer
+	enc, err := newEncryptWriter(&buf, key)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := enc.Write(data); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// decryptBytes decrypts a stream.
+func decryptBytes(key *EncryptionKey, data []byte) ([]byte, error) {
+	dec, err := newDecryptReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(dec)
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	for _, size := range []int{16, 24, 32} {
+		raw := bytes.Repeat([]byte{1}, size)
+		key, err := ParseEncryptionKey(base64.StdEncoding.EncodeToString(raw) + "\n")
+		if err != nil {
+			t.Fatalf("%d: err: %s", size, err)
+		}
+		same, err := NewEncryptionKey(raw)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if key.ID() == "" || key.ID() != same.ID() {
+			t.Fatalf("bad: %s %s", key.ID(), same.ID())
+		}
+	}
+	if testKey(t, 1).ID() == testKey(t, 2).ID() {
+		t.Fatalf("key IDs should differ")
+	}
+
+	bad := []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short"))}
+	for _, encoded := range bad {
+		if _, err := ParseEncryptionKey(encoded); err == nil {
+			t.Fatalf("%q: should fail", encoded)
+		}
+	}
+}
+
+func TestEncryptionKeyFromEnv(t *testing.T) {
+	name := "CONSUL_MIGRATE_TEST_KEY"
+	defer os.Unsetenv(name)
+	if _, err := EncryptionKeyFromEnv(name); err == nil {
+		t.Fatalf("should fail")
+	}
+	os.Setenv(name, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	key, err := EncryptionKeyFromEnv(name)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if key.ID() != testKey(t, 1).ID() {
+		t.Fatalf("bad: %s", key.ID())
+	}
+}
+
+func TestEncryptStream(t *testing.T) {
+	key := testKey(t, 1)
+	for _, size := range []int{0, 1, encryptChunkSize, encryptChunkSize + 1, 3*encryptChunkSize - 7} {
+		data := bytes.Repeat([]byte("abcdefg"), size/7+1)[:size]
+		sealed := encryptBytes(t, key, data)
+		// A single byte may appear in the random nonce by chance
+		if size > 1 && bytes.Contains(sealed, data) {
+			t.Fatalf("%d: data was not encrypted", size)
+		}
+		out, err := decryptBytes(key, sealed)
+		if err != nil {
+			t.Fatalf("%d: err: %s", size, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("%d: bad: %d bytes", size, len(out))
+		}
+	}
+}
+
+func TestEncryptStream_fails(t *testing.T) {
+	key := testKey(t, 1)
+	data := bytes.Repeat([]byte("x"), 2*encryptChunkSize+10)
+	sealed := encryptBytes(t, key, data)
+
+	// The wrong key is detected from the header
+	if _, err := decryptBytes(testKey(t, 2), sealed); err == nil || !strings.Contains(err.Error(), "key") {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := decryptBytes(nil, sealed); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Modified data fails to authenticate
+	modified := append([]byte(nil), sealed...)
+	modified[len(modified)-1] ^= 1
+	if _, err := decryptBytes(key, modified); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Dropping whole chunks from the end is detected
+	header := len(encryptedMagic) + 1 + len(key.ID())
+	chunk := 5 + key.aead.NonceSize() + encryptChunkSize + key.aead.Overhead()
+	for _, n := range []int{1, 2} {
+		if _, err := decryptBytes(key, sealed[:header+n*chunk]); err == nil {
+			t.Fatalf("%d: should fail", n)
+		}
+	}
+
+	// A chunk longer than the limit is rejected before it is read
+	long := append([]byte(nil), sealed[:header]...)
+	long = append(long, 0, 0xff, 0xff, 0xff, 0xff)
+	if _, err := decryptBytes(key, long); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Chunks are bound to the stream header
+	chunk0, err := key.seal([]byte("data"), chunkAD(encryptedHeader("a"), 0, true))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := key.open(chunk0, chunkAD(encryptedHeader("b"), 0, true)); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Plaintext is not mistaken for encrypted data
+	if _, err := decryptBytes(key, []byte("plain")); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestDecryptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := testKey(t, 1)
+	src := filepath.Join(dir, "backup.tar.gz")
+	if err := ioutil.WriteFile(src, encryptBytes(t, key, []byte("hello")), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	id, ok, err := EncryptedKeyID(src)
+	if err != nil || !ok || id != key.ID() {
+		t.Fatalf("bad: %s %v %v", id, ok, err)
+	}
+
+	dst := filepath.Join(dir, "plain.tar.gz")
+	if err := DecryptFile(src, dst, testKey(t, 2)); err == nil {
+		t.Fatalf("should fail")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := DecryptFile(src, dst, key); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	buf, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("bad: %q", buf)
+	}
+
+	// Plain files have no key ID
+	if _, ok, err := EncryptedKeyID(dst); err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+}
@@ -0,0 +1,59 @@
+package migrator
+
+import (
+	"fmt"
+)
+
+// ErrorClass identifies the step of a migration which failed, so that
+// callers can react to failures without matching on error strings.
+// ErrClassRollback means a migration which failed verification could
+// not be undone, and the agent must not start until the data-dir has
+// been fixed by hand.
+type ErrorClass string
+
+const (
+	ErrClassConfig      ErrorClass = "config"
+	ErrClassSource      ErrorClass = "source"
+	ErrClassDestination ErrorClass = "destination"
+	ErrClassStableStore ErrorClass = "stable-store"
+	ErrClassLogStore    ErrorClass = "log-store"
+	ErrClassActivate    ErrorClass = "activate"
+	ErrClassArchive     ErrorClass = "archive"
+	ErrClassHook        ErrorClass = "hook"
+	ErrClassAborted     ErrorClass = "aborted"
+	ErrClassVerify      ErrorClass = "verify"
+	ErrClassValidation  ErrorClass = "validation"
+	ErrClassRewrite     ErrorClass = "rewrite"
+	ErrClassTransform   ErrorClass = "transform"
+	ErrClassRollback    ErrorClass = "rollback"
+	ErrClassUnknown     ErrorClass = "unknown"
+)
+
+// MigrationError is returned by Migrate and Copy. It wraps the error
+// which caused the failure along with its class.
+type MigrationError struct {
+	Class ErrorClass
+	Msg   string
+	Err   error
+}
+
+// newError creates a MigrationError with a formatted message.
+func newError(class ErrorClass, err error, format string, args ...interface{}) error {
+	return &MigrationError{Class: class, Msg: fmt.Sprintf(format, args...), Err: err}
+}
+
+func (e *MigrationError) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s: %v", e.Msg, e.Err)
+}
+
+// ErrorClassOf returns the class of an error returned by Migrate or
+// Copy, or ErrClassUnknown for any other error.
+func ErrorClassOf(err error) ErrorClass {
+	if merr, ok := err.(*MigrationError); ok {
+		return merr.Class
+	}
+	return ErrClassUnknown
+}
@@ -0,0 +1,407 @@
+package migrator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// exportVersion is the version of the export file format. It is
+	// written into the header record of each file. Files with encrypted
+	// logs use exportVersionEncrypted, so older versions of the tool
+	// refuse to load them rather than treating the data as plaintext.
+	exportVersion          = 1
+	exportVersionEncrypted = 2
+
+	// Kinds of records found in an export file.
+	exportKindHeader = "header"
+	exportKindStable = "stable"
+	exportKindLog    = "log"
+)
+
+var (
+	// errNotFound mirrors the error returned by the LMDB and BoltDB
+	// stable stores when a key does not exist.
+	errNotFound = fmt.Errorf("not found")
+)
+
+// exportRecord is a single line of an export file. The file is made up
+// of newline-delimited JSON records, starting with a header, followed
+// by the stable store values and then the logs in index order. If the
+// header has a KeyID, the data of each log is encrypted with that key.
+type exportRecord struct {
+	Kind    string
+	Version int          `json:",omitempty"`
+	KeyID   string       `json:",omitempty"`
+	Key     string       `json:",omitempty"`
+	Value   []byte       `json:",omitempty"`
+	Index   uint64       `json:",omitempty"`
+	Term    uint64       `json:",omitempty"`
+	Type    raft.LogType `json:",omitempty"`
+	Data    []byte       `json:",omitempty"`
+}
+
+// exportStore is a Backend which keeps all of the data in memory and
+// reads or writes a portable export file. Any existing file is loaded
+// when the store is opened, and changes are written out when it is
+// closed, replacing the file atomically. If a key is given, the data of
+// each log is encrypted in the file, though not in memory.
+type exportStore struct {
+	path  string
+	key   *EncryptionKey
+	dirty bool
+
+	logs  map[uint64]*raft.Log
+	kv    map[string][]byte
+	first uint64
+	last  uint64
+	lock  sync.RWMutex
+}
+
+// exportBackend opens an export file at the given path. The file does
+// not need to exist yet. An encryption key can be read from a file
+// using the "key-file" query parameter, or from the environment variable
+// named by "key-env".
+func exportBackend(u *url.URL) (Backend, error) {
+	path, err := backendPath(u)
+	if err != nil {
+		return nil, err
+	}
+	key, err := backendKey(u)
+	if err != nil {
+		return nil, err
+	}
+	return newExportStore(path, key)
+}
+
+// backendKey loads the encryption key selected by the query of a backend
+// URI, if any.
+func backendKey(u *url.URL) (*EncryptionKey, error) {
+	query := u.Query()
+	file, env := query.Get("key-file"), query.Get("key-env")
+	switch {
+	case file != "" && env != "":
+		return nil, fmt.Errorf("Only one of key-file and key-env may be given")
+	case file != "":
+		return ReadEncryptionKey(file)
+	case env != "":
+		return EncryptionKeyFromEnv(env)
+	}
+	return nil, nil
+}
+
+// newExportStore creates a new export store, loading the existing file
+// at path if there is one. The key may be nil to write plaintext, but
+// is required to load an encrypted file.
+func newExportStore(path string, key *EncryptionKey) (*exportStore, error) {
+	e := &exportStore{
+		path: path,
+		key:  key,
+		logs: make(map[uint64]*raft.Log),
+		kv:   make(map[string][]byte),
+	}
+
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	if err := e.load(fh); err != nil {
+		return nil, fmt.Errorf("Error reading export file '%s': %s", path, err)
+	}
+	return e, nil
+}
+
+// load reads all of the records from an export file.
+func (e *exportStore) load(r io.Reader) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var keyID string
+	for i := 0; ; i++ {
+		var rec exportRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if i == 0 {
+			if rec.Kind != exportKindHeader {
+				return fmt.Errorf("missing header")
+			}
+			switch {
+			case rec.Version == exportVersion:
+			case rec.Version == exportVersionEncrypted && rec.KeyID != "":
+				if err := checkKeyID(rec.KeyID, e.key); err != nil {
+					return err
+				}
+				keyID = rec.KeyID
+			default:
+				return fmt.Errorf("unsupported version %d", rec.Version)
+			}
+			continue
+		}
+
+		switch rec.Kind {
+		case exportKindStable:
+			e.kv[rec.Key] = rec.Value
+		case exportKindLog:
+			log := &raft.Log{
+				Index: rec.Index,
+				Term:  rec.Term,
+				Type:  rec.Type,
+				Data:  rec.Data,
+			}
+			if keyID != "" {
+				data, err := e.key.open(rec.Data, logAD(log))
+				if err != nil {
+					return fmt.Errorf("log %d: %s", rec.Index, err)
+				}
+				log.Data = data
+			}
+			e.storeLog(log)
+		default:
+			return fmt.Errorf("unknown record kind '%s'", rec.Kind)
+		}
+	}
+	return nil
+}
+
+// write serializes the contents of the store in the export format.
+func (e *exportStore) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	header := &exportRecord{Kind: exportKindHeader, Version: exportVersion}
+	if e.key != nil {
+		header.Version = exportVersionEncrypted
+		header.KeyID = e.key.ID()
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(e.kv))
+	for key := range e.kv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		rec := &exportRecord{Kind: exportKindStable, Key: key, Value: e.kv[key]}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	for i := e.first; i <= e.last && e.last != 0; i++ {
+		log, ok := e.logs[i]
+		if !ok {
+			continue
+		}
+		rec := &exportRecord{
+			Kind:  exportKindLog,
+			Index: log.Index,
+			Term:  log.Term,
+			Type:  log.Type,
+			Data:  log.Data,
+		}
+		if e.key != nil {
+			data, err := e.key.seal(log.Data, logAD(log))
+			if err != nil {
+				return err
+			}
+			rec.Data = data
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logAD returns the associated data for encrypting the data of a log,
+// which binds it to the rest of the log so it can't be moved elsewhere.
+func logAD(log *raft.Log) []byte {
+	ad := make([]byte, 17)
+	binary.BigEndian.PutUint64(ad, log.Index)
+	binary.BigEndian.PutUint64(ad[8:], log.Term)
+	ad[16] = byte(log.Type)
+	return ad
+}
+
+// Close writes the export file if anything changed. The file is written
+// to a temporary location first and renamed over the original.
+func (e *exportStore) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if !e.dirty {
+		return nil
+	}
+
+	tempPath := e.path + ".temp"
+	fh, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	buf := bufio.NewWriter(fh)
+	if err := e.write(buf); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, e.path); err != nil {
+		return err
+	}
+	e.dirty = false
+	return nil
+}
+
+// FirstIndex implements the LogStore interface.
+func (e *exportStore) FirstIndex() (uint64, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.first, nil
+}
+
+// LastIndex implements the LogStore interface.
+func (e *exportStore) LastIndex() (uint64, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.last, nil
+}
+
+// GetLog implements the LogStore interface.
+func (e *exportStore) GetLog(index uint64, log *raft.Log) error {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	l, ok := e.logs[index]
+	if !ok {
+		return raft.ErrLogNotFound
+	}
+	*log = *l
+	return nil
+}
+
+// StoreLog implements the LogStore interface.
+func (e *exportStore) StoreLog(log *raft.Log) error {
+	return e.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs implements the LogStore interface.
+func (e *exportStore) StoreLogs(logs []*raft.Log) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for _, log := range logs {
+		copied := *log
+		e.storeLog(&copied)
+	}
+	e.dirty = true
+	return nil
+}
+
+// storeLog adds a log and maintains the index range. Must be called
+// with the lock held.
+func (e *exportStore) storeLog(log *raft.Log) {
+	e.logs[log.Index] = log
+	if e.first == 0 || log.Index < e.first {
+		e.first = log.Index
+	}
+	if log.Index > e.last {
+		e.last = log.Index
+	}
+}
+
+// DeleteRange implements the LogStore interface.
+func (e *exportStore) DeleteRange(min, max uint64) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	// Only the stored range needs visiting, and clamping to it keeps
+	// the bounds below from wrapping around
+	if len(e.logs) == 0 || max < e.first || min > e.last {
+		return nil
+	}
+	if min < e.first {
+		min = e.first
+	}
+	if max > e.last {
+		max = e.last
+	}
+	for i := min; ; i++ {
+		delete(e.logs, i)
+		if i == max {
+			break
+		}
+	}
+	switch {
+	case min == e.first && max == e.last:
+		e.first, e.last = 0, 0
+	case min == e.first:
+		e.first = max + 1
+	case max == e.last:
+		e.last = min - 1
+	}
+	e.dirty = true
+	return nil
+}
+
+// Set implements the StableStore interface.
+func (e *exportStore) Set(key []byte, val []byte) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.kv[string(key)] = append([]byte(nil), val...)
+	e.dirty = true
+	return nil
+}
+
+// Get implements the StableStore interface.
+func (e *exportStore) Get(key []byte) ([]byte, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	val, ok := e.kv[string(key)]
+	if !ok {
+		return nil, errNotFound
+	}
+	return val, nil
+}
+
+// SetUint64 implements the StableStore interface.
+func (e *exportStore) SetUint64(key []byte, val uint64) error {
+	return e.Set(key, uint64ToBytes(val))
+}
+
+// GetUint64 implements the StableStore interface.
+func (e *exportStore) GetUint64(key []byte) (uint64, error) {
+	val, err := e.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return bytesToUint64(val), nil
+}
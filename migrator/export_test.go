@@ -0,0 +1,226 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestExportStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "raft.export")
+
+	// Write some data into a new export file
+	e, err := newExportStore(path, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	logs := []*raft.Log{
+		{Index: 3, Term: 1, Type: raft.LogCommand, Data: []byte("foo")},
+		{Index: 4, Term: 2, Type: raft.LogNoop},
+		{Index: 5, Term: 2, Type: raft.LogCommand, Data: []byte("bar")},
+	}
+	if err := e.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := e.Set([]byte("LastVoteCand"), []byte("127.0.0.1:8300")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := e.SetUint64([]byte("CurrentTerm"), 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Load it back
+	e, err = newExportStore(path, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	first, _ := e.FirstIndex()
+	last, _ := e.LastIndex()
+	if first != 3 || last != 5 {
+		t.Fatalf("bad: %d %d", first, last)
+	}
+	for _, log := range logs {
+		out := &raft.Log{}
+		if err := e.GetLog(log.Index, out); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(log, out) {
+			t.Fatalf("bad: %#v %#v", log, out)
+		}
+	}
+	if err := e.GetLog(6, &raft.Log{}); err != raft.ErrLogNotFound {
+		t.Fatalf("bad: %v", err)
+	}
+
+	val, err := e.Get([]byte("LastVoteCand"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(val, []byte("127.0.0.1:8300")) {
+		t.Fatalf("bad: %s", val)
+	}
+	term, err := e.GetUint64([]byte("CurrentTerm"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if term != 2 {
+		t.Fatalf("bad: %d", term)
+	}
+	if _, err := e.Get([]byte("nope")); !isNotFound(err) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Delete the head of the log
+	if err := e.DeleteRange(3, 4); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	first, _ = e.FirstIndex()
+	last, _ = e.LastIndex()
+	if first != 5 || last != 5 {
+		t.Fatalf("bad: %d %d", first, last)
+	}
+
+	// Ranges past either end are clamped to the stored logs
+	if err := e.DeleteRange(0, math.MaxUint64); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	first, _ = e.FirstIndex()
+	last, _ = e.LastIndex()
+	if first != 0 || last != 0 {
+		t.Fatalf("bad: %d %d", first, last)
+	}
+	if err := e.DeleteRange(0, math.MaxUint64); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestExportStore_badFile(t *testing.T) {
+	fh, err := ioutil.TempFile("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(fh.Name())
+
+	fh.WriteString(`{"Kind":"log","Index":1}` + "\n")
+	fh.Close()
+
+	if _, err := newExportStore(fh.Name(), nil); err == nil {
+		t.Fatalf("should fail without a header")
+	}
+}
+
+func TestExportStore_encrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "raft.export")
+
+	key := testKey(t, 1)
+	e, err := newExportStore(path, key)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogCommand, Data: []byte("secret")},
+		{Index: 2, Term: 1, Type: raft.LogNoop},
+	}
+	if err := e.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The log data is not in the file
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if bytes.Contains(buf, []byte(base64.StdEncoding.EncodeToString([]byte("secret")))) {
+		t.Fatalf("data was not encrypted: %s", buf)
+	}
+	if !bytes.Contains(buf, []byte(key.ID())) {
+		t.Fatalf("missing key ID: %s", buf)
+	}
+
+	// It can only be loaded with the same key
+	if _, err := newExportStore(path, nil); err == nil {
+		t.Fatalf("should fail")
+	}
+	if _, err := newExportStore(path, testKey(t, 2)); err == nil {
+		t.Fatalf("should fail")
+	}
+	e, err = newExportStore(path, key)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, log := range logs {
+		out := &raft.Log{}
+		if err := e.GetLog(log.Index, out); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if out.Term != log.Term || out.Type != log.Type || !bytes.Equal(out.Data, log.Data) {
+			t.Fatalf("bad: %#v", out)
+		}
+	}
+
+	// Data moved to another log fails to decrypt
+	moved := bytes.Replace(buf, []byte(`"Index":1,`), []byte(`"Index":3,`), 1)
+	if err := ioutil.WriteFile(path, moved, 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := newExportStore(path, key); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestExportBackend_key(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	encoded := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	if err := ioutil.WriteFile(keyFile, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	path := filepath.Join(dir, "raft.export")
+	store, err := OpenBackend("export-file://" + path + "?key-file=" + keyFile)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if e := store.(*exportStore); e.key == nil || e.key.ID() != testKey(t, 1).ID() {
+		t.Fatalf("bad: %#v", e.key)
+	}
+
+	bad := []string{
+		"?key-file=" + filepath.Join(dir, "missing"),
+		"?key-env=CONSUL_MIGRATE_UNSET_KEY",
+		"?key-file=" + keyFile + "&key-env=FOO",
+	}
+	for _, query := range bad {
+		if _, err := OpenBackend("export-file://" + path + query); err == nil {
+			t.Fatalf("%s: should fail", query)
+		}
+	}
+}
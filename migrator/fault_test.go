@@ -0,0 +1,400 @@
+package migrator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// faults makes the Nth call of each named operation fail, counting
+// calls separately for each operation.
+type faults struct {
+	failAt map[string]int
+	calls  map[string]int
+	failed []string
+	lock   sync.Mutex
+}
+
+func newFaults(failAt map[string]int) *faults {
+	return &faults{failAt: failAt, calls: make(map[string]int)}
+}
+
+// check records a call of op, and returns an error if it should fail.
+func (f *faults) check(op string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.calls[op]++
+	if n, ok := f.failAt[op]; ok && f.calls[op] == n {
+		f.failed = append(f.failed, op)
+		return fmt.Errorf("injected fault in %s call %d", op, n)
+	}
+	return nil
+}
+
+// faultStore is a Backend whose calls fail as configured by its faults.
+type faultStore struct {
+	Backend
+	faults *faults
+}
+
+func (f *faultStore) FirstIndex() (uint64, error) {
+	if err := f.faults.check("FirstIndex"); err != nil {
+		return 0, err
+	}
+	return f.Backend.FirstIndex()
+}
+
+func (f *faultStore) LastIndex() (uint64, error) {
+	if err := f.faults.check("LastIndex"); err != nil {
+		return 0, err
+	}
+	return f.Backend.LastIndex()
+}
+
+func (f *faultStore) GetLog(index uint64, log *raft.Log) error {
+	if err := f.faults.check("GetLog"); err != nil {
+		return err
+	}
+	return f.Backend.GetLog(index, log)
+}
+
+func (f *faultStore) StoreLog(log *raft.Log) error {
+	if err := f.faults.check("StoreLog"); err != nil {
+		return err
+	}
+	return f.Backend.StoreLog(log)
+}
+
+func (f *faultStore) StoreLogs(logs []*raft.Log) error {
+	if err := f.faults.check("StoreLogs"); err != nil {
+		return err
+	}
+	return f.Backend.StoreLogs(logs)
+}
+
+func (f *faultStore) DeleteRange(min, max uint64) error {
+	if err := f.faults.check("DeleteRange"); err != nil {
+		return err
+	}
+	return f.Backend.DeleteRange(min, max)
+}
+
+func (f *faultStore) Set(key []byte, val []byte) error {
+	if err := f.faults.check("Set"); err != nil {
+		return err
+	}
+	return f.Backend.Set(key, val)
+}
+
+func (f *faultStore) Get(key []byte) ([]byte, error) {
+	if err := f.faults.check("Get"); err != nil {
+		return nil, err
+	}
+	return f.Backend.Get(key)
+}
+
+func (f *faultStore) SetUint64(key []byte, val uint64) error {
+	if err := f.faults.check("SetUint64"); err != nil {
+		return err
+	}
+	return f.Backend.SetUint64(key, val)
+}
+
+func (f *faultStore) GetUint64(key []byte) (uint64, error) {
+	if err := f.faults.check("GetUint64"); err != nil {
+		return 0, err
+	}
+	return f.Backend.GetUint64(key)
+}
+
+// faultFS is a fileSystem whose calls fail as configured by its faults.
+type faultFS struct {
+	fileSystem
+	faults *faults
+}
+
+func (f *faultFS) Rename(oldpath, newpath string) error {
+	if err := f.faults.check("Rename"); err != nil {
+		return err
+	}
+	return f.fileSystem.Rename(oldpath, newpath)
+}
+
+func (f *faultFS) Remove(path string) error {
+	if err := f.faults.check("Remove"); err != nil {
+		return err
+	}
+	return f.fileSystem.Remove(path)
+}
+
+func (f *faultFS) RemoveAll(path string) error {
+	if err := f.faults.check("RemoveAll"); err != nil {
+		return err
+	}
+	return f.fileSystem.RemoveAll(path)
+}
+
+func (f *faultFS) WriteFile(path string, data []byte, perm os.FileMode) error {
+	if err := f.faults.check("WriteFile"); err != nil {
+		return err
+	}
+	return f.fileSystem.WriteFile(path, data, perm)
+}
+
+// faultMigrator runs migrations with faults injected into the stores.
+type faultMigrator struct {
+	*Migrator
+	wrap storeWrapper
+}
+
+// newFaultMigrator creates a Migrator for the data-dir whose Migrate
+// passes the stores it opens through wrap.
+func newFaultMigrator(t *testing.T, dir string, wrap storeWrapper) *faultMigrator {
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return &faultMigrator{Migrator: m, wrap: wrap}
+}
+
+// Migrate runs a migration with the faults injected.
+func (f *faultMigrator) Migrate() (bool, error) {
+	return f.run(f.wrap)
+}
+
+// checkUntouched fails the test unless the LMDB data is still in place
+// and unchanged, and no BoltDB files were left behind. The lock file is
+// written by LMDB readers, so it only needs to exist.
+func checkUntouched(t *testing.T, m *Migrator, name string, sum string) {
+	_, actual, err := hashFile(filepath.Join(m.mdbPath, mdbDataFile))
+	if err != nil {
+		t.Fatalf("%s: err: %s", name, err)
+	}
+	if actual != sum {
+		t.Fatalf("%s: '%s' was modified", name, mdbDataFile)
+	}
+	if _, err := os.Stat(filepath.Join(m.mdbPath, "lock.mdb")); err != nil {
+		t.Fatalf("%s: err: %s", name, err)
+	}
+	for _, path := range []string{m.boltPath, m.boltTempPath, m.mdbBackupPath, m.archivePath()} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s: '%s' was left behind: %v", name, path, err)
+		}
+	}
+}
+
+func TestMigrator_migrate_faults(t *testing.T) {
+	type faultCase struct {
+		name    string
+		src     map[string]int
+		dst     map[string]int
+		fs      map[string]int
+		archive string
+		class   ErrorClass
+		msg     string
+
+		// Set if raft.db can't be cleaned up
+		leftBolt bool
+	}
+	cases := []faultCase{
+		{name: "source first index", src: map[string]int{"FirstIndex": 1},
+			class: ErrClassLogStore, msg: "injected fault in FirstIndex"},
+		{name: "source last index", src: map[string]int{"LastIndex": 1},
+			class: ErrClassLogStore, msg: "injected fault in LastIndex"},
+		{name: "source stable key", src: map[string]int{"Get": 2},
+			class: ErrClassStableStore, msg: "Error getting key 'LastVoteTerm'"},
+		{name: "source first log", src: map[string]int{"GetLog": 1},
+			class: ErrClassLogStore, msg: "Error reading log"},
+		{name: "source later log", src: map[string]int{"GetLog": 3},
+			class: ErrClassLogStore, msg: "Error reading log"},
+		{name: "destination stable key", dst: map[string]int{"Set": 1},
+			class: ErrClassStableStore, msg: "Error storing key 'CurrentTerm'"},
+		{name: "destination logs", dst: map[string]int{"StoreLogs": 1},
+			class: ErrClassLogStore, msg: "injected fault in StoreLogs"},
+		{name: "activate", fs: map[string]int{"Rename": 1},
+			class: ErrClassActivate, msg: "Failed to activate Bolt store"},
+		{name: "archive rename", fs: map[string]int{"Rename": 2},
+			class: ErrClassArchive, msg: "Failed to archive LMDB data"},
+		{name: "archive rename and cleanup", fs: map[string]int{"Rename": 2, "Remove": 1},
+			class: ErrClassArchive, msg: "could not be removed", leftBolt: true},
+		{name: "gzip checksum", fs: map[string]int{"WriteFile": 1}, archive: ArchiveGzip,
+			class: ErrClassArchive, msg: "Error writing checksum"},
+		{name: "gzip rename", fs: map[string]int{"Rename": 2}, archive: ArchiveGzip,
+			class: ErrClassArchive, msg: "injected fault in Rename"},
+	}
+
+	for _, tc := range cases {
+		dir := testRaftDir(t)
+		defer os.RemoveAll(dir)
+
+		injected := newFaults(nil)
+		m := newFaultMigrator(t, dir, func(src, dst Backend) (Backend, Backend) {
+			if tc.src != nil {
+				injected = newFaults(tc.src)
+				src = &faultStore{src, injected}
+			}
+			if tc.dst != nil {
+				injected = newFaults(tc.dst)
+				dst = &faultStore{dst, injected}
+			}
+			return src, dst
+		})
+		if tc.archive != "" {
+			m.ArchiveFormat = tc.archive
+		}
+		_, sum, err := hashFile(filepath.Join(m.mdbPath, mdbDataFile))
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.name, err)
+		}
+
+		if tc.fs != nil {
+			injected = newFaults(tc.fs)
+			m.fs = &faultFS{osFileSystem{}, injected}
+		}
+
+		migrated, err := m.Migrate()
+		if err == nil || migrated {
+			t.Fatalf("%s: should fail", tc.name)
+		}
+		if len(injected.failed) == 0 {
+			t.Fatalf("%s: no fault was injected: %s", tc.name, err)
+		}
+		if ErrorClassOf(err) != tc.class {
+			t.Fatalf("%s: bad class %s: %s", tc.name, ErrorClassOf(err), err)
+		}
+		if !strings.Contains(err.Error(), tc.msg) {
+			t.Fatalf("%s: bad: %s", tc.name, err)
+		}
+		if tc.leftBolt {
+			os.Remove(m.boltPath)
+		}
+		checkUntouched(t, m.Migrator, tc.name, sum)
+
+		// A later attempt succeeds
+		m.wrap = nil
+		m.fs = osFileSystem{}
+		if _, err := m.Migrate(); err != nil {
+			t.Fatalf("%s: err: %s", tc.name, err)
+		}
+	}
+}
+
+func TestMigrator_migrate_removeLMDBFails(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.ArchiveFormat = ArchiveGzip
+	m.fs = &faultFS{osFileSystem{}, newFaults(map[string]int{"RemoveAll": 1})}
+	obs := &testObserver{}
+	m.Observer = obs
+
+	// The data is safely archived, so the migration still succeeds
+	migrated, err := m.Migrate()
+	if err != nil || !migrated {
+		t.Fatalf("bad: %v %v", migrated, err)
+	}
+	var warned bool
+	for _, event := range obs.events {
+		if strings.HasPrefix(event, "warning") && strings.Contains(event, "must be removed by hand") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Fatalf("bad: %v", obs.events)
+	}
+	for _, path := range []string{m.boltPath, m.archivePath(), m.mdbPath} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestMigrator_activateBoltStore_fails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.MkdirAll(m.raftPath, 0700); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(m.boltTempPath, []byte("bolt"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.fs = &faultFS{osFileSystem{}, newFaults(map[string]int{"Rename": 1})}
+
+	if err := m.activateBoltStore(); err == nil {
+		t.Fatalf("should fail")
+	}
+	if _, err := os.Stat(m.boltTempPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(m.boltPath); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The next call goes through
+	if err := m.activateBoltStore(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(m.boltPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestMigrator_archiveMDBStore_fails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.MkdirAll(m.mdbPath, 0700); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(m.boltPath, []byte("bolt"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The new store is removed so the LMDB data is used again
+	m.fs = &faultFS{osFileSystem{}, newFaults(map[string]int{"Rename": 1})}
+	if err := m.archiveMDBStore(); err == nil {
+		t.Fatalf("should fail")
+	}
+	if _, err := os.Stat(m.mdbPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(m.boltPath); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Failing to remove it is reported along with the original error
+	if err := ioutil.WriteFile(m.boltPath, []byte("bolt"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.fs = &faultFS{osFileSystem{}, newFaults(map[string]int{"Rename": 1, "Remove": 1})}
+	err = m.archiveMDBStore()
+	if err == nil || !strings.Contains(err.Error(), "could not be removed") {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package migrator
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// fileSystem is the set of file operations used to move the stores into
+// place once the data is copied, so that tests can make them fail.
+type fileSystem interface {
+	Rename(oldpath, newpath string) error
+	Remove(path string) error
+	RemoveAll(path string) error
+	WriteFile(path string, data []byte, perm os.FileMode) error
+}
+
+// osFileSystem is the fileSystem backed by the os package.
+type osFileSystem struct{}
+
+func (osFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFileSystem) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (osFileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFileSystem) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(path, data, perm)
+}
@@ -0,0 +1,238 @@
+package migrator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HookType identifies when a hook is run.
+type HookType string
+
+const (
+	// HookPre hooks run before any store is opened. If one fails, the
+	// migration is aborted. HookPost hooks run once a migration has
+	// completed and been verified, and HookFailure hooks run when a
+	// migration fails, including because of a pre hook.
+	HookPre     HookType = "pre"
+	HookPost    HookType = "post"
+	HookFailure HookType = "failure"
+
+	// DefaultHookTimeout is how long each hook may run before it is
+	// killed, unless HookTimeout is set.
+	DefaultHookTimeout = 5 * time.Minute
+
+	// hookOutputTail is how much of the end of a failed hook's output
+	// is included in its error.
+	hookOutputTail = 1024
+)
+
+// hookState is the migration state given to hooks as JSON on stdin.
+// The same values are also set as environment variables.
+type hookState struct {
+	Hook             HookType
+	DataDir          string
+	Status           string
+	Error            string `json:",omitempty"`
+	ErrorClass       string `json:",omitempty"`
+	FirstIndex       uint64
+	LastIndex        uint64
+	LogsCopied       int
+	LogsDropped      int
+	LogsQuarantined  []uint64 `json:",omitempty"`
+	StableKeysCopied int
+	ArchivePath      string `json:",omitempty"`
+	ManifestPath     string `json:",omitempty"`
+	Verified         bool
+}
+
+// env returns the state as environment variables.
+func (s *hookState) env() []string {
+	return []string{
+		"CONSUL_MIGRATE_HOOK=" + string(s.Hook),
+		"CONSUL_MIGRATE_DATA_DIR=" + s.DataDir,
+		"CONSUL_MIGRATE_STATUS=" + s.Status,
+		"CONSUL_MIGRATE_ERROR=" + s.Error,
+		"CONSUL_MIGRATE_ERROR_CLASS=" + s.ErrorClass,
+		"CONSUL_MIGRATE_FIRST_INDEX=" + strconv.FormatUint(s.FirstIndex, 10),
+		"CONSUL_MIGRATE_LAST_INDEX=" + strconv.FormatUint(s.LastIndex, 10),
+		"CONSUL_MIGRATE_LOGS_COPIED=" + strconv.Itoa(s.LogsCopied),
+		"CONSUL_MIGRATE_LOGS_DROPPED=" + strconv.Itoa(s.LogsDropped),
+		"CONSUL_MIGRATE_LOGS_QUARANTINED=" + strconv.Itoa(len(s.LogsQuarantined)),
+		"CONSUL_MIGRATE_STABLE_KEYS_COPIED=" + strconv.Itoa(s.StableKeysCopied),
+		"CONSUL_MIGRATE_ARCHIVE_PATH=" + s.ArchivePath,
+		"CONSUL_MIGRATE_MANIFEST_PATH=" + s.ManifestPath,
+		"CONSUL_MIGRATE_VERIFIED=" + strconv.FormatBool(s.Verified),
+	}
+}
+
+// hookState captures the current state of the migration for a hook.
+func (m *Migrator) hookState(hook HookType, migErr error) *hookState {
+	state := &hookState{
+		Hook:             hook,
+		DataDir:          m.dataDir,
+		FirstIndex:       m.report.FirstIndex,
+		LastIndex:        m.report.LastIndex,
+		LogsCopied:       m.report.LogsCopied,
+		LogsDropped:      m.report.LogsDropped,
+		LogsQuarantined:  m.quarantinedIndexes(),
+		StableKeysCopied: m.report.StableKeysCopied,
+		ArchivePath:      m.report.ArchivePath,
+		ManifestPath:     m.report.ManifestPath,
+		Verified:         m.verify != nil,
+	}
+	switch hook {
+	case HookPre:
+		state.Status = "starting"
+	case HookPost:
+		state.Status = "migrated"
+	case HookFailure:
+		state.Status = "failed"
+	}
+	if migErr != nil {
+		state.Error = migErr.Error()
+		state.ErrorClass = string(ErrorClassOf(migErr))
+	}
+	return state
+}
+
+// hookCommands returns the commands configured for a type of hook.
+func (m *Migrator) hookCommands(hook HookType) []string {
+	switch hook {
+	case HookPre:
+		return m.PreHooks
+	case HookPost:
+		return m.PostHooks
+	case HookFailure:
+		return m.FailureHooks
+	}
+	return nil
+}
+
+// runHooks runs each hook of the given type in order, stopping at the
+// first one which fails. migErr is the error which caused a migration
+// to fail, if any.
+func (m *Migrator) runHooks(hook HookType, migErr error) error {
+	commands := m.hookCommands(hook)
+	if len(commands) == 0 {
+		return nil
+	}
+
+	state := m.hookState(hook, migErr)
+	input, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(), state.env()...)
+
+	for _, command := range commands {
+		if err := m.runHook(hook, command, env, input); err != nil {
+			return fmt.Errorf("%s hook '%s' failed: %s", hook, command, err)
+		}
+	}
+	return nil
+}
+
+// runHook runs a single hook command using the shell, killing it and
+// any processes it started if it runs for longer than the hook timeout.
+// Its output is logged, and the end of it is included in the error if
+// the hook fails.
+func (m *Migrator) runHook(hook HookType, command string, env []string, input []byte) error {
+	timeout := m.HookTimeout
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+
+	cmd := shellCommand(command)
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(input)
+	out := &hookOutput{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	setProcessGroup(cmd)
+
+	m.Logger.Printf("[INFO] migrator: Running %s hook '%s'", hook, command)
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- cmd.Wait()
+	}()
+
+	// Children of the hook may keep its output open after it is killed,
+	// so don't wait for it to be closed.
+	var err error
+	select {
+	case err = <-doneCh:
+	case <-time.After(timeout):
+		killProcessGroup(cmd)
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out.Bytes()))
+	for scanner.Scan() {
+		m.Logger.Printf("[INFO] migrator: %s hook: %s", hook, scanner.Text())
+	}
+	if err != nil {
+		if tail := out.Tail(hookOutputTail); tail != "" {
+			return fmt.Errorf("%s, output: %s", err, tail)
+		}
+		return err
+	}
+	m.Logger.Printf("[DEBUG] migrator: Finished %s hook '%s' in %s",
+		hook, command, time.Now().Sub(start))
+	return nil
+}
+
+// hookOutput collects the output of a hook, which may still be written
+// to after the hook has been killed.
+type hookOutput struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (h *hookOutput) Write(p []byte) (int, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.buf.Write(p)
+}
+
+// Bytes returns a copy of the output so far.
+func (h *hookOutput) Bytes() []byte {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]byte(nil), h.buf.Bytes()...)
+}
+
+// Tail returns up to the last n bytes of the output, starting at a line
+// if it had to be cut.
+func (h *hookOutput) Tail(n int) string {
+	out := h.Bytes()
+	if len(out) > n {
+		out = out[len(out)-n:]
+		if i := bytes.IndexByte(out, '\n'); i >= 0 && i < len(out)-1 {
+			out = out[i+1:]
+		}
+		out = append([]byte("..."), out...)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// shellCommand returns a command which runs the given string using
+// the system shell.
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("/bin/sh", "-c", command)
+}
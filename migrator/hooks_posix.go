@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package migrator
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup runs a hook in its own process group, so anything it
+// starts can be killed along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills a hook started with setProcessGroup, and every
+// process it started which is still in its group.
+func killProcessGroup(cmd *exec.Cmd) {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,150 @@
+package migrator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrator_runHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewCopier()
+	m.dataDir = "/data"
+	m.report.LogsCopied = 42
+	m.verify = &VerifyResult{}
+	stdin := filepath.Join(dir, "stdin")
+	env := filepath.Join(dir, "env")
+	m.PostHooks = []string{
+		"cat > " + stdin,
+		"echo $CONSUL_MIGRATE_HOOK $CONSUL_MIGRATE_STATUS $CONSUL_MIGRATE_LOGS_COPIED $CONSUL_MIGRATE_VERIFIED > " + env,
+	}
+	if err := m.runHooks(HookPost, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The state is given on stdin
+	buf, err := ioutil.ReadFile(stdin)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var state hookState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if state.Hook != HookPost || state.Status != "migrated" || state.DataDir != "/data" ||
+		state.LogsCopied != 42 || !state.Verified {
+		t.Fatalf("bad: %#v", state)
+	}
+
+	// And in the environment
+	buf, err = ioutil.ReadFile(env)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(buf) != "post migrated 42 true\n" {
+		t.Fatalf("bad: %q", buf)
+	}
+}
+
+func TestMigrator_runHooks_fails(t *testing.T) {
+	m := NewCopier()
+	m.PreHooks = []string{"echo nope; exit 3", "echo never"}
+	err := m.runHooks(HookPre, nil)
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The end of the output is in the error
+	if !strings.Contains(err.Error(), "nope") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Hooks are killed after the timeout
+	m.HookTimeout = 50 * time.Millisecond
+	m.PreHooks = []string{"sleep 10"}
+	start := time.Now()
+	err = m.runHooks(HookPre, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("bad: %v", err)
+	}
+	if time.Now().Sub(start) > 5*time.Second {
+		t.Fatalf("hook was not killed")
+	}
+}
+
+func TestMigrator_runHooks_killsChildren(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The background child would write the file after the hook is killed
+	m := NewCopier()
+	m.HookTimeout = 100 * time.Millisecond
+	child := filepath.Join(dir, "child")
+	m.PreHooks = []string{"(sleep 1; touch " + child + ") & wait"}
+	err = m.runHooks(HookPre, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("bad: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(child); !os.IsNotExist(err) {
+		t.Fatalf("child was not killed: %v", err)
+	}
+}
+
+func TestHookOutput_Tail(t *testing.T) {
+	out := &hookOutput{}
+	out.Write([]byte("first\nsecond\nthird\n"))
+	if tail := out.Tail(100); tail != "first\nsecond\nthird" {
+		t.Fatalf("bad: %q", tail)
+	}
+	if tail := out.Tail(10); tail != "...third" {
+		t.Fatalf("bad: %q", tail)
+	}
+}
+
+func TestMigrator_migrate_preHookFails(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	failed := filepath.Join(dir, "failed")
+	m.PreHooks = []string{"exit 1"}
+	m.FailureHooks = []string{"echo $CONSUL_MIGRATE_ERROR_CLASS > " + failed}
+
+	_, err = m.Migrate()
+	if err == nil || ErrorClassOf(err) != ErrClassHook {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// No stores were opened
+	if _, err := os.Stat(m.boltTempPath); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := os.Stat(m.mdbPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The failure hook ran
+	buf, err := ioutil.ReadFile(failed)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(buf) != "hook\n" {
+		t.Fatalf("bad: %q", buf)
+	}
+}
@@ -0,0 +1,13 @@
+package migrator
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing on Windows, where hooks are run directly.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills a hook. Processes it started are not killed.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
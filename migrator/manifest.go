@@ -0,0 +1,440 @@
+package migrator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// ManifestFile is the name of the manifest written into the raft
+	// directory after a successful migration.
+	ManifestFile = "migration-manifest.json"
+
+	// manifestVersion is the version of the manifest format.
+	manifestVersion = 1
+
+	// manifestRangeSize is the number of logs covered by each hash
+	// in the manifest.
+	manifestRangeSize uint64 = 10000
+)
+
+// Version is the version of consul-migrate, recorded in manifests.
+var Version = "0.1.0"
+
+// Manifest is a record of a completed migration, written as JSON into
+// the raft directory. Besides describing the migration, it holds
+// enough hashes to check the BoltDB data later on without needing the
+// original LMDB data.
+type Manifest struct {
+	Version     int
+	ToolVersion string
+	StartedAt   time.Time
+	CompletedAt time.Time
+	Host        string
+	Source      string
+	Destination string
+
+	// SourceChecksum is the hash of data.mdb, if it was checked while
+	// migrating from a copy of the LMDB data.
+	SourceChecksum string `json:",omitempty"`
+
+	// FirstIndex and LastIndex are the range of the source log store,
+	// and LogsDropped the number of logs skipped by compaction.
+	FirstIndex       uint64
+	LastIndex        uint64
+	LogsCopied       int
+	LogsDropped      int
+	StableKeysCopied int
+
+	// LogsQuarantined are the indexes of logs which could not be read
+	// and were left out when salvaging.
+	LogsQuarantined []uint64 `json:",omitempty"`
+
+	// Transforms are the names of the log transforms applied, in order,
+	// so the logs are not an exact copy of the source.
+	Transforms []string `json:",omitempty"`
+
+	// StableKeys maps each copied stable store key to the hash of its
+	// value, and LogRanges covers all of the copied logs.
+	StableKeys map[string]string
+	LogRanges  []*LogRange
+
+	// Files are checksums of the files left behind by the migration,
+	// relative to the raft directory.
+	Files []*FileChecksum
+}
+
+// LogRange is the hash of the logs from First to Last, inclusive.
+type LogRange struct {
+	First  uint64
+	Last   uint64
+	SHA256 string
+}
+
+// FileChecksum is the checksum of a file. Mutable files are expected
+// to change once Consul starts using them, so a differing checksum is
+// not treated as a problem on its own. KeyID is the ID of the key the
+// file was encrypted with, if any.
+type FileChecksum struct {
+	Path    string
+	Size    int64
+	SHA256  string
+	Mutable bool   `json:",omitempty"`
+	KeyID   string `json:",omitempty"`
+}
+
+// logHasher hashes consecutive logs into ranges of a fixed size.
+type logHasher struct {
+	size   uint64
+	ranges []*LogRange
+	cur    *LogRange
+	hash   hash.Hash
+}
+
+func newLogHasher(size uint64) *logHasher {
+	return &logHasher{size: size}
+}
+
+// add hashes the next log. A new range is started if there is a gap
+// after the previous log, such as one left by a quarantined log.
+func (l *logHasher) add(log *raft.Log) {
+	if l.cur != nil && log.Index != l.cur.Last+1 {
+		l.flush()
+	}
+	if l.cur == nil {
+		l.cur = &LogRange{First: log.Index}
+		l.hash = sha256.New()
+	}
+	hashLog(l.hash, log)
+	l.cur.Last = log.Index
+	if l.cur.Last-l.cur.First+1 >= l.size {
+		l.flush()
+	}
+}
+
+// flush completes the current range, if any.
+func (l *logHasher) flush() {
+	if l.cur == nil {
+		return
+	}
+	l.cur.SHA256 = hex.EncodeToString(l.hash.Sum(nil))
+	l.ranges = append(l.ranges, l.cur)
+	l.cur = nil
+}
+
+// finish completes the last range and returns all of them.
+func (l *logHasher) finish() []*LogRange {
+	l.flush()
+	return l.ranges
+}
+
+// hashLog writes all of the fields of a log into a hash.
+func hashLog(h hash.Hash, log *raft.Log) {
+	h.Write(uint64ToBytes(log.Index))
+	h.Write(uint64ToBytes(log.Term))
+	h.Write([]byte{byte(log.Type)})
+	h.Write(uint64ToBytes(uint64(len(log.Data))))
+	h.Write(log.Data)
+}
+
+// hashValue returns the hex-encoded hash of a stable store value.
+func hashValue(val []byte) string {
+	sum := sha256.Sum256(val)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFile returns the size and hex-encoded hash of a file.
+func hashFile(path string) (int64, string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, fh)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// manifestPath returns the location of the manifest.
+func (m *Migrator) manifestPath() string {
+	return filepath.Join(m.raftPath, ManifestFile)
+}
+
+// writeManifest records the completed migration in the manifest. It
+// must be called once the stores are closed, so that the checksum of
+// the BoltDB file is final.
+func (m *Migrator) writeManifest() error {
+	man := m.newManifest()
+	if err := m.checksumFiles(man); err != nil {
+		return err
+	}
+	if err := writeManifestFile(m.manifestPath(), man); err != nil {
+		return err
+	}
+	m.report.ManifestPath = m.manifestPath()
+	m.Logger.Printf("[INFO] migrator: Wrote migration manifest to '%s'", m.report.ManifestPath)
+	return nil
+}
+
+// writePendingManifest records the copied data before the new store is
+// activated, without any file checksums. If the migration stops before
+// the LMDB data is archived, Startup verifies the new store against it.
+func (m *Migrator) writePendingManifest() error {
+	return writeManifestFile(m.manifestPath(), m.newManifest())
+}
+
+// newManifest describes the migration, without any file checksums.
+func (m *Migrator) newManifest() *Manifest {
+	host, _ := os.Hostname()
+	return &Manifest{
+		Version:          manifestVersion,
+		ToolVersion:      Version,
+		StartedAt:        m.start.UTC(),
+		CompletedAt:      time.Now().UTC(),
+		Host:             host,
+		Source:           m.mdbPath,
+		SourceChecksum:   m.report.SourceChecksum,
+		Destination:      m.boltPath,
+		FirstIndex:       m.report.FirstIndex,
+		LastIndex:        m.report.LastIndex,
+		LogsCopied:       m.report.LogsCopied,
+		LogsDropped:      m.report.LogsDropped,
+		StableKeysCopied: m.report.StableKeysCopied,
+		StableKeys:       m.stableHashes,
+		LogsQuarantined:  m.quarantinedIndexes(),
+		Transforms:       m.transformNames(),
+		LogRanges:        m.logHasher.finish(),
+	}
+}
+
+// checksumFiles records the checksums of the new store and whatever is
+// left of the LMDB data in the manifest.
+func (m *Migrator) checksumFiles(man *Manifest) error {
+	files := []*FileChecksum{{Path: m.boltPath, Mutable: true}}
+	switch m.ArchiveFormat {
+	case ArchiveGzip:
+		files = append(files, &FileChecksum{Path: m.report.ArchivePath, KeyID: m.report.ArchiveKeyID})
+	default:
+		files = append(files, &FileChecksum{Path: filepath.Join(m.mdbBackupPath, "data.mdb")})
+	}
+	for _, file := range files {
+		size, sum, err := hashFile(file.Path)
+		if err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(m.raftPath, file.Path); err == nil {
+			file.Path = filepath.ToSlash(rel)
+		}
+		file.Size, file.SHA256 = size, sum
+	}
+	man.Files = files
+	return nil
+}
+
+// writeManifestFile atomically writes a manifest to the given path.
+func writeManifestFile(path string, man *Manifest) error {
+	buf, err := json.MarshalIndent(man, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempPath := path + ".temp"
+	fh, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+	if _, err := fh.Write(append(buf, '\n')); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// ReadManifest reads a manifest written by a migration.
+func ReadManifest(path string) (*Manifest, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var man Manifest
+	if err := json.NewDecoder(fh).Decode(&man); err != nil {
+		return nil, fmt.Errorf("Error decoding manifest: %s", err)
+	}
+	if man.Version != manifestVersion {
+		return nil, fmt.Errorf("Unsupported manifest version %d", man.Version)
+	}
+	return &man, nil
+}
+
+// VerifyResult describes the outcome of checking a migrated store
+// against its manifest. Problems lists every mismatch found, and is
+// empty if the data still matches. Files which no longer exist, such
+// as a deleted backup, are listed in FilesMissing, and mutable files
+// which have changed in FilesModified; neither is a problem on its own.
+// FilesDecrypted counts the encrypted files which were decrypted and
+// read back, and FilesNotDecrypted lists those only checksummed since
+// no key was given.
+type VerifyResult struct {
+	Manifest          *Manifest
+	StableKeys        int
+	LogRanges         int
+	Files             int
+	FilesMissing      []string
+	FilesModified     []string
+	FilesDecrypted    int
+	FilesNotDecrypted []string
+	Problems          []string
+}
+
+// OK returns whether the verification found no problems.
+func (r *VerifyResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyResult) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// VerifyManifest checks the BoltDB store in the same directory as the
+// manifest at the given path against the hashes it contains. The store
+// is opened read-only, and can't be opened while Consul is running. An
+// error is only returned if the verification could not be carried out
+// at all.
+func VerifyManifest(path string) (*VerifyResult, error) {
+	return VerifyManifestWithKey(path, nil)
+}
+
+// VerifyManifestWithKey is like VerifyManifest, but also decrypts the
+// files which were encrypted with the given key, making sure they are
+// intact archives. It fails if a file was encrypted with another key.
+func VerifyManifestWithKey(path string, key *EncryptionKey) (*VerifyResult, error) {
+	man, err := ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+	result := &VerifyResult{Manifest: man}
+
+	// Check the other files written by the migration
+	for _, file := range man.Files {
+		filePath := filepath.Join(dir, filepath.FromSlash(file.Path))
+		size, sum, err := hashFile(filePath)
+		if os.IsNotExist(err) {
+			result.FilesMissing = append(result.FilesMissing, file.Path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Files++
+		if size == file.Size && sum == file.SHA256 {
+			if file.KeyID != "" {
+				if err := verifyEncryptedFile(result, filePath, file, key); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if file.Mutable {
+			result.FilesModified = append(result.FilesModified, file.Path)
+		} else {
+			result.problem("File '%s' has changed (sha256 %s, expected %s)",
+				file.Path, sum, file.SHA256)
+		}
+	}
+
+	// Open the store which was migrated into
+	store, err := newReadOnlyBoltStore(filepath.Join(dir, boltFile))
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open BoltDB: %s", err)
+	}
+	defer store.Close()
+
+	// Check the stable store
+	for key, expect := range man.StableKeys {
+		result.StableKeys++
+		val, err := store.Get([]byte(key))
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+		if val == nil {
+			result.problem("Stable store key '%s' not found", key)
+			continue
+		}
+		if sum := hashValue(val); sum != expect {
+			result.problem("Stable store key '%s' has changed", key)
+		}
+	}
+
+	// Check each of the log ranges
+	for _, r := range man.LogRanges {
+		result.LogRanges++
+		if err := verifyLogRange(store, r); err != nil {
+			result.problem("Logs %d to %d: %s", r.First, r.Last, err)
+		}
+	}
+	return result, nil
+}
+
+// verifyEncryptedFile decrypts an encrypted archive and reads it back,
+// if the key it was encrypted with was given.
+func verifyEncryptedFile(result *VerifyResult, path string, file *FileChecksum, key *EncryptionKey) error {
+	if key == nil {
+		result.FilesNotDecrypted = append(result.FilesNotDecrypted, file.Path)
+		return nil
+	}
+	if err := checkKeyID(file.KeyID, key); err != nil {
+		return fmt.Errorf("Can't decrypt '%s': %s", file.Path, err)
+	}
+	if err := readArchive(path, key); err != nil {
+		result.problem("File '%s' can't be decrypted: %s", file.Path, err)
+		return nil
+	}
+	result.FilesDecrypted++
+	return nil
+}
+
+// verifyLogRange rehashes a range of logs and compares the result.
+func verifyLogRange(store raft.LogStore, r *LogRange) error {
+	h := sha256.New()
+	for i := r.First; i <= r.Last; i++ {
+		log := &raft.Log{}
+		if err := store.GetLog(i, log); err != nil {
+			if err == raft.ErrLogNotFound {
+				return fmt.Errorf("log %d not found", i)
+			}
+			return err
+		}
+		hashLog(h, log)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != r.SHA256 {
+		return fmt.Errorf("hash mismatch")
+	}
+	return nil
+}
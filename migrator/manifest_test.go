@@ -0,0 +1,177 @@
+package migrator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+)
+
+func TestLogHasher(t *testing.T) {
+	l := newLogHasher(3)
+	for i := uint64(5); i <= 11; i++ {
+		l.add(&raft.Log{Index: i, Term: 1, Data: []byte("foo")})
+	}
+	ranges := l.finish()
+	if len(ranges) != 3 {
+		t.Fatalf("bad: %d", len(ranges))
+	}
+	expect := [][2]uint64{{5, 7}, {8, 10}, {11, 11}}
+	for i, r := range ranges {
+		if r.First != expect[i][0] || r.Last != expect[i][1] || r.SHA256 == "" {
+			t.Fatalf("bad: %d %#v", i, r)
+		}
+	}
+
+	// Identical logs hash the same, any change does not
+	other := newLogHasher(3)
+	for i := uint64(5); i <= 11; i++ {
+		other.add(&raft.Log{Index: i, Term: 1, Data: []byte("foo")})
+	}
+	if other.finish()[1].SHA256 != ranges[1].SHA256 {
+		t.Fatalf("hashes should match")
+	}
+	other = newLogHasher(3)
+	for i := uint64(5); i <= 7; i++ {
+		other.add(&raft.Log{Index: i, Term: 2, Data: []byte("foo")})
+	}
+	if other.finish()[0].SHA256 == ranges[0].SHA256 {
+		t.Fatalf("hashes should differ")
+	}
+}
+
+func TestMigrator_manifest(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	report := m.Report()
+	if report.ManifestPath != filepath.Join(m.raftPath, ManifestFile) {
+		t.Fatalf("bad: %s", report.ManifestPath)
+	}
+
+	// Check the contents of the manifest
+	man, err := ReadManifest(report.ManifestPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if man.ToolVersion != Version || man.Destination != m.boltPath || man.Source != m.mdbPath {
+		t.Fatalf("bad: %#v", man)
+	}
+	if man.CompletedAt.Before(man.StartedAt) {
+		t.Fatalf("bad: %s %s", man.StartedAt, man.CompletedAt)
+	}
+	if man.FirstIndex != report.FirstIndex || man.LastIndex != report.LastIndex ||
+		man.LogsCopied != report.LogsCopied || man.StableKeysCopied != report.StableKeysCopied {
+		t.Fatalf("bad: %#v", man)
+	}
+	if len(man.StableKeys) != report.StableKeysCopied {
+		t.Fatalf("bad: %v", man.StableKeys)
+	}
+	if len(man.LogRanges) == 0 || man.LogRanges[0].First != man.FirstIndex ||
+		man.LogRanges[len(man.LogRanges)-1].Last != man.LastIndex {
+		t.Fatalf("bad: %#v", man.LogRanges)
+	}
+	if len(man.Files) != 2 || man.Files[0].Path != boltFile || !man.Files[0].Mutable ||
+		man.Files[1].Path != "mdb.backup/data.mdb" || man.Files[1].Mutable {
+		t.Fatalf("bad: %#v", man.Files)
+	}
+
+	// Verifies cleanly
+	result, err := VerifyManifest(report.ManifestPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !result.OK() || result.Files != 2 || result.LogRanges != len(man.LogRanges) ||
+		result.StableKeys != len(man.StableKeys) {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	// Still verifies once the backup is deleted
+	if err := os.RemoveAll(m.mdbBackupPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	result, err = VerifyManifest(report.ManifestPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !result.OK() || len(result.FilesMissing) != 1 {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	// Changing a log is detected
+	store, err := raftboltdb.NewBoltStore(m.boltPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	log := &raft.Log{}
+	if err := store.GetLog(man.LastIndex, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	log.Data = append(log.Data, 'x')
+	if err := store.StoreLog(log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("CurrentTerm"), []byte("nope")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	result, err = VerifyManifest(report.ManifestPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.OK() || len(result.Problems) != 2 {
+		t.Fatalf("bad: %#v", result.Problems)
+	}
+	if len(result.FilesModified) != 1 || result.FilesModified[0] != boltFile {
+		t.Fatalf("bad: %v", result.FilesModified)
+	}
+}
+
+func TestMigrator_manifest_gzip(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.ArchiveFormat = ArchiveGzip
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	man, err := ReadManifest(m.Report().ManifestPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(man.Files) != 2 || man.Files[1].Path != mdbArchiveFile ||
+		man.Files[1].SHA256 != m.Report().ArchiveChecksum {
+		t.Fatalf("bad: %#v", man.Files[1])
+	}
+
+	// A corrupted archive is a problem
+	fh, err := os.OpenFile(m.Report().ArchivePath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fh.Write([]byte("junk"))
+	fh.Close()
+
+	result, err := VerifyManifest(m.Report().ManifestPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result.OK() {
+		t.Fatalf("should fail")
+	}
+}
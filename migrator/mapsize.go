@@ -0,0 +1,119 @@
+package migrator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/armon/gomdb"
+)
+
+const (
+	// minMapSize is the smallest map size used for LMDB, so that small
+	// stores still have room for the tables to be opened.
+	minMapSize uint64 = 64 * 1024 * 1024
+
+	// maxMapSize32bit is the largest map which can reliably fit into
+	// the address space of a 32-bit process.
+	maxMapSize32bit uint64 = 2 * 1024 * 1024 * 1024
+
+	// newMapSize64bit is the map size used for a new environment on
+	// a 64-bit platform, which mirrors the setting in Consul.
+	newMapSize64bit uint64 = 64 * 1024 * 1024 * 1024
+)
+
+// mdbMapSize returns the map size to open the LMDB environment in the
+// given mdb directory with. Unless an override is given, it is derived
+// from the size of data.mdb and the pages in use according to the
+// environment, plus a quarter for headroom. New environments, which
+// have no data yet, get the largest size usable. An error is returned
+// if the map can't fit into the address space of this platform.
+func mdbMapSize(dir string, override uint64) (uint64, error) {
+	size := override
+	if size == 0 {
+		used, err := mdbUsedSize(dir)
+		if err != nil {
+			return 0, err
+		}
+		if used == 0 {
+			return newMapSize(), nil
+		}
+		size = used + used/4
+		if size < minMapSize {
+			size = minMapSize
+		}
+		const mb = 1024 * 1024
+		size = (size + mb - 1) / mb * mb
+	}
+
+	if max := maxMapSize(); size > max {
+		return 0, fmt.Errorf("LMDB data in '%s' needs a map size of %d bytes, "+
+			"which is more than the %d bytes which can be mapped by a %d-bit "+
+			"process. Run the migration on a 64-bit platform instead",
+			dir, size, max, strconv.IntSize)
+	}
+	return size, nil
+}
+
+// maxMapSize returns the largest map size usable on this platform.
+func maxMapSize() uint64 {
+	if strconv.IntSize == 32 {
+		return maxMapSize32bit
+	}
+	return 1<<64 - 1
+}
+
+// newMapSize returns the map size used for a new environment.
+func newMapSize() uint64 {
+	if strconv.IntSize == 32 {
+		return maxMapSize32bit
+	}
+	return newMapSize64bit
+}
+
+// mdbUsedSize returns the number of bytes used by an LMDB environment,
+// which is the larger of the data file size and the pages in use
+// according to the environment info. Returns 0 if there is no data.
+func mdbUsedSize(dir string) (uint64, error) {
+	fi, err := os.Stat(filepath.Join(dir, mdbDataFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() == 0 {
+		return 0, nil
+	}
+	used := uint64(fi.Size())
+
+	// Map just the file so the size Consul chose is not used, without
+	// touching the lock file
+	env, err := mdb.NewEnv()
+	if err != nil {
+		return 0, err
+	}
+	defer env.Close()
+	if err := env.SetMaxDBs(mdb.DBI(mdbMaxTables)); err != nil {
+		return 0, err
+	}
+	if err := env.SetMapSize(used); err != nil {
+		return 0, err
+	}
+	if err := env.Open(dir, mdb.NOTLS|mdb.RDONLY|mdb.NOLOCK, 0755); err != nil {
+		return 0, err
+	}
+	info, err := env.Info()
+	if err != nil {
+		return 0, err
+	}
+	stat, err := env.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if pages := uint64(info.LastPNO+1) * uint64(stat.PSize); pages > used {
+		used = pages
+	}
+	return used, nil
+}
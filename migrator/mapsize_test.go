@@ -0,0 +1,64 @@
+package migrator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMDBMapSize(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+	mdbPath := filepath.Join(dir, raftDir, mdbDir)
+
+	// The override is used as-is
+	size, err := mdbMapSize(mdbPath, 123*1024*1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if size != 123*1024*1024 {
+		t.Fatalf("bad: %d", size)
+	}
+
+	// Otherwise it fits the data with some headroom
+	fi, err := os.Stat(filepath.Join(mdbPath, mdbDataFile))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	size, err = mdbMapSize(mdbPath, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if size < uint64(fi.Size()) || size < minMapSize || size%(1024*1024) != 0 {
+		t.Fatalf("bad: %d", size)
+	}
+}
+
+func TestMDBMapSize_new(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	size, err := mdbMapSize(dir, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if size != newMapSize() {
+		t.Fatalf("bad: %d", size)
+	}
+}
+
+func TestMDBMapSize_tooLarge(t *testing.T) {
+	if strconv.IntSize != 32 {
+		t.Skip("only applies to 32-bit platforms")
+	}
+	_, err := mdbMapSize("mdb", maxMapSize32bit+1)
+	if err == nil || !strings.Contains(err.Error(), "64-bit platform") {
+		t.Fatalf("bad: %v", err)
+	}
+}
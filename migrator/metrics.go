@@ -0,0 +1,313 @@
+package migrator
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// metricsInterval limits how often progress gauges are emitted
+	// and the sinks are flushed during a phase.
+	metricsInterval = time.Second
+
+	// statsdMaxPacket keeps statsd packets below a typical MTU
+	statsdMaxPacket = 1400
+)
+
+// MetricsSink receives the metrics emitted during a migration. Keys are
+// dot-separated names, such as "phase.log-store.duration", which sinks
+// may rewrite to suit their format. Durations are in milliseconds.
+// Flush is called periodically and at the end of every run.
+type MetricsSink interface {
+	SetGauge(key string, val float64)
+	IncrCounter(key string, val float64)
+	AddSample(key string, val float64)
+	Flush() error
+}
+
+// FanoutSink sends metrics to several sinks at once.
+type FanoutSink []MetricsSink
+
+func (f FanoutSink) SetGauge(key string, val float64) {
+	for _, s := range f {
+		s.SetGauge(key, val)
+	}
+}
+
+func (f FanoutSink) IncrCounter(key string, val float64) {
+	for _, s := range f {
+		s.IncrCounter(key, val)
+	}
+}
+
+func (f FanoutSink) AddSample(key string, val float64) {
+	for _, s := range f {
+		s.AddSample(key, val)
+	}
+}
+
+func (f FanoutSink) Flush() error {
+	var err error
+	for _, s := range f {
+		if ferr := s.Flush(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// metricGauge sets a gauge if metrics are enabled.
+func (m *Migrator) metricGauge(key string, val float64) {
+	if m.Metrics != nil {
+		m.Metrics.SetGauge(key, val)
+	}
+}
+
+// metricCounter increments a counter if metrics are enabled.
+func (m *Migrator) metricCounter(key string, val float64) {
+	if m.Metrics != nil {
+		m.Metrics.IncrCounter(key, val)
+	}
+}
+
+// metricTiming records a duration sample if metrics are enabled.
+func (m *Migrator) metricTiming(key string, d time.Duration) {
+	if m.Metrics != nil {
+		m.Metrics.AddSample(key, float64(d)/float64(time.Millisecond))
+	}
+}
+
+// metricProgress emits the progress gauges of the current phase, at
+// most once per metricsInterval unless force is set, and flushes the
+// sink so the progress is visible while the migration runs.
+func (m *Migrator) metricProgress(update *ProgressUpdate, force bool) {
+	if m.Metrics == nil {
+		return
+	}
+	now := time.Now()
+	if !force && now.Sub(m.lastMetrics) < metricsInterval {
+		return
+	}
+	m.lastMetrics = now
+
+	prefix := "phase." + string(update.Phase)
+	m.Metrics.SetGauge(prefix+".progress", update.Progress)
+	m.Metrics.SetGauge(prefix+".items_per_second", update.Rate)
+	m.Metrics.SetGauge(prefix+".bytes_per_second", update.ByteRate)
+	m.flushMetrics()
+}
+
+// flushMetrics flushes the sink, logging any errors since metrics
+// should never cause a migration to fail.
+func (m *Migrator) flushMetrics() {
+	if m.Metrics == nil {
+		return
+	}
+	if err := m.Metrics.Flush(); err != nil {
+		m.Logger.Printf("[WARN] migrator: Failed to flush metrics: %v", err)
+	}
+}
+
+// StatsdSink sends metrics to a statsd server over UDP. Lines are
+// buffered and sent in packets which fit within a typical MTU.
+type StatsdSink struct {
+	conn   net.Conn
+	prefix string
+	buf    bytes.Buffer
+	lock   sync.Mutex
+}
+
+// NewStatsdSink creates a sink which sends metrics to the statsd server
+// at addr. Every key is prefixed with prefix, if not empty, so that a
+// dashboard can tell the servers apart.
+func NewStatsdSink(addr, prefix string) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &StatsdSink{conn: conn, prefix: prefix}, nil
+}
+
+func (s *StatsdSink) SetGauge(key string, val float64) {
+	s.write(key, val, "g")
+}
+
+func (s *StatsdSink) IncrCounter(key string, val float64) {
+	s.write(key, val, "c")
+}
+
+func (s *StatsdSink) AddSample(key string, val float64) {
+	s.write(key, val, "ms")
+}
+
+// write buffers a metric line, sending the buffer first if the line
+// would not fit in the current packet.
+func (s *StatsdSink) write(key string, val float64, kind string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	line := fmt.Sprintf("%s%s:%g|%s\n", s.prefix, key, val, kind)
+	if s.buf.Len()+len(line) > statsdMaxPacket {
+		s.flush()
+	}
+	s.buf.WriteString(line)
+}
+
+// Flush sends any buffered metrics.
+func (s *StatsdSink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flush()
+}
+
+func (s *StatsdSink) flush() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(s.buf.Bytes())
+	s.buf.Reset()
+	return err
+}
+
+// Close flushes and closes the connection.
+func (s *StatsdSink) Close() error {
+	s.Flush()
+	return s.conn.Close()
+}
+
+// promNameRe matches the characters which are not allowed in
+// Prometheus metric names.
+var promNameRe = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// promSummary accumulates samples for the Prometheus sink.
+type promSummary struct {
+	count int
+	sum   float64
+	max   float64
+}
+
+// PrometheusFileSink writes metrics in the Prometheus text format to a
+// file, for use with the node exporter's textfile collector. The whole
+// file is rewritten atomically on every flush.
+type PrometheusFileSink struct {
+	path   string
+	labels string
+
+	gauges    map[string]float64
+	counters  map[string]float64
+	summaries map[string]*promSummary
+	lock      sync.Mutex
+}
+
+// NewPrometheusFileSink creates a sink writing to the file at path. The
+// labels are added to every metric, such as the host name.
+func NewPrometheusFileSink(path string, labels map[string]string) *PrometheusFileSink {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", promName(k), v))
+	}
+	sort.Strings(pairs)
+
+	labelStr := ""
+	if len(pairs) > 0 {
+		labelStr = "{" + strings.Join(pairs, ",") + "}"
+	}
+	return &PrometheusFileSink{
+		path:      path,
+		labels:    labelStr,
+		gauges:    make(map[string]float64),
+		counters:  make(map[string]float64),
+		summaries: make(map[string]*promSummary),
+	}
+}
+
+// promName converts a metric key into a valid Prometheus name.
+func promName(key string) string {
+	return promNameRe.ReplaceAllString(key, "_")
+}
+
+func (p *PrometheusFileSink) SetGauge(key string, val float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.gauges[promName(key)] = val
+}
+
+func (p *PrometheusFileSink) IncrCounter(key string, val float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.counters[promName(key)] += val
+}
+
+func (p *PrometheusFileSink) AddSample(key string, val float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	name := promName(key)
+	s, ok := p.summaries[name]
+	if !ok {
+		s = &promSummary{}
+		p.summaries[name] = s
+	}
+	s.count++
+	s.sum += val
+	if val > s.max {
+		s.max = val
+	}
+}
+
+// Flush writes all of the metrics to the file.
+func (p *PrometheusFileSink) Flush() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var buf bytes.Buffer
+	for _, name := range sortedKeys(p.gauges) {
+		full := "consul_migrate_" + name
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n%s%s %g\n", full, full, p.labels, p.gauges[name])
+	}
+	for _, name := range sortedKeys(p.counters) {
+		full := "consul_migrate_" + name + "_total"
+		fmt.Fprintf(&buf, "# TYPE %s counter\n%s%s %g\n", full, full, p.labels, p.counters[name])
+	}
+
+	names := make([]string, 0, len(p.summaries))
+	for name := range p.summaries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := p.summaries[name]
+		full := "consul_migrate_" + name
+		fmt.Fprintf(&buf, "# TYPE %s summary\n", full)
+		fmt.Fprintf(&buf, "%s_sum%s %g\n", full, p.labels, s.sum)
+		fmt.Fprintf(&buf, "%s_count%s %d\n", full, p.labels, s.count)
+		fmt.Fprintf(&buf, "# TYPE %s_max gauge\n%s_max%s %g\n", full, full, p.labels, s.max)
+	}
+
+	tempPath := p.path + ".temp"
+	if err := ioutil.WriteFile(tempPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, p.path)
+}
+
+// sortedKeys returns the keys of a metric map in order.
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
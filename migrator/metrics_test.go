@@ -0,0 +1,169 @@
+package migrator
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSink records the keys of all emitted metrics.
+type testSink struct {
+	gauges   map[string]float64
+	counters map[string]float64
+	samples  map[string]int
+	flushes  int
+	lock     sync.Mutex
+}
+
+func newTestSink() *testSink {
+	return &testSink{
+		gauges:   make(map[string]float64),
+		counters: make(map[string]float64),
+		samples:  make(map[string]int),
+	}
+}
+
+func (s *testSink) SetGauge(key string, val float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gauges[key] = val
+}
+
+func (s *testSink) IncrCounter(key string, val float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counters[key] += val
+}
+
+func (s *testSink) AddSample(key string, val float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.samples[key]++
+}
+
+func (s *testSink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flushes++
+	return nil
+}
+
+func TestMigrator_metrics(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sink := newTestSink()
+	m.Metrics = sink
+
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, phase := range []Phase{PhaseStableStore, PhaseLogStore, PhaseActivate, PhaseArchive} {
+		if sink.samples["phase."+string(phase)+".duration"] != 1 {
+			t.Fatalf("missing duration for %s: %v", phase, sink.samples)
+		}
+	}
+	batches := (m.Report().LogsCopied + logBatchSize - 1) / logBatchSize
+	if sink.samples["log-store.commit"] != batches || sink.samples["bolt.sync"] != 1 {
+		t.Fatalf("bad: %v", sink.samples)
+	}
+	if _, ok := sink.gauges["phase.log-store.items_per_second"]; !ok {
+		t.Fatalf("bad: %v", sink.gauges)
+	}
+	if sink.gauges["migrating"] != 0 || sink.counters["migrations"] != 1 {
+		t.Fatalf("bad: %v %v", sink.gauges, sink.counters)
+	}
+	if sink.flushes == 0 {
+		t.Fatalf("never flushed")
+	}
+
+	// Errors are counted by class
+	m.ArchiveFormat = "nope"
+	os.Rename(m.mdbBackupPath, m.mdbPath)
+	if _, err := m.Migrate(); err == nil {
+		t.Fatalf("should fail")
+	}
+	if sink.counters["errors.config"] != 1 {
+		t.Fatalf("bad: %v", sink.counters)
+	}
+}
+
+func TestStatsdSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+
+	sink, err := NewStatsdSink(conn.LocalAddr().String(), "consul-migrate.host1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer sink.Close()
+
+	sink.SetGauge("migrating", 1)
+	sink.IncrCounter("errors.source", 1)
+	sink.AddSample("log-store.commit", 1.5)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	buf := make([]byte, statsdMaxPacket)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expect := "consul-migrate.host1.migrating:1|g\n" +
+		"consul-migrate.host1.errors.source:1|c\n" +
+		"consul-migrate.host1.log-store.commit:1.5|ms\n"
+	if string(buf[:n]) != expect {
+		t.Fatalf("bad: %q", buf[:n])
+	}
+}
+
+func TestPrometheusFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "consul-migrate.prom")
+
+	sink := NewPrometheusFileSink(path, map[string]string{"host": "host1"})
+	sink.SetGauge("phase.log-store.progress", 50)
+	sink.IncrCounter("errors.source", 1)
+	sink.IncrCounter("errors.source", 1)
+	sink.AddSample("log-store.commit", 2)
+	sink.AddSample("log-store.commit", 4)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	out := string(buf)
+	for _, expect := range []string{
+		`consul_migrate_phase_log_store_progress{host="host1"} 50`,
+		`consul_migrate_errors_source_total{host="host1"} 2`,
+		`consul_migrate_log_store_commit_sum{host="host1"} 6`,
+		`consul_migrate_log_store_commit_count{host="host1"} 2`,
+		`consul_migrate_log_store_commit_max{host="host1"} 4`,
+	} {
+		if !strings.Contains(out, expect) {
+			t.Fatalf("missing %q: %s", expect, out)
+		}
+	}
+}
@@ -2,9 +2,12 @@ package migrator
 
 import (
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
-	"runtime"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/raft-boltdb"
@@ -23,16 +26,22 @@ const (
 	boltFile     = "raft.db"
 	boltTempFile = "raft.db.temp"
 
-	// Maximum log sizes for LMDB. These mirror settings in Consul
-	// and are automatically set based on the runtime.
-	maxLogSize32bit uint64 = 8 * 1024 * 1024 * 1024
-	maxLogSize64bit uint64 = 64 * 1024 * 1024 * 1024
+	// Written once the temporary BoltDB file has been synced, since it is
+	// bulk loaded without syncing and can't be trusted after a crash
+	// otherwise
+	boltSyncedFile = "raft.db.temp.synced"
+
+	// DefaultTrailingLogs is the number of logs retained before the
+	// latest snapshot when compacting. This mirrors the Raft default
+	// used by Consul.
+	DefaultTrailingLogs uint64 = 10240
 )
 
 var (
 	// Common error messages from migrator
 	errFirstIndexZero = fmt.Errorf("No logs found (first index was 0)")
 	errLastIndexZero  = fmt.Errorf("No logs found (last index was 0)")
+	errAborted        = fmt.Errorf("Migration was aborted")
 
 	// stableStoreKeys are the well-known keys written to the
 	// stable store, and are used internally by Raft. We hard-code
@@ -51,19 +60,162 @@ var (
 // and create a new BoltStore with the same data.
 type Migrator struct {
 	// Channels used to expose what's happening internally
-	// during a migration.
+	// during a migration. Updates are dropped if the channel
+	// is full, except that the last update of each phase is
+	// queued in place of the oldest one, so a buffered channel
+	// always ends with the final update. It is closed when
+	// Migrate or Copy returns.
 	ProgressCh chan *ProgressUpdate
 
+	// Observer, if set, is notified of every event during a
+	// migration without dropping any of them.
+	Observer MigrationObserver
+
+	// Metrics, if set, receives timing and throughput metrics.
+	Metrics MetricsSink
+
+	// Logger receives leveled log lines, using the "[DEBUG]",
+	// "[INFO]", "[WARN]" and "[ERR]" prefixes. Logs are discarded
+	// by default.
+	Logger *log.Logger
+
+	// Compact enables dropping logs which are already covered by the
+	// latest Raft snapshot. TrailingLogs is the number of logs below
+	// the snapshot index which are kept, like Raft's own setting.
+	Compact      bool
+	TrailingLogs uint64
+
+	// ArchiveFormat controls what happens to the LMDB data after a
+	// successful migration. By default it is renamed to mdb.backup.
+	// With ArchiveGzip, a compressed and checksummed tarball is written
+	// to ArchivePath (raft/mdb.backup.tar.gz if empty) instead, and
+	// the original directory is removed once the archive is verified.
+	ArchiveFormat string
+	ArchivePath   string
+
+	// EncryptionKey, if set, encrypts the compressed archive with
+	// AES-GCM, and its ID is recorded in the manifest. It requires
+	// ArchiveGzip, since renamed LMDB data can't be encrypted.
+	EncryptionKey *EncryptionKey
+
+	// Salvage makes logs which can't be read from the source get
+	// quarantined instead of failing the migration. They are written,
+	// with their raw bytes where possible, to QuarantinePath, which
+	// defaults to raft/quarantine.json. Copy only writes the file if
+	// QuarantinePath is set, and can't recover the raw bytes.
+	Salvage        bool
+	QuarantinePath string
+
+	// CopySource makes the migration read from a point-in-time copy
+	// of the LMDB environment, made in a temporary directory under
+	// ScratchDir (the system default if empty), instead of the live
+	// data. Consul must still be stopped, since the copy doesn't take
+	// the LMDB lock. The original data.mdb is checksummed before and
+	// after, and the migration fails if it changed.
+	CopySource bool
+	ScratchDir string
+
+	// MapSize overrides the map size used to open the LMDB environment,
+	// in bytes. By default it is derived from the size of the data.
+	MapSize uint64
+
+	// DiscardPartial makes Migrate always remove a raft.db.temp file
+	// left behind by an earlier run which was killed. By default, if
+	// the file was synced before the run stopped, its logs are checked
+	// against the source and kept if they all match, so the copy can
+	// resume after them. A file which was not synced is discarded.
+	DiscardPartial bool
+
+	// Validation controls how the source data is checked against the
+	// Raft invariants while it is copied: ValidateWarn (the default if
+	// empty) reports violations, ValidateStrict also fails the copy if
+	// any is an error, and ValidateOff skips the checks.
+	Validation string
+
+	// AddressMap rewrites server addresses while migrating, so the data
+	// can be used by servers on a new network. Keys are either a full
+	// "host:port" address or a host alone, which keeps the port, and
+	// map to an address of the same form. LastVoteCand, the peers.json
+	// file, the peers in peer change logs and the peers in the metadata
+	// of each snapshot are rewritten.
+	AddressMap map[string]string
+
+	// Transforms are applied in order to each log as it is copied, and
+	// may modify, drop or annotate it. What each one did is recorded
+	// in the report. A partial BoltDB file left by an earlier run is
+	// always discarded when transforms are set.
+	Transforms []LogTransform
+
+	// Overwrite lets Copy write into a destination which already holds
+	// logs or stable store keys. By default such a destination is
+	// refused, since the copied data would be mixed with what is there.
+	Overwrite bool
+
+	// PreHooks, PostHooks and FailureHooks are shell commands run by
+	// Migrate before any store is opened, once the migration has been
+	// completed and verified, and when it fails. The state of the
+	// migration is given to each as JSON on stdin and in environment
+	// variables. A failing pre hook aborts the migration. Hooks are
+	// killed after HookTimeout, or DefaultHookTimeout if zero, along
+	// with any processes they started. The end of a failed hook's output
+	// is included in its error.
+	PreHooks     []string
+	PostHooks    []string
+	FailureHooks []string
+	HookTimeout  time.Duration
+
 	dataDir   string                // The Consul data-dir
 	mdbStore  *raftmdb.MDBStore     // The legacy MDB environment
+	mdbSource string                // The mdb directory being read
+	mapSize   uint64                // The LMDB map size in use
+	resuming  bool                  // Set if raft.db.temp was kept
 	boltStore *raftboltdb.BoltStore // Handle for the new store
+	bulkStore *bulkBoltStore        // The new store while bulk loading
+	report    *Report               // Summary of the last migration
+
+	// Closed to abort the copy
+	abortCh   chan struct{}
+	abortOnce sync.Once
+
+	// Used to move the stores into place
+	fs fileSystem
+
+	// State of the current run and phase, used to compute progress
+	// updates and durations
+	start       time.Time
+	phase       Phase
+	phaseStart  time.Time
+	phaseBytes  int64
+	lastMetrics time.Time
+
+	// Set once the progress channel has been closed
+	progressClosed bool
+
+	// Hashes of the copied data, recorded in the manifest
+	stableHashes map[string]string
+	logHasher    *logHasher
+
+	// Checks the copied data against the Raft invariants
+	validator *validator
+
+	// The result of verifying the migrated data against the manifest,
+	// or why it could not be verified
+	verify    *VerifyResult
+	verifyErr error
+
+	// The stores data is copied between. During Migrate these are
+	// the MDB and Bolt stores, but Copy may use any Backend.
+	src Backend
+	dst Backend
 
 	// Calculated paths based on the data dir
 	raftPath      string
+	snapshotPath  string
 	mdbPath       string
 	mdbBackupPath string
 	boltPath      string
 	boltTempPath  string
+	boltSynced    string
 }
 
 // New creates a new Migrator given the path to a Consul
@@ -75,34 +227,51 @@ func New(dataDir string) (*Migrator, error) {
 	}
 
 	// Create the struct
-	m := &Migrator{
-		ProgressCh: make(chan *ProgressUpdate, 128),
-		dataDir:    dataDir,
-
-		raftPath:      filepath.Join(dataDir, raftDir),
-		mdbPath:       filepath.Join(dataDir, raftDir, mdbDir),
-		mdbBackupPath: filepath.Join(dataDir, raftDir, mdbBackupDir),
-		boltPath:      filepath.Join(dataDir, raftDir, boltFile),
-		boltTempPath:  filepath.Join(dataDir, raftDir, boltTempFile),
-	}
+	m := NewCopier()
+	m.dataDir = dataDir
+	m.raftPath = filepath.Join(dataDir, raftDir)
+	m.snapshotPath = filepath.Join(dataDir, raftDir, snapshotDir)
+	m.mdbPath = filepath.Join(dataDir, raftDir, mdbDir)
+	m.mdbBackupPath = filepath.Join(dataDir, raftDir, mdbBackupDir)
+	m.boltPath = filepath.Join(dataDir, raftDir, boltFile)
+	m.boltTempPath = filepath.Join(dataDir, raftDir, boltTempFile)
+	m.boltSynced = filepath.Join(dataDir, raftDir, boltSyncedFile)
 
 	return m, nil
 }
 
+// NewCopier creates a Migrator which is not tied to a Consul data-dir.
+// It can only be used to Copy data between arbitrary backends.
+func NewCopier() *Migrator {
+	m := &Migrator{
+		ProgressCh:    make(chan *ProgressUpdate, 128),
+		TrailingLogs:  DefaultTrailingLogs,
+		ArchiveFormat: ArchiveRename,
+		Logger:        log.New(ioutil.Discard, "", log.LstdFlags),
+		abortCh:       make(chan struct{}),
+		fs:            osFileSystem{},
+	}
+	m.reset()
+	return m
+}
+
 // mdbConnect is used to open a handle on our LMDB raft backend. This
 // is enough to read all of the Consul data we need to migrate.
 func (m *Migrator) mdbConnect(dir string) error {
-	// Calculate and set the max size
-	size := maxLogSize32bit
-	if runtime.GOARCH == "amd64" {
-		size = maxLogSize64bit
+	// Size the map to fit the data
+	size, err := mdbMapSize(filepath.Join(dir, mdbDir), m.MapSize)
+	if err != nil {
+		return err
 	}
+	m.mapSize = size
+	m.Logger.Printf("[DEBUG] migrator: Using LMDB map size of %d bytes", size)
 
 	// Open the connection
 	mdb, err := raftmdb.NewMDBStoreWithSize(dir, size)
 	if err != nil {
 		return err
 	}
+	m.Logger.Printf("[INFO] migrator: Opened LMDB store in '%s'", dir)
 
 	// Return the new environment
 	m.mdbStore = mdb
@@ -118,32 +287,92 @@ func (m *Migrator) boltConnect(file string) error {
 	if err != nil {
 		return err
 	}
+	m.Logger.Printf("[INFO] migrator: Opened BoltDB store at '%s'", file)
 
 	m.boltStore = store
 	return nil
 }
 
+// bulkConnect creates the BoltDB file to copy our data into, opened
+// for a fast bulk load. It must be finished with syncBoltStore.
+func (m *Migrator) bulkConnect(file string) error {
+	store, err := newBulkBoltStore(file)
+	if err != nil {
+		return err
+	}
+	m.Logger.Printf("[INFO] migrator: Opened BoltDB store at '%s' for bulk loading", file)
+
+	m.bulkStore = store
+	return nil
+}
+
+// syncBoltStore makes the bulk loaded BoltDB file durable with a single
+// sync, and then reopens it as a normal BoltStore to make sure it is
+// readable and holds all of the logs.
+func (m *Migrator) syncBoltStore(file string) error {
+	last, err := m.bulkStore.LastIndex()
+	if err != nil {
+		return err
+	}
+	syncStart := time.Now()
+	if err := m.bulkStore.Sync(); err != nil {
+		return err
+	}
+	m.metricTiming("bolt.sync", time.Now().Sub(syncStart))
+	if err := m.markBoltSynced(); err != nil {
+		return err
+	}
+	err = m.bulkStore.Close()
+	m.bulkStore = nil
+	if err != nil {
+		return err
+	}
+	m.Logger.Printf("[DEBUG] migrator: Synced BoltDB store in %s", time.Now().Sub(syncStart))
+
+	if err := m.boltConnect(file); err != nil {
+		return err
+	}
+	reopened, err := m.boltStore.LastIndex()
+	if err != nil {
+		return err
+	}
+	if reopened != last {
+		return fmt.Errorf("Last index is %d after reopening, expected %d", reopened, last)
+	}
+	return nil
+}
+
 // migrateStableStore copies values out of the origin StableStore
 // and writes them into the destination. There are only a handful
 // of keys we need, so we copy them explicitly.
 func (m *Migrator) migrateStableStore() error {
-	op := "Migrating stable store"
-	m.sendProgress(op, 0, 1)
-
 	total := len(stableStoreKeys)
+	m.sendProgress(PhaseStableStore, 0, total)
+
 	for i, key := range stableStoreKeys {
-		val, err := m.mdbStore.Get(key)
+		val, err := m.src.Get(key)
 		if err != nil {
-			if err.Error() != "not found" {
+			if !isNotFound(err) {
 				return fmt.Errorf("Error getting key '%s': %s", string(key), err)
 			}
-			m.sendProgress(op, i+1, total)
+			m.warn(fmt.Sprintf("Stable store key '%s' not found, skipping", key))
+			m.sendProgress(PhaseStableStore, i+1, total)
+			continue
+		}
+		if val == nil {
+			m.warn(fmt.Sprintf("Stable store key '%s' not found, skipping", key))
+			m.sendProgress(PhaseStableStore, i+1, total)
 			continue
 		}
-		if err := m.boltStore.Set(key, val); err != nil {
+		m.validateStable(key, val)
+		val = m.rewriteStable(key, val)
+		if err := m.dst.Set(key, val); err != nil {
 			return fmt.Errorf("Error storing key '%s': %s", string(key), err)
 		}
-		m.sendProgress(op, i+1, total)
+		m.report.StableKeysCopied++
+		m.stableHashes[string(key)] = hashValue(val)
+		m.addBytes(len(key) + len(val))
+		m.sendProgress(PhaseStableStore, i+1, total)
 	}
 	return nil
 }
@@ -151,10 +380,7 @@ func (m *Migrator) migrateStableStore() error {
 // migrateLogStore is like migrateStableStore, but iterates over
 // all of our Raft logs and copies them into the new BoltStore.
 func (m *Migrator) migrateLogStore() error {
-	op := "Migrating log store"
-	m.sendProgress(op, 0, 1)
-
-	first, err := m.mdbStore.FirstIndex()
+	first, err := m.src.FirstIndex()
 	if err != nil {
 		return err
 	}
@@ -162,56 +388,194 @@ func (m *Migrator) migrateLogStore() error {
 		return errFirstIndexZero
 	}
 
-	last, err := m.mdbStore.LastIndex()
+	last, err := m.src.LastIndex()
 	if err != nil {
 		return err
 	}
 	if last == 0 {
 		return errLastIndexZero
 	}
-	total := int(last - first)
+	m.report.FirstIndex = first
+	m.report.LastIndex = last
+	m.Logger.Printf("[INFO] migrator: Source log store has indexes %d to %d", first, last)
 
-	current := 0
-	for i := first; i <= last; i++ {
+	start, err := m.compactStart(first, last)
+	if err != nil {
+		return err
+	}
+	total := int(last - start + 1)
+	m.sendProgress(PhaseLogStore, 0, total)
+
+	// Pick up where an earlier run left off if possible
+	next := start
+	if m.resuming {
+		if next, err = m.resumeLogStore(start, last); err != nil {
+			return err
+		}
+		if m.invalid() {
+			return errInvalid
+		}
+	}
+
+	current := int(next - start)
+	batch := make([]*raft.Log, 0, logBatchSize)
+	for i := next; i <= last; i++ {
+		if m.aborted() {
+			return errAborted
+		}
 		log := &raft.Log{}
-		if err := m.mdbStore.GetLog(i, log); err != nil {
+		if err := m.src.GetLog(i, log); err != nil {
+			// A salvaged log leaves a gap in the indexes, which is also
+			// reported by validateLog once it sees the next log
+			if !m.Salvage {
+				if err == raft.ErrLogNotFound {
+					return fmt.Errorf("Log %d is missing, leaving a gap in the logs", i)
+				}
+				return fmt.Errorf("Error reading log %d: %s", i, err)
+			}
+			m.quarantine(i, err)
+			current++
+			m.sendProgress(PhaseLogStore, current, total)
+			continue
+		}
+		m.validateLog(i, log)
+		if m.invalid() {
+			return errInvalid
+		}
+		if err := m.rewriteLog(log); err != nil {
+			return err
+		}
+		keep, err := m.transformLog(log)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			current++
+			m.sendProgress(PhaseLogStore, current, total)
+			continue
+		}
+		batch = append(batch, log)
+		if len(batch) < logBatchSize {
+			continue
+		}
+		if err := m.storeLogs(batch); err != nil {
 			return err
 		}
-		if err := m.boltStore.StoreLog(log); err != nil {
+		current += len(batch)
+		m.sendProgress(PhaseLogStore, current, total)
+		batch = batch[:0]
+	}
+	if len(batch) > 0 {
+		if err := m.storeLogs(batch); err != nil {
 			return err
 		}
-		current++
-		m.sendProgress(op, current, total)
+		current += len(batch)
+		m.sendProgress(PhaseLogStore, current, total)
+	}
+	if m.report.LogsCopied == 0 && m.transformDropped() > 0 {
+		return fmt.Errorf("Log transforms dropped all of the %d logs", total)
+	}
+	if m.report.LogsCopied == 0 {
+		return fmt.Errorf("None of the %d logs could be read", total)
 	}
 	return nil
 }
 
+// storeLogs writes a batch of logs to the destination in one commit.
+func (m *Migrator) storeLogs(batch []*raft.Log) error {
+	commitStart := time.Now()
+	if err := m.dst.StoreLogs(batch); err != nil {
+		return err
+	}
+	m.metricTiming("log-store.commit", time.Now().Sub(commitStart))
+
+	for _, log := range batch {
+		m.logHasher.add(log)
+		m.report.LogsCopied++
+		m.addBytes(len(log.Data))
+	}
+	return nil
+}
+
+// compactStart determines the first index to copy from the log store.
+// Without compaction this is simply the first index. When compaction
+// is enabled, logs which are older than the latest snapshot index less
+// the trailing logs are skipped, since Raft would never need them. At
+// least the last log is always kept so the store is never empty.
+func (m *Migrator) compactStart(first, last uint64) (uint64, error) {
+	if !m.Compact {
+		return first, nil
+	}
+
+	snap, err := latestSnapshot(m.snapshotPath)
+	if err != nil {
+		return 0, fmt.Errorf("Error reading snapshots: %s", err)
+	}
+	if snap == nil {
+		m.Logger.Printf("[DEBUG] migrator: No snapshots found, nothing to compact")
+		return first, nil
+	}
+	if snap.Index <= m.TrailingLogs {
+		m.Logger.Printf("[DEBUG] migrator: Snapshot '%s' at index %d is within the trailing logs, nothing to compact",
+			snap.ID, snap.Index)
+		return first, nil
+	}
+
+	start := snap.Index - m.TrailingLogs
+	if start <= first {
+		return first, nil
+	}
+	if start > last {
+		start = last
+	}
+
+	m.report.LogsDropped = int(start - first)
+	m.report.DropReason = fmt.Sprintf(
+		"logs below index %d are covered by snapshot '%s' at index %d "+
+			"(keeping %d trailing logs)",
+		start, snap.ID, snap.Index, m.TrailingLogs)
+	m.Logger.Printf("[INFO] migrator: Dropping %d logs: %s", m.report.LogsDropped, m.report.DropReason)
+	return start, nil
+}
+
 // activateBoltStore wraps moving the Bolt file into place after
 // a data migration has finished successfully.
 func (m *Migrator) activateBoltStore() error {
-	op := "Moving Bolt file into place"
-	m.sendProgress(op, 0, 1)
+	m.sendProgress(PhaseActivate, 0, 1)
 
-	if err := os.Rename(m.boltTempPath, m.boltPath); err != nil {
+	if err := m.fs.Rename(m.boltTempPath, m.boltPath); err != nil {
 		return err
 	}
+	m.Logger.Printf("[INFO] migrator: Moved '%s' to '%s'", m.boltTempPath, m.boltPath)
 
-	m.sendProgress(op, 1, 1)
+	m.sendProgress(PhaseActivate, 1, 1)
 	return nil
 }
 
 // archiveMDBStore is used to move the LMDB data directory to a backup
-// location so that it is not used by Consul again.
+// location so that it is not used by Consul again. Depending on the
+// ArchiveFormat, the data is either renamed or compressed.
 func (m *Migrator) archiveMDBStore() error {
-	op := "Archiving LMDB data"
-	m.sendProgress(op, 0, 1)
+	m.sendProgress(PhaseArchive, 0, 1)
 
-	if err := os.Rename(m.mdbPath, m.mdbBackupPath); err != nil {
-		os.Remove(m.boltPath)
+	var err error
+	switch m.ArchiveFormat {
+	case ArchiveGzip:
+		err = m.compressMDBStore()
+	default:
+		err = m.fs.Rename(m.mdbPath, m.mdbBackupPath)
+		m.report.ArchivePath = m.mdbBackupPath
+	}
+	if err != nil {
+		m.Logger.Printf("[DEBUG] migrator: Removing '%s' since the LMDB data was not archived", m.boltPath)
+		if rerr := m.fs.Remove(m.boltPath); rerr != nil {
+			return fmt.Errorf("%s (and '%s' could not be removed: %s)", err, m.boltPath, rerr)
+		}
 		return err
 	}
+	m.Logger.Printf("[INFO] migrator: Archived LMDB data to '%s'", m.report.ArchivePath)
 
-	m.sendProgress(op, 1, 1)
+	m.sendProgress(PhaseArchive, 1, 1)
 	return nil
 }
 
@@ -222,64 +586,413 @@ func (m *Migrator) archiveMDBStore() error {
 // still be intact. Returns a bool indicating whether a migration
 // was completed, and any error.
 func (m *Migrator) Migrate() (bool, error) {
+	return m.run(nil)
+}
+
+// storeWrapper replaces the stores opened by a migration before any
+// data is copied between them.
+type storeWrapper func(src, dst Backend) (Backend, Backend)
+
+// run performs a migration for Migrate. The stores it opens are passed
+// through wrap if it is not nil.
+func (m *Migrator) run(wrap storeWrapper) (bool, error) {
+	// Reset the state from any previous attempt
+	m.reset()
+
+	m.Logger.Printf("[INFO] migrator: Starting migration of '%s'", m.dataDir)
+	m.metricGauge("migrating", 1)
+	migrated, err := m.migrate(wrap)
+
+	// Record what was done now that the stores are closed, and check
+	// the new store against it. The data has already been migrated, so
+	// this can't fail the migration, but post hooks only run once the
+	// migration has been verified.
+	if migrated && err == nil {
+		if err := m.writeManifest(); err != nil {
+			m.warn(fmt.Sprintf("Failed to write migration manifest: %s", err))
+		}
+		m.verifyMigration()
+		if m.verifyErr != nil {
+			m.warn(fmt.Sprintf("Failed to verify migration: %s", m.verifyErr))
+		} else if err := m.runHooks(HookPost, nil); err != nil {
+			m.warn(err.Error())
+		}
+	}
+	if err != nil {
+		if herr := m.runHooks(HookFailure, err); herr != nil {
+			m.warn(herr.Error())
+		}
+	}
+	m.finish(migrated, err)
+	return migrated, err
+}
+
+// verifyMigration checks the migrated data against the manifest,
+// recording the result for startup and the hooks.
+func (m *Migrator) verifyMigration() {
+	if m.report.ManifestPath == "" {
+		m.verifyErr = fmt.Errorf("no manifest was written")
+		return
+	}
+	verify, err := VerifyManifestWithKey(m.report.ManifestPath, m.EncryptionKey)
+	if err != nil {
+		m.verifyErr = err
+		return
+	}
+	if !verify.OK() {
+		m.verifyErr = fmt.Errorf("%d problems found, including: %s",
+			len(verify.Problems), verify.Problems[0])
+		return
+	}
+	m.verify = verify
+	m.Logger.Printf("[INFO] migrator: Verified %d log ranges in '%s'", verify.LogRanges, m.boltPath)
+}
+
+// migrate performs the steps of a migration for Migrate.
+func (m *Migrator) migrate(wrap storeWrapper) (bool, error) {
 	// Check if we should attempt a migration
 	if _, err := os.Stat(m.mdbPath); os.IsNotExist(err) {
+		m.Logger.Printf("[INFO] migrator: No LMDB data found at '%s', nothing to do", m.mdbPath)
 		return false, nil
 	}
 
+	// Check the archive settings before doing any work
+	if !validArchiveFormat(m.ArchiveFormat) {
+		return false, newError(ErrClassConfig, nil, "Unsupported archive format '%s'", m.ArchiveFormat)
+	}
+	if m.EncryptionKey != nil && m.ArchiveFormat != ArchiveGzip {
+		return false, newError(ErrClassConfig, nil, "Encrypting the LMDB data requires the '%s' archive format",
+			ArchiveGzip)
+	}
+	if !validValidation(m.Validation) {
+		return false, newError(ErrClassConfig, nil, "Unsupported validation mode '%s'", m.Validation)
+	}
+	if err := validAddressMap(m.AddressMap); err != nil {
+		return false, newError(ErrClassConfig, err, "Invalid address map")
+	}
+	if err := validTransforms(m.Transforms); err != nil {
+		return false, newError(ErrClassConfig, err, "Invalid log transforms")
+	}
+
+	// Give the pre hooks a chance to abort before touching any store
+	if err := m.runHooks(HookPre, nil); err != nil {
+		return false, newError(ErrClassHook, err, "Aborted by pre-migration hook")
+	}
+	if m.aborted() {
+		return false, newError(ErrClassAborted, errAborted, "Migration was not completed")
+	}
+
+	// Read from a copy of the LMDB data if requested
+	srcPath := m.raftPath
+	m.mdbSource = m.mdbPath
+	if m.CopySource {
+		scratch, err := m.copySource()
+		if scratch != "" {
+			defer os.RemoveAll(scratch)
+		}
+		if err != nil {
+			return false, newError(ErrClassSource, err, "Failed to copy LMDB environment")
+		}
+		srcPath = scratch
+		m.mdbSource = filepath.Join(scratch, mdbDir)
+
+		// The copy can't be interrupted, so check once it is done
+		if m.aborted() {
+			return false, newError(ErrClassAborted, errAborted, "Migration was not completed")
+		}
+	}
+
 	// Connect the stores
-	if err := m.mdbConnect(m.raftPath); err != nil {
-		return false, fmt.Errorf("Failed to connect MDB: %s", err)
+	if err := m.mdbConnect(srcPath); err != nil {
+		return false, newError(ErrClassSource, err, "Failed to connect MDB")
+	}
+	defer func() {
+		if m.mdbStore != nil {
+			m.mdbStore.Close()
+		}
+	}()
+
+	// Check for a temp file left by an earlier run
+	if err := m.checkPartialBolt(); err != nil {
+		return false, newError(ErrClassDestination, err, "Failed to check partial BoltDB file")
 	}
-	defer m.mdbStore.Close()
 
-	if err := m.boltConnect(m.boltTempPath); err != nil {
-		return false, fmt.Errorf("Failed to connect BoltDB: %s", err)
+	if err := m.bulkConnect(m.boltTempPath); err != nil {
+		return false, newError(ErrClassDestination, err, "Failed to connect BoltDB")
 	}
-	defer m.boltStore.Close()
+	defer func() {
+		if m.bulkStore != nil {
+			m.bulkStore.Close()
+			m.bulkStore = nil
+		}
+		if m.boltStore != nil {
+			m.boltStore.Close()
+			m.boltStore = nil
+		}
+	}()
 
 	// Ensure we clean up the temp file during failure cases
-	defer os.Remove(m.boltTempPath)
+	defer func() {
+		if err := os.Remove(m.boltTempPath); err == nil {
+			m.Logger.Printf("[DEBUG] migrator: Removed temporary BoltDB file '%s'", m.boltTempPath)
+		}
+		os.Remove(m.boltSynced)
+	}()
 
-	// Migrate the stable store
-	if err := m.migrateStableStore(); err != nil {
-		return false, fmt.Errorf("Failed to migrate stable store: %v", err)
+	// Copy all of the data
+	m.src, m.dst = m.mdbStore, m.bulkStore
+	if wrap != nil {
+		m.src, m.dst = wrap(m.src, m.dst)
+	}
+	if err := m.copyStores(); err != nil {
+		return false, err
 	}
 
-	// Migrate the log store
-	if err := m.migrateLogStore(); err != nil {
-		return false, fmt.Errorf("Failed to migrate log store: %v", err)
+	// Save any logs which could not be read
+	if len(m.report.Quarantined) > 0 {
+		if err := m.quarantineMDBLogs(); err != nil {
+			return false, newError(ErrClassLogStore, err, "Failed to write quarantine file")
+		}
+	}
+
+	// Make sure the original LMDB data was not modified
+	if m.CopySource {
+		if err := m.verifySource(); err != nil {
+			return false, newError(ErrClassSource, err, "LMDB data was modified during the migration")
+		}
+	}
+
+	if m.aborted() {
+		return false, newError(ErrClassAborted, errAborted, "Migration was not completed")
+	}
+
+	// Prepare the rewritten peers, to be moved into place at the end.
+	// The new store is in use by then, so if they can't be moved they
+	// are kept to be moved by hand.
+	peerFiles, err := m.preparePeerFiles()
+	if err != nil {
+		return false, newError(ErrClassRewrite, err, "Failed to rewrite peers")
 	}
+	keepPeers := false
+	defer func() {
+		if !keepPeers {
+			for _, f := range peerFiles {
+				os.Remove(f.tempPath)
+			}
+		}
+	}()
+
+	// Make the new BoltDB file durable
+	if err := m.syncBoltStore(m.boltTempPath); err != nil {
+		return false, newError(ErrClassDestination, err, "Failed to sync BoltDB")
+	}
+
+	// The sync can't be interrupted either, and this is the last chance
+	// to give up before changing the data-dir
+	if m.aborted() {
+		return false, newError(ErrClassAborted, errAborted, "Migration was not completed")
+	}
+
+	// Record the copied data, so that Startup can verify the new store
+	// if the migration stops before the LMDB data is archived. It is
+	// removed if the migration fails before then.
+	if err := m.writePendingManifest(); err != nil {
+		m.warn(fmt.Sprintf("Failed to write migration manifest: %s", err))
+	}
+	archived := false
+	defer func() {
+		if !archived {
+			os.Remove(m.manifestPath())
+		}
+	}()
 
 	// Activate the new BoltDB file
 	if err := m.activateBoltStore(); err != nil {
-		return false, fmt.Errorf("Failed to activate Bolt store: %s", err)
+		return false, newError(ErrClassActivate, err, "Failed to activate Bolt store")
 	}
 
 	// Move the old MDB dir to its backup location
 	if err := m.archiveMDBStore(); err != nil {
-		return false, fmt.Errorf("Failed to archive LMDB data: %s", err)
+		return false, newError(ErrClassArchive, err, "Failed to archive LMDB data")
+	}
+	archived = true
+
+	// Move the rewritten peers into place
+	if err := m.activatePeerFiles(peerFiles); err != nil {
+		keepPeers = true
+		return false, newError(ErrClassActivate, err, "Failed to move the rewritten peers into place")
 	}
 
 	return true, nil
 }
 
-// sendProgress is used to send a progress update message to the progress
-// channel. Sending is a non-blocking operation. It is the responsibility
-// of the caller to ensure they drain the queue promptly to avoid missing
-// progress update messages.
-func (m *Migrator) sendProgress(op string, done, total int) {
-	update := ProgressUpdate{op, (float64(done) / float64(total)) * 100}
+// Copy copies all of the Raft data from the src backend into the dst
+// backend. Unlike Migrate, it does not touch any files on its own; the
+// caller is responsible for opening and closing both backends.
+func (m *Migrator) Copy(src, dst Backend) error {
+	m.reset()
+	m.src, m.dst = src, dst
+	m.metricGauge("migrating", 1)
+
+	var err error
+	if !validValidation(m.Validation) {
+		err = newError(ErrClassConfig, nil, "Unsupported validation mode '%s'", m.Validation)
+	} else if aerr := validAddressMap(m.AddressMap); aerr != nil {
+		err = newError(ErrClassConfig, aerr, "Invalid address map")
+	} else if terr := validTransforms(m.Transforms); terr != nil {
+		err = newError(ErrClassConfig, terr, "Invalid log transforms")
+	} else if !m.Overwrite {
+		err = m.checkEmpty(dst)
+	}
+	if err == nil {
+		err = m.copyStores()
+	}
+	if err == nil && len(m.report.Quarantined) > 0 && m.QuarantinePath != "" {
+		if qerr := m.writeQuarantine(nil); qerr != nil {
+			err = newError(ErrClassLogStore, qerr, "Failed to write quarantine file")
+		}
+	}
+	m.finish(err == nil, err)
+	return err
+}
+
+// checkEmpty makes sure the destination of a copy holds no logs or
+// stable store keys.
+func (m *Migrator) checkEmpty(dst Backend) error {
+	last, err := dst.LastIndex()
+	if err != nil {
+		return newError(ErrClassLogStore, err, "Failed to read the destination log store")
+	}
+	if last != 0 {
+		return newError(ErrClassConfig, nil, "Destination already holds logs up to index %d", last)
+	}
+	for _, key := range stableStoreKeys {
+		val, err := dst.Get(key)
+		if err != nil && !isNotFound(err) {
+			return newError(ErrClassStableStore, err, "Failed to read the destination stable store")
+		}
+		if err == nil && val != nil {
+			return newError(ErrClassConfig, nil, "Destination already holds stable store key '%s'", key)
+		}
+	}
+	return nil
+}
+
+// copyStores copies the stable store and the log store from the
+// source to the destination.
+func (m *Migrator) copyStores() error {
+	// Migrate the stable store
+	if err := m.migrateStableStore(); err != nil {
+		return newError(ErrClassStableStore, err, "Failed to migrate stable store")
+	}
+
+	// Migrate the log store
+	if err := m.migrateLogStore(); err != nil {
+		if err == errInvalid {
+			return m.invalidError()
+		}
+		if ErrorClassOf(err) == ErrClassTransform {
+			return err
+		}
+		return newError(ErrClassLogStore, err, "Failed to migrate log store")
+	}
+
+	// Check the stable store against the logs
+	m.validateState()
+	if m.invalid() {
+		return m.invalidError()
+	}
+	return nil
+}
+
+// abort stops a migration which is copying data. It is cleaned up
+// as if it had failed.
+func (m *Migrator) abort() {
+	m.abortOnce.Do(func() {
+		close(m.abortCh)
+	})
+}
+
+// aborted returns whether the migration was aborted.
+func (m *Migrator) aborted() bool {
 	select {
-	case m.ProgressCh <- &update:
+	case <-m.abortCh:
+		return true
 	default:
+		return false
+	}
+}
+
+// reset clears the state left over from any previous run. Since the
+// progress channel is closed at the end of each run, a fresh one is
+// created if needed.
+func (m *Migrator) reset() {
+	m.report = &Report{PhaseDurations: make(map[Phase]time.Duration)}
+	m.start = time.Now()
+	m.lastMetrics = time.Time{}
+	m.phase = ""
+	m.phaseBytes = 0
+	m.stableHashes = make(map[string]string)
+	m.logHasher = newLogHasher(manifestRangeSize)
+	m.validator = newValidator()
+	m.verify, m.verifyErr = nil, nil
+	if m.progressClosed {
+		m.ProgressCh = make(chan *ProgressUpdate, cap(m.ProgressCh))
+		m.progressClosed = false
 	}
 }
 
-// ProgressUpdate is used to communicate internal progress data about
-// an in-flight migration. The Op is the current operation, and the
-// Progress indicates a percentage of migrations completed.
-type ProgressUpdate struct {
-	Op       string
-	Progress float64
+// Report returns the summary of the most recent migration attempt.
+func (m *Migrator) Report() *Report {
+	return m.report
+}
+
+// Report summarizes what happened during a migration. Duration covers
+// the whole run, and PhaseDurations each completed phase.
+type Report struct {
+	// FirstIndex and LastIndex are the range of the source log store
+	FirstIndex       uint64
+	LastIndex        uint64
+	LogsCopied       int
+	StableKeysCopied int
+	BytesCopied      int64
+	Duration         time.Duration
+	PhaseDurations   map[Phase]time.Duration
+
+	// LogsDropped counts the logs skipped by compaction because they
+	// are covered by a snapshot, and DropReason explains why
+	LogsDropped int
+	DropReason  string
+
+	// Where the LMDB data was archived to, and the checksum of the
+	// archive and ID of its encryption key if compressed
+	ArchivePath     string
+	ArchiveChecksum string
+	ArchiveKeyID    string
+
+	// SourceChecksum is the hash of data.mdb when migrating from a copy
+	SourceChecksum string
+
+	// LogsResumed counts the logs kept from a partial BoltDB file, which
+	// are included in LogsCopied, or PartialDiscardReason explains why
+	// the file was discarded instead
+	LogsResumed          int
+	PartialDiscardReason string
+
+	// Logs which could not be read when salvaging, and where they were
+	// written
+	Quarantined    []*QuarantinedLog
+	QuarantinePath string
+
+	// The first Raft invariant violations found, out of ViolationCount
+	Violations     []*Violation
+	ViolationCount int
+
+	// Addresses changed using the AddressMap, and the logs touched by
+	// each of the log transforms
+	Rewrites   []*Rewrite
+	Transforms []*TransformReport
+
+	// ManifestPath is set once the migration manifest is written
+	ManifestPath string
 }
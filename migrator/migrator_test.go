@@ -2,8 +2,10 @@ package migrator
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -11,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul-migrate/fixture"
 	"github.com/hashicorp/raft"
 )
 
@@ -220,6 +223,68 @@ func TestMigrator_migrate(t *testing.T) {
 	}
 }
 
+func TestMigrator_migrate_compact(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	// Create the migrator
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.Compact = true
+	m.TrailingLogs = 1
+
+	// Find the index range of the fixture data
+	if err := m.mdbConnect(m.raftPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	first, err := m.mdbStore.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	last, err := m.mdbStore.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.mdbStore.Close()
+
+	// Write a snapshot covering all of the logs
+	meta := fmt.Sprintf(`{"ID":"1-%d-1","Index":%d,"Term":1}`, last, last)
+	testSnapshot(t, m.snapshotPath, "snap", meta)
+
+	// Perform the migration
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Check the report
+	report := m.Report()
+	if report.LogsDropped != int(last-1-first) {
+		t.Fatalf("bad: %#v", report)
+	}
+	if report.LogsCopied != 2 {
+		t.Fatalf("bad: %#v", report)
+	}
+	if report.DropReason == "" {
+		t.Fatalf("missing drop reason")
+	}
+
+	// Only the trailing logs should be in the BoltStore
+	if err := m.boltConnect(m.boltPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.boltStore.Close()
+
+	bFirst, err := m.boltStore.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if bFirst != last-1 {
+		t.Fatalf("bad: %d", bFirst)
+	}
+}
+
 func TestMigrator_migrate_fails(t *testing.T) {
 	// Create a new temp dir. We will attempt to use this
 	// as the Raft dir to create errors.
@@ -266,6 +331,35 @@ func TestMigrator_migrate_fails(t *testing.T) {
 	}
 }
 
+func TestMigrator_logger(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var buf bytes.Buffer
+	m.Logger = log.New(&buf, "", 0)
+
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Check for a few of the important steps
+	logs := buf.String()
+	for _, expect := range []string{
+		"[DEBUG] migrator: Using LMDB map size",
+		"[INFO] migrator: Opened LMDB store",
+		"[INFO] migrator: Source log store has indexes",
+		"[INFO] migrator: Archived LMDB data",
+	} {
+		if !strings.Contains(logs, expect) {
+			t.Fatalf("missing %q in logs: %s", expect, logs)
+		}
+	}
+}
+
 func TestMigrator_migrate_noop(t *testing.T) {
 	dir, err := ioutil.TempDir("", "consul-migrate")
 	if err != nil {
@@ -287,6 +381,28 @@ func TestMigrator_migrate_noop(t *testing.T) {
 	}
 }
 
+func TestMigrator_Copy_notEmpty(t *testing.T) {
+	// A destination holding logs or stable keys is refused
+	dsts := []*inmemStore{
+		testValidateStore(t, []uint64{1}, nil),
+		testValidateStore(t, nil, map[string][]byte{"LastVoteCand": []byte("127.0.0.1:8300")}),
+	}
+	for i, dst := range dsts {
+		m := NewCopier()
+		err := m.Copy(testValidateStore(t, []uint64{1, 2}, validStable()), dst)
+		if ErrorClassOf(err) != ErrClassConfig || !strings.Contains(err.Error(), "already holds") {
+			t.Fatalf("%d: bad: %v", i, err)
+		}
+
+		// Unless overwriting is allowed
+		m = NewCopier()
+		m.Overwrite = true
+		if err := m.Copy(testValidateStore(t, []uint64{1, 2}, validStable()), dst); err != nil {
+			t.Fatalf("%d: err: %s", i, err)
+		}
+	}
+}
+
 func TestMigrator_sendProgress(t *testing.T) {
 	dir, err := ioutil.TempDir("", "consul-migrate")
 	if err != nil {
@@ -378,3 +494,198 @@ func TestMigrator_progressUpdate_nonblocking(t *testing.T) {
 		t.Fatalf("missing progress update")
 	}
 }
+
+// testFixtureDir creates a Consul data-dir holding an LMDB store
+// generated from the given fixture configuration.
+func testFixtureDir(t testing.TB, conf *fixture.Config) (string, *fixture.Result) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	res, err := fixture.Generate(filepath.Join(dir, raftDir), conf)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("err: %s", err)
+	}
+	return dir, res
+}
+
+func TestMigrator_migrate_fixtures(t *testing.T) {
+	cases := []struct {
+		name       string
+		conf       func(*fixture.Config)
+		salvage    bool
+		err        string
+		stableKeys int
+	}{
+		{
+			name:       "default",
+			conf:       func(c *fixture.Config) {},
+			stableKeys: 3,
+		},
+		{
+			name: "compacted",
+			conf: func(c *fixture.Config) {
+				c.FirstIndex = 5000
+				c.Logs = 2000
+			},
+			stableKeys: 3,
+		},
+		{
+			name: "several batches",
+			conf: func(c *fixture.Config) {
+				c.Logs = 3*logBatchSize + 7
+			},
+			stableKeys: 3,
+		},
+		{
+			name: "large entries",
+			conf: func(c *fixture.Config) {
+				c.Logs = 10
+				c.MinSize = 1024 * 1024
+				c.MaxSize = 4 * 1024 * 1024
+			},
+			stableKeys: 3,
+		},
+		{
+			name: "empty entries",
+			conf: func(c *fixture.Config) {
+				c.MinSize, c.MaxSize = 0, 0
+			},
+			stableKeys: 3,
+		},
+		{
+			name: "every log type",
+			conf: func(c *fixture.Config) {
+				c.Types = map[raft.LogType]int{
+					raft.LogCommand:    1,
+					raft.LogNoop:       1,
+					raft.LogAddPeer:    1,
+					raft.LogRemovePeer: 1,
+					raft.LogBarrier:    1,
+				}
+				c.TermEvery = 1
+			},
+			stableKeys: 3,
+		},
+		{
+			name: "gaps",
+			conf: func(c *fixture.Config) {
+				c.Gaps = []fixture.Gap{{Start: 50, Length: 5}}
+			},
+			err: "Error reading log 50",
+		},
+		{
+			name: "gaps salvaged",
+			conf: func(c *fixture.Config) {
+				c.Gaps = []fixture.Gap{{Start: 50, Length: 5}, {Start: 80, Length: 1}}
+			},
+			salvage:    true,
+			stableKeys: 3,
+		},
+		{
+			name: "missing stable keys",
+			conf: func(c *fixture.Config) {
+				c.Stable = nil
+				c.StableUint64 = map[string]uint64{"CurrentTerm": 1}
+			},
+			stableKeys: 1,
+		},
+		{
+			name: "unknown stable keys",
+			conf: func(c *fixture.Config) {
+				c.Stable["SomethingElse"] = []byte("ignored")
+				c.Stable["LastVoteCand"] = []byte{0, 0xff, '\n'}
+			},
+			stableKeys: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		conf := fixture.DefaultConfig()
+		tc.conf(conf)
+		dir, res := testFixtureDir(t, conf)
+		defer os.RemoveAll(dir)
+
+		m, err := New(dir)
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.name, err)
+		}
+		m.Salvage = tc.salvage
+		_, err = m.Migrate()
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("%s: bad: %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.name, err)
+		}
+
+		report := m.Report()
+		if report.FirstIndex != res.FirstIndex || report.LastIndex != res.LastIndex {
+			t.Fatalf("%s: bad: %#v", tc.name, report)
+		}
+		if report.LogsCopied != res.Logs {
+			t.Fatalf("%s: bad: %d", tc.name, report.LogsCopied)
+		}
+		if report.StableKeysCopied != tc.stableKeys {
+			t.Fatalf("%s: bad: %d", tc.name, report.StableKeysCopied)
+		}
+		if !reflect.DeepEqual(m.quarantinedIndexes(), res.Missing) {
+			t.Fatalf("%s: bad: %v", tc.name, m.quarantinedIndexes())
+		}
+
+		// The migrated store checks out against the manifest
+		verify, err := VerifyManifest(report.ManifestPath)
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.name, err)
+		}
+		if !verify.OK() {
+			t.Fatalf("%s: bad: %v", tc.name, verify.Problems)
+		}
+	}
+}
+
+// benchmarkMigrate migrates a freshly generated store on each iteration.
+func benchmarkMigrate(b *testing.B, conf *fixture.Config) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dir, res := testFixtureDir(b, conf)
+		b.SetBytes(res.Bytes)
+		m, err := New(dir)
+		if err != nil {
+			b.Fatalf("err: %s", err)
+		}
+		b.StartTimer()
+
+		if _, err := m.Migrate(); err != nil {
+			b.Fatalf("err: %s", err)
+		}
+
+		b.StopTimer()
+		os.RemoveAll(dir)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkMigrator_migrate_1k(b *testing.B) {
+	conf := fixture.DefaultConfig()
+	conf.Logs = 1000
+	benchmarkMigrate(b, conf)
+}
+
+func BenchmarkMigrator_migrate_100k(b *testing.B) {
+	conf := fixture.DefaultConfig()
+	conf.Logs = 100000
+	benchmarkMigrate(b, conf)
+}
+
+func BenchmarkMigrator_migrate_largeEntries(b *testing.B) {
+	conf := fixture.DefaultConfig()
+	conf.Logs = 100
+	conf.MinSize = 256 * 1024
+	conf.MaxSize = 1024 * 1024
+	benchmarkMigrate(b, conf)
+}
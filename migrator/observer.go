@@ -0,0 +1,114 @@
+package migrator
+
+import (
+	"sync"
+	"time"
+)
+
+// MigrationObserver receives the events of a migration. Unlike the
+// ProgressCh, no events are ever dropped. The methods are called
+// synchronously from the goroutine running the migration, so they
+// should return quickly; wrap slow observers with NewAsyncObserver.
+//
+// PhaseStarted is called before the first progress update of each
+// phase, and PhaseCompleted once the phase is done. Warning reports
+// problems which do not stop the migration. Finished is always the
+// last call, and reports the same result as Migrate or Copy.
+type MigrationObserver interface {
+	PhaseStarted(phase Phase)
+	Progress(update *ProgressUpdate)
+	PhaseCompleted(phase Phase, elapsed time.Duration)
+	Warning(msg string)
+	Finished(migrated bool, err error)
+}
+
+// AsyncObserver delivers events to another observer from a background
+// goroutine, so that a slow observer does not hold up the migration.
+// Events are queued without bound and delivered in order, so none are
+// lost. Use Wait to block until the Finished event was delivered. An
+// AsyncObserver can only be used for a single run.
+type AsyncObserver struct {
+	obs MigrationObserver
+
+	queue    []func()
+	finished bool
+	lock     sync.Mutex
+	cond     *sync.Cond
+	doneCh   chan struct{}
+}
+
+// NewAsyncObserver wraps obs to deliver events asynchronously.
+func NewAsyncObserver(obs MigrationObserver) *AsyncObserver {
+	a := &AsyncObserver{
+		obs:    obs,
+		doneCh: make(chan struct{}),
+	}
+	a.cond = sync.NewCond(&a.lock)
+	go a.run()
+	return a
+}
+
+// PhaseStarted implements the MigrationObserver interface.
+func (a *AsyncObserver) PhaseStarted(phase Phase) {
+	a.enqueue(func() { a.obs.PhaseStarted(phase) }, false)
+}
+
+// Progress implements the MigrationObserver interface.
+func (a *AsyncObserver) Progress(update *ProgressUpdate) {
+	a.enqueue(func() { a.obs.Progress(update) }, false)
+}
+
+// PhaseCompleted implements the MigrationObserver interface.
+func (a *AsyncObserver) PhaseCompleted(phase Phase, elapsed time.Duration) {
+	a.enqueue(func() { a.obs.PhaseCompleted(phase, elapsed) }, false)
+}
+
+// Warning implements the MigrationObserver interface.
+func (a *AsyncObserver) Warning(msg string) {
+	a.enqueue(func() { a.obs.Warning(msg) }, false)
+}
+
+// Finished implements the MigrationObserver interface.
+func (a *AsyncObserver) Finished(migrated bool, err error) {
+	a.enqueue(func() { a.obs.Finished(migrated, err) }, true)
+}
+
+// Wait blocks until all events up to and including Finished have been
+// delivered to the wrapped observer.
+func (a *AsyncObserver) Wait() {
+	<-a.doneCh
+}
+
+// enqueue adds an event to the queue and wakes up the delivery loop.
+func (a *AsyncObserver) enqueue(fn func(), finished bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.finished {
+		return
+	}
+	a.queue = append(a.queue, fn)
+	a.finished = finished
+	a.cond.Signal()
+}
+
+// run delivers queued events until the Finished event was delivered.
+func (a *AsyncObserver) run() {
+	for {
+		a.lock.Lock()
+		for len(a.queue) == 0 {
+			a.cond.Wait()
+		}
+		fn := a.queue[0]
+		a.queue[0] = nil
+		a.queue = a.queue[1:]
+		last := a.finished && len(a.queue) == 0
+		a.lock.Unlock()
+
+		fn()
+		if last {
+			close(a.doneCh)
+			return
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package migrator
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testObserver records every event as a string.
+type testObserver struct {
+	events []string
+	lock   sync.Mutex
+}
+
+func (o *testObserver) record(format string, args ...interface{}) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *testObserver) PhaseStarted(phase Phase) {
+	o.record("start %s", phase)
+}
+
+func (o *testObserver) Progress(update *ProgressUpdate) {
+	o.record("progress %s %d/%d", update.Phase, update.Done, update.Total)
+}
+
+func (o *testObserver) PhaseCompleted(phase Phase, elapsed time.Duration) {
+	o.record("complete %s", phase)
+}
+
+func (o *testObserver) Warning(msg string) {
+	o.record("warning %s", msg)
+}
+
+func (o *testObserver) Finished(migrated bool, err error) {
+	o.record("finished %v %v", migrated, err)
+}
+
+func TestMigrator_observer(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	obs := &testObserver{}
+	m.Observer = obs
+
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Every phase is started and completed in order, and the final
+	// event is the result
+	var phases []string
+	for _, event := range obs.events {
+		if strings.HasPrefix(event, "start ") || strings.HasPrefix(event, "complete ") {
+			phases = append(phases, event)
+		}
+	}
+	expect := []string{
+		"start Migrating stable store", "complete Migrating stable store",
+		"start Migrating log store", "complete Migrating log store",
+		"start Moving Bolt file into place", "complete Moving Bolt file into place",
+		"start Archiving LMDB data", "complete Archiving LMDB data",
+	}
+	if fmt.Sprintf("%v", phases) != fmt.Sprintf("%v", expect) {
+		t.Fatalf("bad: %v", phases)
+	}
+	if last := obs.events[len(obs.events)-1]; last != "finished true <nil>" {
+		t.Fatalf("bad: %s", last)
+	}
+
+	// The progress channel is closed once the migration is done
+	for range m.ProgressCh {
+	}
+}
+
+func TestMigrator_observer_fails(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.ArchiveFormat = "nope"
+	obs := &testObserver{}
+	m.Observer = obs
+
+	if _, err := m.Migrate(); err == nil {
+		t.Fatalf("should fail")
+	}
+	if len(obs.events) != 1 || !strings.HasPrefix(obs.events[0], "finished false") {
+		t.Fatalf("bad: %v", obs.events)
+	}
+}
+
+func TestMigrator_progressCh_reopened(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Closed after a no-op run, and replaced for the next one
+	os.RemoveAll(m.mdbPath)
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	first := m.ProgressCh
+	if _, ok := <-first; ok {
+		t.Fatalf("should be closed")
+	}
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if m.ProgressCh == first {
+		t.Fatalf("should have a new channel")
+	}
+}
+
+func TestAsyncObserver(t *testing.T) {
+	obs := &testObserver{}
+	a := NewAsyncObserver(obs)
+
+	a.PhaseStarted(PhaseLogStore)
+	for i := 1; i <= 100; i++ {
+		a.Progress(&ProgressUpdate{Phase: PhaseLogStore, Done: i, Total: 100})
+	}
+	a.Warning("careful")
+	a.PhaseCompleted(PhaseLogStore, time.Second)
+	a.Finished(true, nil)
+
+	// Events after Finished are ignored
+	a.Warning("too late")
+
+	doneCh := make(chan struct{})
+	go func() {
+		a.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for events")
+	}
+
+	if len(obs.events) != 104 {
+		t.Fatalf("bad: %d", len(obs.events))
+	}
+	if obs.events[0] != "start Migrating log store" ||
+		obs.events[100] != "progress Migrating log store 100/100" {
+		t.Fatalf("bad: %v", obs.events)
+	}
+	if obs.events[103] != "finished true <nil>" {
+		t.Fatalf("bad: %v", obs.events)
+	}
+}
@@ -0,0 +1,193 @@
+package migrator
+
+import (
+	"time"
+)
+
+// Phase identifies one of the steps of a migration.
+type Phase string
+
+const (
+	PhaseCopySource  Phase = "copy-source"
+	PhaseStableStore Phase = "stable-store"
+	PhaseLogStore    Phase = "log-store"
+	PhaseActivate    Phase = "activate"
+	PhaseArchive     Phase = "archive"
+)
+
+// phaseDescriptions are the human-readable names of the phases, which
+// are used as the Op of progress updates.
+var phaseDescriptions = map[Phase]string{
+	PhaseCopySource:  "Copying LMDB environment",
+	PhaseStableStore: "Migrating stable store",
+	PhaseLogStore:    "Migrating log store",
+	PhaseActivate:    "Moving Bolt file into place",
+	PhaseArchive:     "Archiving LMDB data",
+}
+
+// String returns the human-readable description of the phase.
+func (p Phase) String() string {
+	if desc, ok := phaseDescriptions[p]; ok {
+		return desc
+	}
+	return string(p)
+}
+
+// ProgressUpdate is used to communicate internal progress data about
+// an in-flight migration. The Op is the current operation, and the
+// Progress indicates a percentage of migrations completed.
+//
+// Done and Total count the items (keys, logs or files) of the current
+// Phase, and Bytes is the payload copied so far. Elapsed is measured
+// from the start of the phase. Rate is in items per second, ByteRate
+// in bytes per second, and ETA estimates the time remaining in the
+// phase; these are zero until enough progress was made to tell.
+type ProgressUpdate struct {
+	Op       string
+	Progress float64
+
+	Phase    Phase
+	Done     int
+	Total    int
+	Bytes    int64
+	Elapsed  time.Duration
+	Rate     float64
+	ByteRate float64
+	ETA      time.Duration
+}
+
+// addBytes records payload bytes copied in the current phase.
+func (m *Migrator) addBytes(n int) {
+	m.phaseBytes += int64(n)
+	m.report.BytesCopied += int64(n)
+}
+
+// sendProgress is used to send a progress update message to the progress
+// channel. Sending is a non-blocking operation, so updates are dropped
+// if the consumer doesn't drain the queue promptly, except for the last
+// update of each phase, which makes room by dropping the oldest queued
+// update. The Observer is also notified, including of the start of a
+// new phase and the completion of the previous one.
+func (m *Migrator) sendProgress(phase Phase, done, total int) {
+	now := time.Now()
+	if phase != m.phase {
+		m.completePhase(now)
+		m.phase = phase
+		m.phaseStart = now
+		m.phaseBytes = 0
+		if m.Observer != nil {
+			m.Observer.PhaseStarted(phase)
+		}
+	}
+
+	final := done == total
+	update := newProgressUpdate(phase, done, total, m.phaseBytes, now.Sub(m.phaseStart))
+	m.metricProgress(update, final)
+	if m.Observer != nil {
+		m.Observer.Progress(update)
+	}
+	if m.progressClosed {
+		return
+	}
+	select {
+	case m.ProgressCh <- update:
+		return
+	default:
+	}
+	if !final {
+		return
+	}
+
+	// Nothing else sends on the channel, so once an update has been
+	// taken off it, by us or the consumer, there is room for this one.
+	select {
+	case <-m.ProgressCh:
+	default:
+	}
+	select {
+	case m.ProgressCh <- update:
+	default:
+	}
+}
+
+// completePhase notifies the Observer that the current phase is done.
+func (m *Migrator) completePhase(now time.Time) {
+	if m.phase == "" {
+		return
+	}
+	elapsed := now.Sub(m.phaseStart)
+	m.report.PhaseDurations[m.phase] = elapsed
+	m.Logger.Printf("[DEBUG] migrator: Phase '%s' completed in %s", m.phase, elapsed)
+	m.metricTiming("phase."+string(m.phase)+".duration", elapsed)
+	if m.Observer != nil {
+		m.Observer.PhaseCompleted(m.phase, elapsed)
+	}
+	m.phase = ""
+}
+
+// warn logs a non-fatal problem and notifies the Observer.
+func (m *Migrator) warn(msg string) {
+	m.Logger.Printf("[WARN] migrator: %s", msg)
+	if m.Observer != nil {
+		m.Observer.Warning(msg)
+	}
+}
+
+// finish is called when a run is over. The final phase is completed
+// if the run was successful, the Observer is told about the result,
+// and the progress channel is closed so consumers know to stop.
+func (m *Migrator) finish(migrated bool, err error) {
+	now := time.Now()
+	if err == nil {
+		m.completePhase(now)
+	}
+	m.report.Duration = now.Sub(m.start)
+	switch {
+	case err != nil:
+		m.Logger.Printf("[ERR] migrator: Failed after %s: %v", m.report.Duration, err)
+		m.metricCounter("errors."+string(ErrorClassOf(err)), 1)
+	case migrated:
+		m.Logger.Printf("[INFO] migrator: Copied %d logs and %d stable store keys in %s",
+			m.report.LogsCopied, m.report.StableKeysCopied, m.report.Duration)
+		m.metricCounter("migrations", 1)
+		m.metricTiming("duration", m.report.Duration)
+	}
+	m.metricGauge("migrating", 0)
+	m.flushMetrics()
+	if m.Observer != nil {
+		m.Observer.Finished(migrated, err)
+	}
+	if !m.progressClosed {
+		close(m.ProgressCh)
+		m.progressClosed = true
+	}
+}
+
+// newProgressUpdate computes the derived fields of a progress update. An
+// empty phase is always reported as complete, rather than dividing by
+// zero.
+func newProgressUpdate(phase Phase, done, total int, bytes int64, elapsed time.Duration) *ProgressUpdate {
+	update := &ProgressUpdate{
+		Op:       phase.String(),
+		Progress: 100,
+		Phase:    phase,
+		Done:     done,
+		Total:    total,
+		Bytes:    bytes,
+		Elapsed:  elapsed,
+	}
+	if total > 0 {
+		update.Progress = (float64(done) / float64(total)) * 100
+	}
+
+	secs := elapsed.Seconds()
+	if secs <= 0 || done <= 0 {
+		return update
+	}
+	update.Rate = float64(done) / secs
+	update.ByteRate = float64(bytes) / secs
+	if remaining := total - done; remaining > 0 {
+		update.ETA = time.Duration(float64(remaining) / update.Rate * float64(time.Second))
+	}
+	return update
+}
@@ -0,0 +1,107 @@
+package migrator
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewProgressUpdate(t *testing.T) {
+	// Computes the derived fields
+	update := newProgressUpdate(PhaseLogStore, 50, 200, 1000, 10*time.Second)
+	if update.Op != "Migrating log store" || update.Phase != PhaseLogStore {
+		t.Fatalf("bad: %#v", update)
+	}
+	if update.Progress != 25 {
+		t.Fatalf("bad: %#v", update)
+	}
+	if update.Rate != 5 || update.ByteRate != 100 {
+		t.Fatalf("bad: %#v", update)
+	}
+	if update.ETA != 30*time.Second {
+		t.Fatalf("bad: %#v", update)
+	}
+
+	// A single entry store reports correctly
+	update = newProgressUpdate(PhaseLogStore, 1, 1, 10, time.Second)
+	if update.Progress != 100 || update.ETA != 0 {
+		t.Fatalf("bad: %#v", update)
+	}
+
+	// An empty phase does not divide by zero
+	update = newProgressUpdate(PhaseStableStore, 0, 0, 0, 0)
+	if update.Progress != 100 || update.Rate != 0 || update.ETA != 0 {
+		t.Fatalf("bad: %#v", update)
+	}
+
+	// Nothing is estimated before any progress was made
+	update = newProgressUpdate(PhaseLogStore, 0, 100, 0, time.Second)
+	if update.Progress != 0 || update.Rate != 0 || update.ETA != 0 {
+		t.Fatalf("bad: %#v", update)
+	}
+}
+
+func TestMigrator_progressCounts(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.ProgressCh = make(chan *ProgressUpdate, 4096)
+
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	report := m.Report()
+
+	// The final log store update covers every log, including both
+	// the first and the last index
+	var last *ProgressUpdate
+	for len(m.ProgressCh) > 0 {
+		update := <-m.ProgressCh
+		if update.Phase == PhaseLogStore {
+			last = update
+		}
+	}
+	if last == nil {
+		t.Fatalf("missing log store updates")
+	}
+	expect := int(report.LastIndex - report.FirstIndex + 1)
+	if last.Done != expect || last.Total != expect || last.Progress != 100 {
+		t.Fatalf("bad: %#v", last)
+	}
+	if report.LogsCopied != expect || report.BytesCopied == 0 {
+		t.Fatalf("bad: %#v", report)
+	}
+}
+
+func TestMigrator_progressSlowReader(t *testing.T) {
+	m := NewCopier()
+	m.ProgressCh = make(chan *ProgressUpdate, 4)
+
+	// The reader falls behind the migration
+	doneCh := make(chan *ProgressUpdate)
+	go func() {
+		var last *ProgressUpdate
+		for update := range m.ProgressCh {
+			last = update
+			time.Sleep(time.Millisecond)
+		}
+		doneCh <- last
+	}()
+
+	m.sendProgress(PhaseStableStore, 0, 2)
+	m.sendProgress(PhaseStableStore, 2, 2)
+	for i := 0; i <= 1000; i++ {
+		m.sendProgress(PhaseLogStore, i, 1000)
+	}
+	m.finish(true, nil)
+
+	// The final update is never dropped
+	last := <-doneCh
+	if last == nil || last.Phase != PhaseLogStore || last.Done != 1000 || last.Progress != 100 {
+		t.Fatalf("bad: %#v", last)
+	}
+}
@@ -0,0 +1,199 @@
+package migrator
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"github.com/armon/gomdb"
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// Table name used by the raft-mdb stable store
+	mdbConfTable = "conf"
+)
+
+var (
+	// errReadOnly is returned when writing to a store opened read-only.
+	errReadOnly = errors.New("store is opened read-only")
+)
+
+// mdbReadStore reads a raft-mdb store without opening it for writing,
+// which raft-mdb always does. The environment is opened without the
+// lock file, so nothing on disk is changed, but the store must not be
+// written to by anything else while it is open.
+type mdbReadStore struct {
+	env *mdb.Env
+}
+
+// newMDBReadStore opens the LMDB environment in dir read-only.
+func newMDBReadStore(dir string, size uint64) (*mdbReadStore, error) {
+	env, err := mdb.NewEnv()
+	if err != nil {
+		return nil, err
+	}
+	if err := env.SetMaxDBs(mdb.DBI(mdbMaxTables)); err != nil {
+		env.Close()
+		return nil, err
+	}
+	if err := env.SetMapSize(size); err != nil {
+		env.Close()
+		return nil, err
+	}
+	if err := env.Open(dir, mdb.NOTLS|mdb.RDONLY|mdb.NOLOCK, 0755); err != nil {
+		env.Close()
+		return nil, err
+	}
+	return &mdbReadStore{env: env}, nil
+}
+
+// view runs fn in a read transaction, with the named table open.
+func (s *mdbReadStore) view(table string, fn func(txn *mdb.Txn, dbi mdb.DBI) error) error {
+	txn, err := s.env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		return err
+	}
+	defer txn.Abort()
+	dbi, err := txn.DBIOpen(&table, 0)
+	if err != nil {
+		return err
+	}
+	return fn(txn, dbi)
+}
+
+// edgeIndex returns the first or last index in the log table, using
+// the given cursor operation.
+func (s *mdbReadStore) edgeIndex(op uint) (uint64, error) {
+	var index uint64
+	err := s.view(mdbLogsTable, func(txn *mdb.Txn, dbi mdb.DBI) error {
+		cursor, err := txn.CursorOpen(dbi)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		key, _, err := cursor.Get(nil, op)
+		if err == mdb.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		index = bytesToUint64(key)
+		return nil
+	})
+	return index, err
+}
+
+func (s *mdbReadStore) Close() error {
+	s.env.Close()
+	return nil
+}
+
+func (s *mdbReadStore) FirstIndex() (uint64, error) {
+	return s.edgeIndex(mdb.FIRST)
+}
+
+func (s *mdbReadStore) LastIndex() (uint64, error) {
+	return s.edgeIndex(mdb.LAST)
+}
+
+func (s *mdbReadStore) GetLog(index uint64, log *raft.Log) error {
+	var val []byte
+	err := s.view(mdbLogsTable, func(txn *mdb.Txn, dbi mdb.DBI) error {
+		v, err := txn.Get(dbi, uint64ToBytes(index))
+		if err == mdb.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		val = append([]byte(nil), v...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return raft.ErrLogNotFound
+	}
+	return codec.NewDecoder(bytes.NewReader(val), &codec.MsgpackHandle{}).Decode(log)
+}
+
+func (s *mdbReadStore) StoreLog(log *raft.Log) error {
+	return errReadOnly
+}
+
+func (s *mdbReadStore) StoreLogs(logs []*raft.Log) error {
+	return errReadOnly
+}
+
+func (s *mdbReadStore) DeleteRange(min, max uint64) error {
+	return errReadOnly
+}
+
+func (s *mdbReadStore) Set(key []byte, val []byte) error {
+	return errReadOnly
+}
+
+func (s *mdbReadStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.view(mdbConfTable, func(txn *mdb.Txn, dbi mdb.DBI) error {
+		v, err := txn.Get(dbi, key)
+		if err == mdb.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		val = append([]byte(nil), v...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, errNotFound
+	}
+	return val, nil
+}
+
+func (s *mdbReadStore) SetUint64(key []byte, val uint64) error {
+	return errReadOnly
+}
+
+func (s *mdbReadStore) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return bytesToUint64(val), nil
+}
+
+// archiveStore reads the LMDB data in a compressed archive, which is
+// extracted to a temporary directory that is removed on Close.
+type archiveStore struct {
+	*mdbReadStore
+	dir string
+}
+
+func (a *archiveStore) Close() error {
+	err := a.mdbReadStore.Close()
+	os.RemoveAll(a.dir)
+	return err
+}
+
+// newReadOnlyBoltStore opens a raft-boltdb file read-only. The bulk
+// store reads the same format, and its writes fail on a read-only file.
+func newReadOnlyBoltStore(path string) (*bulkBoltStore, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	conn, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	return &bulkBoltStore{conn: conn}, nil
+}
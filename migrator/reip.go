@@ -0,0 +1,317 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// peersFile is the file in the raft directory where Raft keeps the
+	// addresses of its peers, as a JSON list.
+	peersFile = "peers.json"
+
+	// Stable store key holding the address of the last vote candidate
+	keyLastVoteCand = "LastVoteCand"
+
+	// peersTempSuffix is added to the path of a file holding peers while
+	// the rewritten copy waits to be moved into place.
+	peersTempSuffix = ".temp"
+)
+
+// Rewrite records an address which was changed using the AddressMap.
+// Location is "LastVoteCand", "peers.json", the path of the metadata
+// of a snapshot inside the raft directory, or "log", in which case
+// Index is the index of the peer change log.
+type Rewrite struct {
+	Location string
+	Index    uint64 `json:",omitempty"`
+	Old      string
+	New      string
+}
+
+func (r *Rewrite) String() string {
+	location := r.Location
+	if r.Index != 0 {
+		location = fmt.Sprintf("%s %d", r.Location, r.Index)
+	}
+	return fmt.Sprintf("%s: %s -> %s", location, r.Old, r.New)
+}
+
+// validAddressMap checks that each entry of an address map rewrites a
+// host:port to another host:port, or a host to another host.
+func validAddressMap(addrs map[string]string) error {
+	for old, new := range addrs {
+		_, _, oldErr := net.SplitHostPort(old)
+		_, _, newErr := net.SplitHostPort(new)
+		if old == "" || new == "" || (oldErr == nil) != (newErr == nil) {
+			return fmt.Errorf("Invalid address mapping '%s' to '%s', both must be host:port or host", old, new)
+		}
+	}
+	return nil
+}
+
+// rewriteAddress maps an address using the AddressMap. An exact match
+// is used first, then a match on the host alone, keeping the port.
+// Returns false if the address is not changed.
+func (m *Migrator) rewriteAddress(addr string) (string, bool) {
+	if new, ok := m.AddressMap[addr]; ok {
+		return new, new != addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, false
+	}
+	if newHost, ok := m.AddressMap[host]; ok && newHost != host {
+		return net.JoinHostPort(newHost, port), true
+	}
+	return addr, false
+}
+
+// rewrote records a rewritten address in the report.
+func (m *Migrator) rewrote(location string, index uint64, old, new string) {
+	r := &Rewrite{Location: location, Index: index, Old: old, New: new}
+	m.report.Rewrites = append(m.report.Rewrites, r)
+	m.Logger.Printf("[INFO] migrator: Rewrote address in %s", r)
+}
+
+// rewriteStable rewrites the address in a stable store value, if it
+// holds one. Returns the value to store.
+func (m *Migrator) rewriteStable(key, val []byte) []byte {
+	if len(m.AddressMap) == 0 || string(key) != keyLastVoteCand {
+		return val
+	}
+	addr, ok := m.rewriteAddress(string(val))
+	if !ok {
+		return val
+	}
+	m.rewrote(keyLastVoteCand, 0, string(val), addr)
+	return []byte(addr)
+}
+
+// rewritePeers rewrites the addresses in a msgpack-encoded list of
+// encoded addresses, which is how Raft stores peers in peer change logs
+// and snapshots. Returns nil if nothing was changed.
+func (m *Migrator) rewritePeers(location string, index uint64, data []byte) ([]byte, error) {
+	var peers [][]byte
+	if err := codec.NewDecoder(bytes.NewReader(data), &codec.MsgpackHandle{}).Decode(&peers); err != nil {
+		return nil, fmt.Errorf("Error decoding peers: %s", err)
+	}
+
+	var changed bool
+	for i, peer := range peers {
+		addr, ok := m.rewriteAddress(string(peer))
+		if !ok {
+			continue
+		}
+		m.rewrote(location, index, string(peer), addr)
+		peers[i] = []byte(addr)
+		changed = true
+	}
+	if !changed {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, &codec.MsgpackHandle{}).Encode(peers); err != nil {
+		return nil, fmt.Errorf("Error encoding peers: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// rewriteLog rewrites the addresses in a peer change log in place.
+func (m *Migrator) rewriteLog(log *raft.Log) error {
+	if len(m.AddressMap) == 0 || (log.Type != raft.LogAddPeer && log.Type != raft.LogRemovePeer) {
+		return nil
+	}
+	data, err := m.rewritePeers("log", log.Index, log.Data)
+	if err != nil {
+		return fmt.Errorf("Error rewriting peers in log %d: %s", log.Index, err)
+	}
+	if data != nil {
+		log.Data = data
+	}
+	return nil
+}
+
+// forgetLogRewrites removes the rewrites of logs from the report, when
+// the logs they were made in are thrown away.
+func (m *Migrator) forgetLogRewrites() {
+	var kept []*Rewrite
+	for _, r := range m.report.Rewrites {
+		if r.Index == 0 {
+			kept = append(kept, r)
+		}
+	}
+	m.report.Rewrites = kept
+}
+
+// peerFile is a file holding peers which was rewritten. The new copy is
+// written to tempPath, and moved to path once the migration is complete.
+type peerFile struct {
+	path     string
+	tempPath string
+}
+
+// preparePeerFiles writes rewritten copies of the metadata of each
+// snapshot and of the peers file, next to the originals. Raft restores
+// the peers from a snapshot, so they must be rewritten as well. Returns
+// the files to move into place, in order, with the peers file last.
+func (m *Migrator) preparePeerFiles() ([]*peerFile, error) {
+	// Anything left by an earlier run is out of date
+	for _, f := range m.pendingPeerFiles() {
+		if err := m.fs.Remove(f.tempPath); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.AddressMap) == 0 {
+		return nil, nil
+	}
+	files, err := m.prepareSnapshotMetas()
+	if err == nil {
+		var path string
+		if path, err = m.preparePeersFile(); err == nil && path != "" {
+			files = append(files, &peerFile{filepath.Join(m.raftPath, peersFile), path})
+		}
+	}
+	if err != nil {
+		for _, f := range files {
+			os.Remove(f.tempPath)
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
+// prepareSnapshotMetas writes the rewritten metadata of each snapshot
+// holding a mapped address. Snapshots which are still being written or
+// have unreadable metadata are skipped, like latestSnapshot does.
+func (m *Migrator) prepareSnapshotMetas() ([]*peerFile, error) {
+	entries, err := ioutil.ReadDir(m.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*peerFile
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasSuffix(entry.Name(), snapshotTmpSuffix) {
+			continue
+		}
+		path := filepath.Join(m.snapshotPath, entry.Name(), snapshotMetaFile)
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		meta := &snapshotFileMeta{}
+		if err := json.Unmarshal(buf, meta); err != nil || len(meta.Peers) == 0 {
+			continue
+		}
+
+		location := filepath.ToSlash(filepath.Join(snapshotDir, entry.Name(), snapshotMetaFile))
+		peers, err := m.rewritePeers(location, 0, meta.Peers)
+		if err != nil {
+			return files, fmt.Errorf("Error rewriting peers in '%s': %s", path, err)
+		}
+		if peers == nil {
+			continue
+		}
+		meta.Peers = peers
+		out, err := json.Marshal(meta)
+		if err != nil {
+			return files, err
+		}
+		tempPath := path + peersTempSuffix
+		if err := m.fs.WriteFile(tempPath, append(out, '\n'), 0600); err != nil {
+			return files, err
+		}
+		files = append(files, &peerFile{path, tempPath})
+	}
+	return files, nil
+}
+
+// preparePeersFile writes the rewritten peers file next to the current
+// one. Returns the path of the new file, or an empty string if nothing
+// changed.
+func (m *Migrator) preparePeersFile() (string, error) {
+	path := filepath.Join(m.raftPath, peersFile)
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var peers []string
+	if len(bytes.TrimSpace(buf)) > 0 {
+		if err := json.Unmarshal(buf, &peers); err != nil {
+			return "", fmt.Errorf("Error decoding '%s': %s", path, err)
+		}
+	}
+	var changed bool
+	for i, peer := range peers {
+		addr, ok := m.rewriteAddress(peer)
+		if !ok {
+			continue
+		}
+		m.rewrote(peersFile, 0, peer, addr)
+		peers[i] = addr
+		changed = true
+	}
+	if !changed {
+		return "", nil
+	}
+
+	out, err := json.Marshal(peers)
+	if err != nil {
+		return "", err
+	}
+	tempPath := path + peersTempSuffix
+	if err := m.fs.WriteFile(tempPath, out, 0600); err != nil {
+		return "", err
+	}
+	return tempPath, nil
+}
+
+// pendingPeerFiles finds the rewritten peer files left by a migration
+// which stopped before moving them into place, with the peers file last.
+func (m *Migrator) pendingPeerFiles() []*peerFile {
+	var files []*peerFile
+	metas, _ := filepath.Glob(filepath.Join(m.snapshotPath, "*", snapshotMetaFile+peersTempSuffix))
+	for _, tempPath := range metas {
+		files = append(files, &peerFile{strings.TrimSuffix(tempPath, peersTempSuffix), tempPath})
+	}
+	path := filepath.Join(m.raftPath, peersFile)
+	if exists(path + peersTempSuffix) {
+		files = append(files, &peerFile{path, path + peersTempSuffix})
+	}
+	return files
+}
+
+// activatePeerFiles moves the rewritten peer files into place. If one
+// can't be moved, it and the ones after it are left at their temporary
+// paths, and the error says which must be moved by hand.
+func (m *Migrator) activatePeerFiles(files []*peerFile) error {
+	for i, f := range files {
+		if err := m.fs.Rename(f.tempPath, f.path); err != nil {
+			var left []string
+			for _, f := range files[i:] {
+				left = append(left, fmt.Sprintf("'%s' to '%s'", f.tempPath, f.path))
+			}
+			return fmt.Errorf("%s; move %s by hand before starting the agent", err, strings.Join(left, ", "))
+		}
+		m.Logger.Printf("[INFO] migrator: Rewrote peers in '%s'", f.path)
+	}
+	return nil
+}
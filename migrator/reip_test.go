@@ -0,0 +1,312 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+)
+
+// encodePeers encodes peers the way Raft does in peer change logs.
+func encodePeers(t *testing.T, peers ...string) []byte {
+	var encoded [][]byte
+	for _, peer := range peers {
+		encoded = append(encoded, []byte(peer))
+	}
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, &codec.MsgpackHandle{}).Encode(encoded); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// decodePeers decodes the peers in a peer change log.
+func decodePeers(t *testing.T, data []byte) []string {
+	var encoded [][]byte
+	if err := codec.NewDecoder(bytes.NewReader(data), &codec.MsgpackHandle{}).Decode(&encoded); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var peers []string
+	for _, peer := range encoded {
+		peers = append(peers, string(peer))
+	}
+	return peers
+}
+
+func TestMigrator_rewriteAddress(t *testing.T) {
+	m := NewCopier()
+	m.AddressMap = map[string]string{
+		"10.0.0.1:8300": "10.1.0.1:8300",
+		"10.0.0.2":      "10.1.0.2",
+		"10.0.0.3:8300": "10.0.0.3:8300",
+	}
+	cases := []struct {
+		addr    string
+		expect  string
+		changed bool
+	}{
+		{"10.0.0.1:8300", "10.1.0.1:8300", true},
+		{"10.0.0.1:8301", "10.0.0.1:8301", false},
+		{"10.0.0.2:8300", "10.1.0.2:8300", true},
+		{"10.0.0.2:9000", "10.1.0.2:9000", true},
+		{"10.0.0.3:8300", "10.0.0.3:8300", false},
+		{"10.0.0.4:8300", "10.0.0.4:8300", false},
+		{"not an address", "not an address", false},
+	}
+	for _, c := range cases {
+		addr, changed := m.rewriteAddress(c.addr)
+		if addr != c.expect || changed != c.changed {
+			t.Fatalf("%s: bad: %s %v", c.addr, addr, changed)
+		}
+	}
+}
+
+func TestValidAddressMap(t *testing.T) {
+	valid := []map[string]string{
+		nil,
+		{"10.0.0.1:8300": "10.1.0.1:8300"},
+		{"10.0.0.1": "10.1.0.1"},
+	}
+	for _, addrs := range valid {
+		if err := validAddressMap(addrs); err != nil {
+			t.Fatalf("%v: err: %s", addrs, err)
+		}
+	}
+	invalid := []map[string]string{
+		{"10.0.0.1:8300": "10.1.0.1"},
+		{"10.0.0.1": "10.1.0.1:8300"},
+		{"10.0.0.1": ""},
+		{"": "10.1.0.1"},
+	}
+	for _, addrs := range invalid {
+		if err := validAddressMap(addrs); err == nil {
+			t.Fatalf("%v: should fail", addrs)
+		}
+	}
+}
+
+func TestMigrator_rewrite_stable(t *testing.T) {
+	m := NewCopier()
+	m.AddressMap = map[string]string{"127.0.0.1": "10.1.0.1"}
+	src := testValidateStore(t, []uint64{1, 2}, validStable())
+	dst := &inmemStore{raft.NewInmemStore()}
+	if err := m.Copy(src, dst); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cand, err := dst.Get([]byte(keyLastVoteCand))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(cand) != "10.1.0.1:8300" {
+		t.Fatalf("bad: %s", cand)
+	}
+	expect := []*Rewrite{{Location: keyLastVoteCand, Old: "127.0.0.1:8300", New: "10.1.0.1:8300"}}
+	if !reflect.DeepEqual(m.Report().Rewrites, expect) {
+		t.Fatalf("bad: %v", m.Report().Rewrites)
+	}
+
+	// The original address is validated, not the rewritten one
+	if len(m.Report().Violations) != 0 {
+		t.Fatalf("bad: %v", m.Report().Violations)
+	}
+}
+
+func TestMigrator_rewrite_logs(t *testing.T) {
+	src := testValidateStore(t, []uint64{1, 1}, validStable())
+	logs := []*raft.Log{
+		{Index: 3, Term: 2, Type: raft.LogAddPeer, Data: encodePeers(t, "10.0.0.1:8300", "10.0.0.9:8300")},
+		{Index: 4, Term: 2, Type: raft.LogRemovePeer, Data: encodePeers(t, "10.0.0.9:8300")},
+		{Index: 5, Term: 2, Type: raft.LogCommand, Data: []byte("10.0.0.1:8300")},
+	}
+	if err := src.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	m := NewCopier()
+	m.AddressMap = map[string]string{"10.0.0.1:8300": "10.1.0.1:8300"}
+	dst := &inmemStore{raft.NewInmemStore()}
+	if err := m.Copy(src, dst); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	log := &raft.Log{}
+	if err := dst.GetLog(3, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if peers := decodePeers(t, log.Data); !reflect.DeepEqual(peers, []string{"10.1.0.1:8300", "10.0.0.9:8300"}) {
+		t.Fatalf("bad: %v", peers)
+	}
+
+	// Logs without the address, or which aren't peer changes, are untouched
+	for _, index := range []uint64{4, 5} {
+		if err := dst.GetLog(index, log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !bytes.Equal(log.Data, logs[index-3].Data) {
+			t.Fatalf("%d: bad: %q", index, log.Data)
+		}
+	}
+
+	expect := []*Rewrite{{Location: "log", Index: 3, Old: "10.0.0.1:8300", New: "10.1.0.1:8300"}}
+	if !reflect.DeepEqual(m.Report().Rewrites, expect) {
+		t.Fatalf("bad: %v", m.Report().Rewrites)
+	}
+}
+
+func TestMigrator_rewrite_invalid(t *testing.T) {
+	m := NewCopier()
+	m.AddressMap = map[string]string{"10.0.0.1:8300": "10.1.0.1"}
+	src := testValidateStore(t, []uint64{1}, validStable())
+	err := m.Copy(src, &inmemStore{raft.NewInmemStore()})
+	if ErrorClassOf(err) != ErrClassConfig {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+// testPeersMigrator returns a Migrator for a new data-dir holding a
+// peers file and a snapshot, both with the peers 10.0.0.1:8300 and
+// 10.0.0.2:8300.
+func testPeersMigrator(t *testing.T) (*Migrator, func()) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.MkdirAll(m.raftPath, 0700); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	peersPath := filepath.Join(m.raftPath, peersFile)
+	if err := ioutil.WriteFile(peersPath, []byte(`["10.0.0.1:8300","10.0.0.2:8300"]`), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	meta, err := json.Marshal(&snapshotFileMeta{
+		SnapshotMeta: raft.SnapshotMeta{ID: "2-10-1", Index: 10, Term: 2,
+			Peers: encodePeers(t, "10.0.0.1:8300", "10.0.0.2:8300")},
+		CRC: []byte("crc"),
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	testSnapshot(t, m.snapshotPath, "2-10-1", string(meta))
+	return m, func() { os.RemoveAll(dir) }
+}
+
+// readSnapshotMeta reads the metadata of a snapshot.
+func readSnapshotMeta(t *testing.T, m *Migrator, id string) *snapshotFileMeta {
+	buf, err := ioutil.ReadFile(filepath.Join(m.snapshotPath, id, snapshotMetaFile))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	meta := &snapshotFileMeta{}
+	if err := json.Unmarshal(buf, meta); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return meta
+}
+
+func TestMigrator_preparePeerFiles(t *testing.T) {
+	m, cleanup := testPeersMigrator(t)
+	defer cleanup()
+
+	// Addresses which aren't mapped leave the files alone
+	m.AddressMap = map[string]string{"10.0.0.3": "10.1.0.3"}
+	files, err := m.preparePeerFiles()
+	if err != nil || len(files) != 0 {
+		t.Fatalf("bad: %v %v", files, err)
+	}
+
+	m.AddressMap = map[string]string{"10.0.0.1": "10.1.0.1"}
+	files, err = m.preparePeerFiles()
+	if err != nil || len(files) != 2 {
+		t.Fatalf("bad: %v %v", files, err)
+	}
+	peersPath := filepath.Join(m.raftPath, peersFile)
+	if files[1].path != peersPath {
+		t.Fatalf("bad: %s", files[1].path)
+	}
+	for _, f := range files {
+		info, err := os.Stat(f.tempPath)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Fatalf("bad: %s", info.Mode())
+		}
+	}
+
+	// The files are only replaced once activated
+	buf, err := ioutil.ReadFile(peersPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(buf) != `["10.0.0.1:8300","10.0.0.2:8300"]` {
+		t.Fatalf("bad: %s", buf)
+	}
+	if err := m.activatePeerFiles(files); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	buf, err = ioutil.ReadFile(peersPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var peers []string
+	if err := json.Unmarshal(buf, &peers); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(peers, []string{"10.1.0.1:8300", "10.0.0.2:8300"}) {
+		t.Fatalf("bad: %v", peers)
+	}
+
+	// The snapshot keeps its other metadata
+	meta := readSnapshotMeta(t, m, "2-10-1")
+	if !reflect.DeepEqual(decodePeers(t, meta.Peers), []string{"10.1.0.1:8300", "10.0.0.2:8300"}) {
+		t.Fatalf("bad: %v", decodePeers(t, meta.Peers))
+	}
+	if meta.ID != "2-10-1" || meta.Index != 10 || meta.Term != 2 || string(meta.CRC) != "crc" {
+		t.Fatalf("bad: %#v", meta)
+	}
+
+	expect := []*Rewrite{
+		{Location: "snapshots/2-10-1/meta.json", Old: "10.0.0.1:8300", New: "10.1.0.1:8300"},
+		{Location: peersFile, Old: "10.0.0.1:8300", New: "10.1.0.1:8300"},
+	}
+	if !reflect.DeepEqual(m.Report().Rewrites, expect) {
+		t.Fatalf("bad: %v", m.Report().Rewrites)
+	}
+}
+
+func TestMigrator_activatePeerFiles_fails(t *testing.T) {
+	m, cleanup := testPeersMigrator(t)
+	defer cleanup()
+
+	m.AddressMap = map[string]string{"10.0.0.1": "10.1.0.1"}
+	files, err := m.preparePeerFiles()
+	if err != nil || len(files) != 2 {
+		t.Fatalf("bad: %v %v", files, err)
+	}
+
+	// Moving the peers file fails, and it is left to be moved by hand
+	m.fs = &faultFS{fileSystem: m.fs, faults: newFaults(map[string]int{"Rename": 2})}
+	err = m.activatePeerFiles(files)
+	if err == nil || !strings.Contains(err.Error(), files[1].tempPath) {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := os.Stat(files[1].tempPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(files[0].tempPath); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+}
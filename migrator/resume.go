@@ -0,0 +1,200 @@
+package migrator
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/raft"
+)
+
+// checkPartialBolt looks for a temporary BoltDB file left behind by an
+// earlier run which was killed before it could clean up. The file is
+// discarded if DiscardPartial is set, it was not marked as synced, or
+// it can't be opened. Otherwise it is kept, and resumeLogStore decides
+// whether its logs can be used.
+func (m *Migrator) checkPartialBolt() error {
+	m.resuming = false
+	fi, err := os.Stat(m.boltTempPath)
+	if os.IsNotExist(err) {
+		os.Remove(m.boltSynced)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m.Logger.Printf("[INFO] migrator: Found '%s' (%d bytes) left by an earlier run",
+		m.boltTempPath, fi.Size())
+
+	if m.DiscardPartial {
+		return m.discardPartialBolt("resuming is disabled")
+	}
+
+	// The file is written without syncing, so unless it was synced
+	// before the earlier run stopped it may be torn
+	if _, err := os.Stat(m.boltSynced); os.IsNotExist(err) {
+		return m.discardPartialBolt("it was not synced before the earlier run stopped")
+	} else if err != nil {
+		return err
+	}
+
+	store, err := newBulkBoltStore(m.boltTempPath)
+	if err == bolt.ErrTimeout {
+		return fmt.Errorf("'%s' is in use by another process", m.boltTempPath)
+	}
+	if err != nil {
+		return m.discardPartialBolt(fmt.Sprintf("it can't be opened: %s", err))
+	}
+	if err := store.Close(); err != nil {
+		return err
+	}
+
+	// More logs are about to be written without syncing, so the file
+	// can't be trusted again until it is synced
+	if err := m.clearBoltSynced(); err != nil {
+		return err
+	}
+	m.resuming = true
+	return nil
+}
+
+// discardPartialBolt removes a temporary BoltDB file from an earlier run.
+func (m *Migrator) discardPartialBolt(reason string) error {
+	if err := os.Remove(m.boltTempPath); err != nil {
+		return err
+	}
+	if err := m.clearBoltSynced(); err != nil {
+		return err
+	}
+	m.report.PartialDiscardReason = reason
+	m.warn(fmt.Sprintf("Discarded '%s' left by an earlier run: %s", m.boltTempPath, reason))
+	return nil
+}
+
+// markBoltSynced records that the temporary BoltDB file has been synced,
+// so that a later run may resume from it. The marker is synced too.
+func (m *Migrator) markBoltSynced() error {
+	if m.boltSynced == "" {
+		return nil
+	}
+	fh, err := os.Create(m.boltSynced)
+	if err != nil {
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(m.boltSynced))
+}
+
+// clearBoltSynced removes the marker written by markBoltSynced, making
+// sure it is gone before anything more is written to the file.
+func (m *Migrator) clearBoltSynced() error {
+	if err := os.Remove(m.boltSynced); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(filepath.Dir(m.boltSynced))
+}
+
+// resumeLogStore checks the logs already in a temporary BoltDB file
+// kept by checkPartialBolt, given the range of logs to be copied. They
+// can only be used if they start at the first log to copy, have no
+// gaps, and every one is identical to the source. Otherwise all of
+// them are removed. Returns the index to continue copying from.
+func (m *Migrator) resumeLogStore(start, last uint64) (uint64, error) {
+	first, err := m.bulkStore.FirstIndex()
+	if err != nil {
+		return 0, err
+	}
+	end, err := m.bulkStore.LastIndex()
+	if err != nil {
+		return 0, err
+	}
+	if end == 0 {
+		m.Logger.Printf("[INFO] migrator: Partial BoltDB file has no logs, copying all of them")
+		return start, nil
+	}
+
+	reason := m.checkPartialLogs(start, last, first, end)
+	if reason != "" {
+		if err := m.bulkStore.truncate(); err != nil {
+			return 0, err
+		}
+		m.logHasher = newLogHasher(manifestRangeSize)
+		m.report.LogsCopied = 0
+		m.report.LogsResumed = 0
+		m.report.Quarantined = nil
+		m.forgetLogRewrites()
+		m.report.PartialDiscardReason = reason
+		m.warn(fmt.Sprintf("Discarded logs %d to %d in '%s' left by an earlier run: %s",
+			first, end, m.boltTempPath, reason))
+		return start, nil
+	}
+
+	m.Logger.Printf("[INFO] migrator: Resuming from index %d, after %d logs verified in '%s'",
+		end+1, m.report.LogsResumed, m.boltTempPath)
+	return end + 1, nil
+}
+
+// checkPartialLogs compares the logs from first to end in the partial
+// file against the source, counting them as resumed. The source logs
+// are validated along the way, so the validator carries on from the
+// end of the range. Returns the reason they can't be used, or an empty
+// string if they all match.
+func (m *Migrator) checkPartialLogs(start, last, first, end uint64) string {
+	if first != start {
+		return fmt.Sprintf("its first log is %d, but the copy starts at %d", first, start)
+	}
+	if end > last {
+		return fmt.Sprintf("its last log is %d, but the source ends at %d", end, last)
+	}
+	if len(m.Transforms) > 0 {
+		return "log transforms may not give the same result twice"
+	}
+	for i := first; i <= end; i++ {
+		// A log which was salvaged is missing from both
+		log := &raft.Log{}
+		srcErr := m.src.GetLog(i, log)
+		partial := &raft.Log{}
+		if err := m.bulkStore.GetLog(i, partial); err != nil {
+			if err == raft.ErrLogNotFound && srcErr != nil && m.Salvage {
+				m.quarantine(i, srcErr)
+				continue
+			}
+			return fmt.Sprintf("log %d can't be read: %s", i, err)
+		}
+		if srcErr != nil {
+			return fmt.Sprintf("log %d can't be read from the source: %s", i, srcErr)
+		}
+		m.validateLog(i, log)
+		if m.invalid() {
+			return fmt.Sprintf("log %d violates the Raft invariants", i)
+		}
+		if err := m.rewriteLog(log); err != nil {
+			return fmt.Sprintf("log %d can't be rewritten: %s", i, err)
+		}
+		if !logsEqual(partial, log) {
+			return fmt.Sprintf("log %d does not match the source", i)
+		}
+		m.logHasher.add(partial)
+		m.report.LogsCopied++
+		m.report.LogsResumed++
+		m.sendProgress(PhaseLogStore, m.report.LogsResumed, int(last-start+1))
+	}
+	return ""
+}
+
+// logsEqual compares all of the fields of two logs.
+func logsEqual(a, b *raft.Log) bool {
+	return a.Index == b.Index && a.Term == b.Term && a.Type == b.Type &&
+		bytes.Equal(a.Data, b.Data)
+}
@@ -0,0 +1,209 @@
+package migrator
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// testResumeMigrator returns a Migrator copying from an in-memory store
+// with logs 1 to 10 into a bulk BoltDB store holding the given logs.
+func testResumeMigrator(t *testing.T, partial []*raft.Log) (*Migrator, func()) {
+	dir, path := testBoltPath(t)
+	store, err := newBulkBoltStore(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(partial) > 0 {
+		if err := store.StoreLogs(partial); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	src := &inmemStore{raft.NewInmemStore()}
+	for i := uint64(1); i <= 10; i++ {
+		if err := src.StoreLog(&raft.Log{Index: i, Term: 1, Data: []byte("foo")}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	m := NewCopier()
+	m.boltTempPath = path
+	m.bulkStore = store
+	m.src, m.dst = src, store
+	return m, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrator_resumeLogStore(t *testing.T) {
+	var partial []*raft.Log
+	for i := uint64(1); i <= 4; i++ {
+		partial = append(partial, &raft.Log{Index: i, Term: 1, Data: []byte("foo")})
+	}
+	m, cleanup := testResumeMigrator(t, partial)
+	defer cleanup()
+
+	next, err := m.resumeLogStore(1, 10)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if next != 5 || m.report.LogsResumed != 4 || m.report.LogsCopied != 4 {
+		t.Fatalf("bad: %d %#v", next, m.report)
+	}
+	if m.report.PartialDiscardReason != "" {
+		t.Fatalf("bad: %s", m.report.PartialDiscardReason)
+	}
+
+	// Validation carries on from the resumed logs
+	if m.validator.lastIndex != 4 || m.validator.lastTerm != 1 {
+		t.Fatalf("bad: %#v", m.validator)
+	}
+}
+
+func TestMigrator_resumeLogStore_discard(t *testing.T) {
+	cases := map[string][]*raft.Log{
+		"log 3 does not match": {
+			{Index: 1, Term: 1, Data: []byte("foo")},
+			{Index: 2, Term: 1, Data: []byte("foo")},
+			{Index: 3, Term: 2, Data: []byte("foo")},
+		},
+		"first log is 2": {
+			{Index: 2, Term: 1, Data: []byte("foo")},
+		},
+		"log 2 can't be read": {
+			{Index: 1, Term: 1, Data: []byte("foo")},
+			{Index: 3, Term: 1, Data: []byte("foo")},
+		},
+		"source ends at 10": {
+			{Index: 1, Term: 1, Data: []byte("foo")},
+			{Index: 11, Term: 1, Data: []byte("foo")},
+		},
+	}
+	for reason, partial := range cases {
+		m, cleanup := testResumeMigrator(t, partial)
+
+		next, err := m.resumeLogStore(1, 10)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if next != 1 || m.report.LogsResumed != 0 || m.report.LogsCopied != 0 {
+			t.Fatalf("bad: %s: %d %#v", reason, next, m.report)
+		}
+		if !strings.Contains(m.report.PartialDiscardReason, reason) {
+			t.Fatalf("bad: %s: %s", reason, m.report.PartialDiscardReason)
+		}
+
+		// All of the partial logs were removed
+		if last, _ := m.bulkStore.LastIndex(); last != 0 {
+			t.Fatalf("bad: %s: %d", reason, last)
+		}
+		cleanup()
+	}
+}
+
+func TestMigrator_migrate_partialTemp(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Leave behind a temp file which is not a BoltDB file at all
+	if err := ioutil.WriteFile(m.boltTempPath, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(m.Report().PartialDiscardReason, "can't be opened") {
+		t.Fatalf("bad: %s", m.Report().PartialDiscardReason)
+	}
+	if m.Report().LogsCopied == 0 {
+		t.Fatalf("bad: %#v", m.Report())
+	}
+}
+
+func TestMigrator_migrate_partialNotSynced(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Leave behind a valid temp file which was never marked as synced
+	store, err := newBulkBoltStore(m.boltTempPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(m.Report().PartialDiscardReason, "not synced") {
+		t.Fatalf("bad: %s", m.Report().PartialDiscardReason)
+	}
+}
+
+func TestMigrator_migrate_resume(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := m.mdbConnect(m.raftPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Copy the first few logs into a temp file, like a killed run
+	first, err := m.mdbStore.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store, err := newBulkBoltStore(m.boltTempPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for i := first; i < first+3; i++ {
+		log := &raft.Log{}
+		if err := m.mdbStore.GetLog(i, log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := store.StoreLog(log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+	m.mdbStore.Close()
+	if err := m.markBoltSynced(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(m.boltSynced); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+	report := m.Report()
+	if report.LogsResumed != 3 || report.PartialDiscardReason != "" {
+		t.Fatalf("bad: %#v", report)
+	}
+	if report.LogsCopied != int(report.LastIndex-report.FirstIndex+1) {
+		t.Fatalf("bad: %#v", report)
+	}
+}
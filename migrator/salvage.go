@@ -0,0 +1,154 @@
+package migrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/armon/gomdb"
+)
+
+const (
+	// quarantineFile is the default name of the file, in the raft
+	// directory, which holds the logs that could not be read.
+	quarantineFile = "quarantine.json"
+
+	// Table names and count used by the raft-mdb store
+	mdbLogsTable = "logs"
+	mdbMaxTables = 2
+)
+
+// QuarantinedLog is a log which could not be read from the source
+// while salvaging. Raw holds the stored bytes of the log, if they
+// could still be read without decoding them.
+type QuarantinedLog struct {
+	Index uint64
+	Error string
+	Raw   []byte `json:",omitempty"`
+}
+
+// quarantinePath returns the location of the quarantine file.
+func (m *Migrator) quarantinePath() string {
+	if m.QuarantinePath != "" {
+		return m.QuarantinePath
+	}
+	return filepath.Join(m.raftPath, quarantineFile)
+}
+
+// quarantine records a log which could not be read, so that the copy
+// can carry on without it.
+func (m *Migrator) quarantine(index uint64, err error) {
+	m.report.Quarantined = append(m.report.Quarantined, &QuarantinedLog{
+		Index: index,
+		Error: err.Error(),
+	})
+	m.warn(fmt.Sprintf("Log %d could not be read and was quarantined: %s", index, err))
+}
+
+// quarantinedIndexes returns the indexes of all quarantined logs.
+func (m *Migrator) quarantinedIndexes() []uint64 {
+	var indexes []uint64
+	for _, q := range m.report.Quarantined {
+		indexes = append(indexes, q.Index)
+	}
+	return indexes
+}
+
+// writeQuarantine writes all of the quarantined logs to the quarantine
+// file, one JSON object per line. If raw is given, it is used to fill
+// in the stored bytes of each log.
+func (m *Migrator) writeQuarantine(raw map[uint64][]byte) error {
+	path := m.quarantinePath()
+	tempPath := path + ".temp"
+	fh, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	enc := json.NewEncoder(fh)
+	for _, q := range m.report.Quarantined {
+		q.Raw = raw[q.Index]
+		if err := enc.Encode(q); err != nil {
+			fh.Close()
+			return err
+		}
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+
+	m.report.QuarantinePath = path
+	m.Logger.Printf("[INFO] migrator: Wrote %d quarantined logs to '%s'",
+		len(m.report.Quarantined), path)
+	return nil
+}
+
+// readRawMDBLogs reads the stored bytes of the given logs directly out
+// of LMDB, without decoding them. The raft-mdb store must be closed
+// first, since LMDB does not allow an environment to be opened twice
+// by the same process. Logs which do not exist are left out.
+func readRawMDBLogs(dir string, size uint64, indexes []uint64) (map[uint64][]byte, error) {
+	env, err := mdb.NewEnv()
+	if err != nil {
+		return nil, err
+	}
+	defer env.Close()
+	if err := env.SetMaxDBs(mdb.DBI(mdbMaxTables)); err != nil {
+		return nil, err
+	}
+	if err := env.SetMapSize(size); err != nil {
+		return nil, err
+	}
+	if err := env.Open(dir, mdb.NOTLS|mdb.RDONLY, 0755); err != nil {
+		return nil, err
+	}
+
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Abort()
+	name := mdbLogsTable
+	dbi, err := txn.DBIOpen(&name, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[uint64][]byte)
+	for _, index := range indexes {
+		val, err := txn.Get(dbi, uint64ToBytes(index))
+		if err == mdb.NotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		raw[index] = append([]byte(nil), val...)
+	}
+	return raw, nil
+}
+
+// quarantineMDBLogs writes the quarantined logs during a migration,
+// along with their raw bytes. The LMDB store is closed to read them,
+// so this must be done once the copy is complete.
+func (m *Migrator) quarantineMDBLogs() error {
+	if err := m.mdbStore.Close(); err != nil {
+		return err
+	}
+	m.mdbStore = nil
+
+	raw, err := readRawMDBLogs(m.mdbSource, m.mapSize, m.quarantinedIndexes())
+	if err != nil {
+		m.warn(fmt.Sprintf("Unable to read raw bytes of quarantined logs: %s", err))
+	}
+	return m.writeQuarantine(raw)
+}
@@ -0,0 +1,125 @@
+package migrator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// badLogStore fails to read some of the logs of an in-memory store.
+type badLogStore struct {
+	*inmemStore
+	bad map[uint64]bool
+}
+
+func (b *badLogStore) GetLog(index uint64, log *raft.Log) error {
+	if b.bad[index] {
+		return fmt.Errorf("msgpack decode error")
+	}
+	return b.inmemStore.GetLog(index, log)
+}
+
+func testBadLogStore(t *testing.T, bad ...uint64) *badLogStore {
+	src := &badLogStore{&inmemStore{raft.NewInmemStore()}, make(map[uint64]bool)}
+	for i := uint64(1); i <= 10; i++ {
+		if err := src.StoreLog(&raft.Log{Index: i, Term: 1, Data: []byte("foo")}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	for _, index := range bad {
+		src.bad[index] = true
+	}
+	return src
+}
+
+func TestMigrator_copy_badLog(t *testing.T) {
+	src := testBadLogStore(t, 3)
+
+	// Fails by default, naming the bad index
+	m := NewCopier()
+	err := m.Copy(src, &inmemStore{raft.NewInmemStore()})
+	if err == nil || !strings.Contains(err.Error(), "log 3") {
+		t.Fatalf("bad: %v", err)
+	}
+	if ErrorClassOf(err) != ErrClassLogStore {
+		t.Fatalf("bad: %v", ErrorClassOf(err))
+	}
+}
+
+func TestMigrator_copy_salvage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := testBadLogStore(t, 3, 7)
+	dst := &inmemStore{raft.NewInmemStore()}
+
+	m := NewCopier()
+	m.Salvage = true
+	m.QuarantinePath = filepath.Join(dir, "quarantine.json")
+	if err := m.Copy(src, dst); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The readable logs were copied
+	report := m.Report()
+	if report.LogsCopied != 8 || len(report.Quarantined) != 2 {
+		t.Fatalf("bad: %#v", report)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		err := dst.GetLog(i, &raft.Log{})
+		if (i == 3 || i == 7) != (err == raft.ErrLogNotFound) {
+			t.Fatalf("bad: %d %v", i, err)
+		}
+	}
+
+	// The quarantine file lists the bad logs
+	if report.QuarantinePath != m.QuarantinePath {
+		t.Fatalf("bad: %s", report.QuarantinePath)
+	}
+	fh, err := os.Open(m.QuarantinePath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer fh.Close()
+	var indexes []uint64
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var q QuarantinedLog
+		if err := json.Unmarshal(scanner.Bytes(), &q); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if q.Error != "msgpack decode error" {
+			t.Fatalf("bad: %#v", q)
+		}
+		indexes = append(indexes, q.Index)
+	}
+	if len(indexes) != 2 || indexes[0] != 3 || indexes[1] != 7 {
+		t.Fatalf("bad: %v", indexes)
+	}
+
+	// The hashed ranges skip the gaps
+	ranges := m.logHasher.finish()
+	if len(ranges) != 3 || ranges[0].Last != 2 || ranges[1].First != 4 || ranges[2].First != 8 {
+		t.Fatalf("bad: %#v", ranges)
+	}
+}
+
+func TestMigrator_copy_salvageNothing(t *testing.T) {
+	src := testBadLogStore(t, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+
+	m := NewCopier()
+	m.Salvage = true
+	if err := m.Copy(src, &inmemStore{raft.NewInmemStore()}); err == nil {
+		t.Fatalf("should fail")
+	}
+}
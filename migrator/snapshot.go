@@ -0,0 +1,65 @@
+package migrator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// Path to the Raft snapshots inside of the raft directory
+	snapshotDir = "snapshots"
+
+	// Name of the metadata file written into each snapshot directory,
+	// and the suffix used by Raft for snapshots still being written.
+	snapshotMetaFile  = "meta.json"
+	snapshotTmpSuffix = ".tmp"
+)
+
+// snapshotFileMeta is the metadata file Raft writes into each snapshot
+// directory, which includes a checksum of the snapshot data.
+type snapshotFileMeta struct {
+	raft.SnapshotMeta
+	CRC []byte
+}
+
+// latestSnapshot scans the Raft snapshot directory and returns the
+// metadata of the newest completed snapshot. Returns nil if there are
+// no snapshots available. Snapshots which are still in progress or
+// have unreadable metadata are ignored, since Raft would ignore them
+// as well when restoring.
+func latestSnapshot(dir string) (*raft.SnapshotMeta, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var latest *raft.SnapshotMeta
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasSuffix(entry.Name(), snapshotTmpSuffix) {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(dir, entry.Name(), snapshotMetaFile))
+		if err != nil {
+			continue
+		}
+		meta := &raft.SnapshotMeta{}
+		if err := json.Unmarshal(buf, meta); err != nil {
+			continue
+		}
+
+		if latest == nil || meta.Term > latest.Term ||
+			(meta.Term == latest.Term && meta.Index > latest.Index) {
+			latest = meta
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,49 @@
+package migrator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testSnapshot(t *testing.T, dir, id, meta string) {
+	path := filepath.Join(dir, id)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, snapshotMetaFile), []byte(meta), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestLatestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Returns nil if the snapshot dir is missing
+	snap, err := latestSnapshot(filepath.Join(dir, snapshotDir))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if snap != nil {
+		t.Fatalf("bad: %#v", snap)
+	}
+
+	// Write a few snapshots, including ones which should be ignored
+	testSnapshot(t, dir, "2-10-1", `{"ID":"2-10-1","Index":10,"Term":2}`)
+	testSnapshot(t, dir, "2-20-2", `{"ID":"2-20-2","Index":20,"Term":2}`)
+	testSnapshot(t, dir, "2-30-3.tmp", `{"ID":"2-30-3","Index":30,"Term":2}`)
+	testSnapshot(t, dir, "garbage", `{`)
+
+	snap, err = latestSnapshot(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if snap == nil || snap.ID != "2-20-2" || snap.Index != 20 {
+		t.Fatalf("bad: %#v", snap)
+	}
+}
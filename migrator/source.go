@@ -0,0 +1,93 @@
+package migrator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/armon/gomdb"
+)
+
+const (
+	// mdbDataFile is the LMDB data file inside the mdb directory
+	mdbDataFile = "data.mdb"
+)
+
+// copySource makes a consistent, point-in-time copy of the LMDB
+// environment into a new scratch directory, laid out like the raft
+// directory so that it can be opened in place of the original. The
+// original data.mdb is checksummed first so that verifySource can
+// prove it was not modified. Returns the scratch directory, which the
+// caller must remove, even if an error is returned.
+func (m *Migrator) copySource() (string, error) {
+	m.sendProgress(PhaseCopySource, 0, 2)
+
+	_, sum, err := hashFile(filepath.Join(m.mdbPath, mdbDataFile))
+	if err != nil {
+		return "", err
+	}
+	m.report.SourceChecksum = sum
+	m.Logger.Printf("[INFO] migrator: LMDB data file has sha256 %s", sum)
+	m.sendProgress(PhaseCopySource, 1, 2)
+
+	scratch, err := ioutil.TempDir(m.ScratchDir, "consul-migrate")
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(scratch, mdbDir)
+	if err := os.Mkdir(dst, 0700); err != nil {
+		return scratch, err
+	}
+	size, err := mdbMapSize(m.mdbPath, m.MapSize)
+	if err != nil {
+		return scratch, err
+	}
+	if err := copyMDBEnv(m.mdbPath, dst, size); err != nil {
+		return scratch, err
+	}
+	m.Logger.Printf("[INFO] migrator: Copied LMDB environment to '%s'", dst)
+
+	m.sendProgress(PhaseCopySource, 2, 2)
+	return scratch, nil
+}
+
+// verifySource checks that the original data.mdb still matches the
+// checksum taken by copySource.
+func (m *Migrator) verifySource() error {
+	_, sum, err := hashFile(filepath.Join(m.mdbPath, mdbDataFile))
+	if err != nil {
+		return err
+	}
+	if sum != m.report.SourceChecksum {
+		return fmt.Errorf("sha256 of '%s' changed from %s to %s",
+			mdbDataFile, m.report.SourceChecksum, sum)
+	}
+	m.Logger.Printf("[DEBUG] migrator: LMDB data file is unchanged")
+	return nil
+}
+
+// copyMDBEnv copies an LMDB environment into another directory, the
+// same way as mdb_copy. The source is opened read-only without using
+// the lock file, so it is not modified, and the copy is taken inside a
+// single read transaction. Without the lock file the read transaction
+// isn't registered in the reader table, and a writer may reuse the pages
+// being copied, so the copy is only consistent if Consul is stopped.
+// verifySource catches a writer which changed data.mdb meanwhile.
+func copyMDBEnv(src, dst string, size uint64) error {
+	env, err := mdb.NewEnv()
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+	if err := env.SetMaxDBs(mdb.DBI(mdbMaxTables)); err != nil {
+		return err
+	}
+	if err := env.SetMapSize(size); err != nil {
+		return err
+	}
+	if err := env.Open(src, mdb.NOTLS|mdb.RDONLY|mdb.NOLOCK, 0755); err != nil {
+		return err
+	}
+	return env.Copy(dst)
+}
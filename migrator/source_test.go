@@ -0,0 +1,86 @@
+package migrator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrator_migrate_copySource(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	scratch, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.CopySource = true
+	m.ScratchDir = scratch
+
+	_, before, err := hashFile(filepath.Join(m.mdbPath, mdbDataFile))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The checksum of the original was recorded
+	report := m.Report()
+	if report.SourceChecksum != before {
+		t.Fatalf("bad: %s %s", report.SourceChecksum, before)
+	}
+	if _, ok := report.PhaseDurations[PhaseCopySource]; !ok {
+		t.Fatalf("bad: %v", report.PhaseDurations)
+	}
+	if report.LogsCopied == 0 {
+		t.Fatalf("bad: %#v", report)
+	}
+
+	// The scratch copy was cleaned up
+	entries, err := ioutil.ReadDir(scratch)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("bad: %v", entries)
+	}
+}
+
+func TestMigrator_verifySource(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	path := filepath.Join(m.mdbPath, mdbDataFile)
+	_, m.report.SourceChecksum, err = hashFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := m.verifySource(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Any change to the data file is detected
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fh.Write([]byte("junk"))
+	fh.Close()
+	err = m.verifySource()
+	if err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package migrator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// unverifiedSuffix is added to a BoltDB file which failed to verify
+	unverifiedSuffix = ".unverified"
+)
+
+var (
+	// startupAbortGrace is how long Startup waits for a migration to
+	// stop once it has been aborted.
+	startupAbortGrace = 30 * time.Second
+)
+
+// StartupStatus describes the state of a data-dir found by Startup.
+type StartupStatus string
+
+const (
+	// StartupFresh means there is no Raft data at all, such as on a
+	// new server. StartupCurrent means the data is already in BoltDB.
+	// StartupMigrated means the LMDB data was migrated and verified.
+	StartupFresh    StartupStatus = "fresh"
+	StartupCurrent  StartupStatus = "current"
+	StartupMigrated StartupStatus = "migrated"
+)
+
+// StartupResult is returned by Startup. Report is set if a migration
+// was attempted, and Verify once the migrated data was verified.
+type StartupResult struct {
+	Status StartupStatus
+	Report *Report
+	Verify *VerifyResult
+}
+
+// Startup brings the Raft data in a Consul data-dir up to date before
+// an agent starts, and is meant to be embedded in the agent. The data
+// is migrated if it is still in LMDB, and then verified against the
+// manifest. Any error other than ErrClassRollback leaves the data-dir
+// as it was found, so that the migration can be retried on the next
+// start. An ErrClassRollback error means the agent must not start.
+//
+// If an earlier migration stopped after activating the new store but
+// before archiving the LMDB data, the new store is verified against the
+// manifest written before it was activated. The LMDB data is archived if
+// it passes, and otherwise the new store is moved aside and the data is
+// migrated again.
+//
+// If the migration is still running after the timeout, it is aborted
+// and cleaned up. The timeout is only checked between steps, and the
+// copy made for CopySource and the sync of the new store can't be
+// interrupted. Once the new store is activated, the migration always
+// runs to completion, including archiving the LMDB data. Startup waits
+// up to 30 seconds more for an aborted migration to stop, and then
+// returns an ErrClassAborted error while it carries on in the
+// background, so the agent must not start. Logs are written to the
+// logger, which may be nil.
+func Startup(dataDir string, logger *log.Logger, timeout time.Duration) (*StartupResult, error) {
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", log.LstdFlags)
+	}
+
+	// Check the state of the data-dir
+	raftPath := filepath.Join(dataDir, raftDir)
+	hasMDB := exists(filepath.Join(raftPath, mdbDir))
+	hasBolt := exists(filepath.Join(raftPath, boltFile))
+	hasBackup := exists(filepath.Join(raftPath, mdbBackupDir)) ||
+		exists(filepath.Join(raftPath, mdbArchiveFile))
+	peersPath := filepath.Join(raftPath, peersFile)
+	switch {
+	case hasMDB && hasBolt:
+		m, err := New(dataDir)
+		if err != nil {
+			return nil, newError(ErrClassConfig, err, "Failed to create migrator")
+		}
+		m.Logger = logger
+		return m.finishInterrupted(timeout)
+	case hasBackup && !hasMDB && !hasBolt:
+		return nil, newError(ErrClassConfig, nil,
+			"Found an LMDB backup but no Raft data in '%s', which must be restored by hand", raftPath)
+	case hasBolt && exists(peersPath+peersTempSuffix):
+		return nil, newError(ErrClassConfig, nil,
+			"Found rewritten peers in '%s' which were not moved into place, "+
+				"which must be moved to '%s' by hand", peersPath+peersTempSuffix, peersPath)
+	case hasBolt:
+		logger.Printf("[DEBUG] migrator: Raft data in '%s' is already in BoltDB", raftPath)
+		return &StartupResult{Status: StartupCurrent}, nil
+	case !hasMDB:
+		logger.Printf("[DEBUG] migrator: No Raft data found in '%s'", raftPath)
+		return &StartupResult{Status: StartupFresh}, nil
+	}
+
+	m, err := New(dataDir)
+	if err != nil {
+		return nil, newError(ErrClassConfig, err, "Failed to create migrator")
+	}
+	m.Logger = logger
+	return m.startup(timeout)
+}
+
+// startup runs a migration for Startup, aborting it after the timeout,
+// and then verifies the result.
+func (m *Migrator) startup(timeout time.Duration) (*StartupResult, error) {
+	type migrateResult struct {
+		migrated bool
+		err      error
+	}
+	doneCh := make(chan migrateResult, 1)
+	go func() {
+		migrated, err := m.Migrate()
+		doneCh <- migrateResult{migrated, err}
+	}()
+
+	// Wait for the migration, which cleans up after itself if aborted
+	var result migrateResult
+	select {
+	case result = <-doneCh:
+	case <-time.After(timeout):
+		m.Logger.Printf("[WARN] migrator: Migration is taking longer than %s, aborting", timeout)
+		m.abort()
+		select {
+		case result = <-doneCh:
+		case <-time.After(startupAbortGrace):
+			return nil, newError(ErrClassAborted, nil,
+				"Migration timed out after %s and did not stop within %s; "+
+					"do not start the agent until it has finished", timeout, startupAbortGrace)
+		}
+	}
+	if result.err != nil {
+		if ErrorClassOf(result.err) == ErrClassAborted {
+			return nil, newError(ErrClassAborted, result.err, "Migration timed out after %s", timeout)
+		}
+		return nil, result.err
+	}
+	if !result.migrated {
+		return &StartupResult{Status: StartupFresh, Report: m.Report()}, nil
+	}
+
+	// Migrate checked the new store against the manifest
+	if m.verifyErr != nil {
+		return nil, m.rollback(m.verifyErr)
+	}
+	return &StartupResult{Status: StartupMigrated, Report: m.Report(), Verify: m.verify}, nil
+}
+
+// finishInterrupted completes a migration which stopped after the new
+// store was activated, but before the LMDB data was archived, if the
+// new store can be verified. Otherwise the new store is moved aside
+// and the data is migrated again.
+func (m *Migrator) finishInterrupted(timeout time.Duration) (*StartupResult, error) {
+	m.Logger.Printf("[WARN] migrator: Found both LMDB data and '%s', an earlier migration was interrupted", m.boltPath)
+	verify, err := VerifyManifest(m.manifestPath())
+	if err == nil && !verify.OK() {
+		err = fmt.Errorf("%d problems found, including: %s", len(verify.Problems), verify.Problems[0])
+	}
+	if err != nil {
+		m.Logger.Printf("[WARN] migrator: Migrating again, since '%s' can't be verified: %s", m.boltPath, err)
+		if err := m.fs.Rename(m.boltPath, m.boltPath+unverifiedSuffix); err != nil {
+			return nil, newError(ErrClassRollback, err,
+				"Failed to move aside '%s' left by an interrupted migration; "+
+					"do not start the agent until the data-dir is fixed", m.boltPath)
+		}
+		os.Remove(m.manifestPath())
+		return m.startup(timeout)
+	}
+
+	// Finish the steps after activating the new store
+	if err := m.archiveMDBStore(); err != nil {
+		return nil, newError(ErrClassArchive, err, "Failed to archive LMDB data")
+	}
+	man := verify.Manifest
+	man.CompletedAt = time.Now().UTC()
+	err = m.checksumFiles(man)
+	if err == nil {
+		err = writeManifestFile(m.manifestPath(), man)
+	}
+	if err != nil {
+		m.Logger.Printf("[WARN] migrator: Failed to update migration manifest: %s", err)
+	}
+	m.report.ManifestPath = m.manifestPath()
+	if err := m.activatePeerFiles(m.pendingPeerFiles()); err != nil {
+		return nil, newError(ErrClassActivate, err, "Failed to move the rewritten peers into place")
+	}
+	m.Logger.Printf("[INFO] migrator: Finished the interrupted migration of '%s'", m.dataDir)
+	return &StartupResult{Status: StartupMigrated, Report: m.Report(), Verify: verify}, nil
+}
+
+// rollback undoes a migration which could not be verified, by moving
+// the LMDB data back and the new store aside, so that the migration
+// can be tried again. Only renamed LMDB data can be moved back. If the
+// rollback fails, the unverified store may still be in place, so an
+// ErrClassRollback error is returned and the agent must not start.
+func (m *Migrator) rollback(cause error) error {
+	m.Logger.Printf("[ERR] migrator: Rolling back migration: %s", cause)
+	if m.report.ArchivePath != m.mdbBackupPath {
+		return newError(ErrClassRollback, cause,
+			"Failed to verify migration, and LMDB data in '%s' can't be restored; "+
+				"do not start the agent until the data-dir is fixed", m.report.ArchivePath)
+	}
+
+	// Restore the LMDB data first. If anything fails after this, both
+	// stores are in place, which Startup refuses to run with.
+	if err := m.fs.Rename(m.mdbBackupPath, m.mdbPath); err != nil {
+		return newError(ErrClassRollback, cause,
+			"Failed to verify migration, and LMDB data can't be restored (%s); "+
+				"do not start the agent until the data-dir is fixed", err)
+	}
+	if err := m.fs.Rename(m.boltPath, m.boltPath+unverifiedSuffix); err != nil {
+		// Put the backup back so the data-dir is at least consistent
+		if uerr := m.fs.Rename(m.mdbPath, m.mdbBackupPath); uerr != nil {
+			m.Logger.Printf("[ERR] migrator: Failed to move LMDB data back to '%s': %s", m.mdbBackupPath, uerr)
+		}
+		return newError(ErrClassRollback, cause,
+			"Failed to verify migration, and '%s' can't be moved aside (%s); "+
+				"do not start the agent until the data-dir is fixed", m.boltPath, err)
+	}
+	os.Remove(m.manifestPath())
+	return newError(ErrClassVerify, cause, "Failed to verify migration, rolled back")
+}
+
+// exists returns whether a file or directory exists.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,278 @@
+package migrator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartup_state(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	raftPath := filepath.Join(dir, raftDir)
+
+	// Nothing in the data-dir yet
+	res, err := Startup(dir, nil, time.Minute)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if res.Status != StartupFresh || res.Report != nil {
+		t.Fatalf("bad: %#v", res)
+	}
+
+	// Only BoltDB data
+	if err := os.MkdirAll(raftPath, 0700); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(raftPath, boltFile), nil, 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	res, err = Startup(dir, nil, time.Minute)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if res.Status != StartupCurrent {
+		t.Fatalf("bad: %#v", res)
+	}
+
+	// Rewritten peers which were never moved into place
+	peersTemp := filepath.Join(raftPath, peersFile+peersTempSuffix)
+	if err := ioutil.WriteFile(peersTemp, []byte("[]"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := Startup(dir, nil, time.Minute); ErrorClassOf(err) != ErrClassConfig {
+		t.Fatalf("bad: %v", err)
+	}
+	os.Remove(peersTemp)
+
+	// Only an LMDB backup, as if the data-dir was changed by hand
+	os.Remove(filepath.Join(raftPath, boltFile))
+	if err := os.MkdirAll(filepath.Join(raftPath, mdbBackupDir), 0700); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := Startup(dir, nil, time.Minute); ErrorClassOf(err) != ErrClassConfig {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestStartup_migrate(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	res, err := Startup(dir, nil, time.Minute)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if res.Status != StartupMigrated || res.Report == nil {
+		t.Fatalf("bad: %#v", res)
+	}
+	if res.Verify == nil || !res.Verify.OK() {
+		t.Fatalf("bad: %#v", res.Verify)
+	}
+
+	// Starting again finds the migrated data
+	res, err = Startup(dir, nil, time.Minute)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if res.Status != StartupCurrent {
+		t.Fatalf("bad: %#v", res)
+	}
+}
+
+// interruptMigration puts a migrated data-dir back into the state left
+// by a migration which stopped before archiving the LMDB data.
+func interruptMigration(t *testing.T, m *Migrator) {
+	if err := os.Rename(m.mdbBackupPath, m.mdbPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	man, err := ReadManifest(m.manifestPath())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	man.Files = nil
+	if err := writeManifestFile(m.manifestPath(), man); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestStartup_interrupted(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The new store is verified and the LMDB data archived
+	interruptMigration(t, m)
+	res, err := Startup(dir, nil, time.Minute)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if res.Status != StartupMigrated || res.Verify == nil || !res.Verify.OK() {
+		t.Fatalf("bad: %#v", res)
+	}
+	if _, err := os.Stat(m.mdbBackupPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(m.mdbPath); !os.IsNotExist(err) {
+		t.Fatalf("bad: %v", err)
+	}
+	man, err := ReadManifest(m.manifestPath())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(man.Files) != 2 {
+		t.Fatalf("bad: %#v", man.Files)
+	}
+
+	// Without a manifest, the new store is moved aside and the data is
+	// migrated again
+	interruptMigration(t, m)
+	os.Remove(m.manifestPath())
+	res, err = Startup(dir, nil, time.Minute)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if res.Status != StartupMigrated || res.Report == nil || res.Report.LogsCopied == 0 {
+		t.Fatalf("bad: %#v", res)
+	}
+	for _, path := range []string{m.boltPath, m.boltPath + unverifiedSuffix, m.mdbBackupPath} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestMigrator_startup_grace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-migrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := startupAbortGrace
+	startupAbortGrace = 10 * time.Millisecond
+	defer func() { startupAbortGrace = old }()
+
+	// The pre hook keeps running after the migration is aborted
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.MkdirAll(m.mdbPath, 0700); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.PreHooks = []string{"sleep 1"}
+	start := time.Now()
+	_, err = m.startup(10 * time.Millisecond)
+	if ErrorClassOf(err) != ErrClassAborted || !strings.Contains(err.Error(), "did not stop") {
+		t.Fatalf("bad: %v", err)
+	}
+	if time.Now().Sub(start) > 500*time.Millisecond {
+		t.Fatalf("waited too long")
+	}
+
+	// Wait for the migration to stop
+	for range m.ProgressCh {
+	}
+}
+
+func TestMigrator_startup_aborted(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	m.abort()
+
+	_, err = m.startup(time.Minute)
+	if ErrorClassOf(err) != ErrClassAborted {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The data-dir is left as it was
+	if _, err := os.Stat(m.mdbPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, path := range []string{m.boltPath, m.boltTempPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("bad: %s %v", path, err)
+		}
+	}
+}
+
+func TestMigrator_rollback(t *testing.T) {
+	dir := testRaftDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := m.Migrate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = m.rollback(errAborted)
+	if ErrorClassOf(err) != ErrClassVerify {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The LMDB data is back and the new store was moved aside
+	if _, err := os.Stat(m.mdbPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(m.boltPath + unverifiedSuffix); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, path := range []string{m.boltPath, m.mdbBackupPath, m.manifestPath()} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("bad: %s %v", path, err)
+		}
+	}
+}
+
+func TestMigrator_rollback_fails(t *testing.T) {
+	for _, failAt := range []int{1, 2} {
+		dir := testRaftDir(t)
+		m, err := New(dir)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if _, err := m.Migrate(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		// Fail restoring the LMDB data, or moving the new store aside
+		m.fs = &faultFS{osFileSystem{}, newFaults(map[string]int{"Rename": failAt})}
+		err = m.rollback(errAborted)
+		if ErrorClassOf(err) != ErrClassRollback || !strings.Contains(err.Error(), "do not start") {
+			t.Fatalf("%d: bad: %v", failAt, err)
+		}
+
+		// The data-dir is left as it was after the migration
+		for _, path := range []string{m.boltPath, m.mdbBackupPath} {
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("%d: err: %s", failAt, err)
+			}
+		}
+		if _, err := os.Stat(m.mdbPath); !os.IsNotExist(err) {
+			t.Fatalf("%d: bad: %v", failAt, err)
+		}
+		os.RemoveAll(dir)
+	}
+}
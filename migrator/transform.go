@@ -0,0 +1,164 @@
+package migrator
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// maxTransformNotes is the number of notes recorded for each
+	// transform. Any more are only counted.
+	maxTransformNotes = 100
+)
+
+// TransformAction is what a LogTransform did with a log.
+type TransformAction string
+
+const (
+	// TransformKeep leaves the log as it was
+	TransformKeep TransformAction = "keep"
+
+	// TransformModify means the log was changed in place
+	TransformModify TransformAction = "modify"
+
+	// TransformDrop leaves the log out of the destination. Raft expects
+	// its logs to have no gaps, so it is usually safer to modify a log
+	// into a LogNoop than to drop it.
+	TransformDrop TransformAction = "drop"
+)
+
+// LogTransform is given each log as it is copied, and may modify it in
+// place, drop it, or annotate it with a note for the report. Transforms
+// are run in the order given in Migrator.Transforms, after the source
+// has been validated and addresses rewritten, and a dropped log is not
+// passed to the transforms after it. An error fails the migration.
+type LogTransform interface {
+	// Name identifies the transform in the report.
+	Name() string
+
+	// Transform returns what was done with the log, and a note to
+	// record against its index, which may be empty.
+	Transform(log *raft.Log) (TransformAction, string, error)
+}
+
+// TransformFunc adapts a function to the LogTransform interface.
+type TransformFunc struct {
+	TransformName string
+	Func          func(log *raft.Log) (TransformAction, string, error)
+}
+
+// Name implements the LogTransform interface.
+func (f *TransformFunc) Name() string {
+	return f.TransformName
+}
+
+// Transform implements the LogTransform interface.
+func (f *TransformFunc) Transform(log *raft.Log) (TransformAction, string, error) {
+	return f.Func(log)
+}
+
+// TransformNote is a note a transform recorded against a log.
+type TransformNote struct {
+	Index uint64
+	Note  string
+}
+
+// TransformReport records the logs touched by a transform. The ranges
+// cover the logs it modified or dropped, and Notes holds the first of
+// its notes, out of NoteCount in total.
+type TransformReport struct {
+	Name         string
+	LogsModified int
+	LogsDropped  int
+	Modified     []*IndexRange
+	Dropped      []*IndexRange
+	Notes        []*TransformNote
+	NoteCount    int
+}
+
+// validTransforms checks that every transform has a name, and that the
+// names are unique so the report can tell them apart.
+func validTransforms(transforms []LogTransform) error {
+	names := make(map[string]bool)
+	for _, t := range transforms {
+		name := t.Name()
+		if name == "" {
+			return fmt.Errorf("Log transform has no name")
+		}
+		if names[name] {
+			return fmt.Errorf("Log transform name '%s' is used more than once", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// transformLog passes a log through each of the transforms in order,
+// recording what they did in the report. Returns false if the log was
+// dropped.
+func (m *Migrator) transformLog(log *raft.Log) (bool, error) {
+	for i, t := range m.Transforms {
+		index := log.Index
+		action, note, err := t.Transform(log)
+		if err != nil {
+			return false, newError(ErrClassTransform, err, "Log transform '%s' failed on log %d", t.Name(), index)
+		}
+		if log.Index != index {
+			return false, newError(ErrClassTransform, nil, "Log transform '%s' changed the index of log %d to %d",
+				t.Name(), index, log.Index)
+		}
+
+		r := m.transformReport(i)
+		if note != "" {
+			r.NoteCount++
+			if len(r.Notes) < maxTransformNotes {
+				r.Notes = append(r.Notes, &TransformNote{Index: index, Note: note})
+			}
+		}
+		switch action {
+		case TransformKeep:
+		case TransformModify:
+			r.LogsModified++
+			r.Modified = addIndex(r.Modified, index)
+		case TransformDrop:
+			r.LogsDropped++
+			r.Dropped = addIndex(r.Dropped, index)
+			m.Logger.Printf("[DEBUG] migrator: Log transform '%s' dropped log %d", t.Name(), index)
+			return false, nil
+		default:
+			return false, newError(ErrClassTransform, nil, "Log transform '%s' returned unknown action '%s' for log %d",
+				t.Name(), action, index)
+		}
+	}
+	return true, nil
+}
+
+// transformReport returns the report for the i'th transform, creating
+// the reports on first use.
+func (m *Migrator) transformReport(i int) *TransformReport {
+	if m.report.Transforms == nil {
+		for _, t := range m.Transforms {
+			m.report.Transforms = append(m.report.Transforms, &TransformReport{Name: t.Name()})
+		}
+	}
+	return m.report.Transforms[i]
+}
+
+// transformDropped returns the number of logs dropped by transforms.
+func (m *Migrator) transformDropped() int {
+	var dropped int
+	for _, r := range m.report.Transforms {
+		dropped += r.LogsDropped
+	}
+	return dropped
+}
+
+// transformNames returns the names of the configured transforms.
+func (m *Migrator) transformNames() []string {
+	var names []string
+	for _, t := range m.Transforms {
+		names = append(names, t.Name())
+	}
+	return names
+}
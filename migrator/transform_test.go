@@ -0,0 +1,196 @@
+package migrator
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// redactTransform replaces the data of command logs holding a secret.
+func redactTransform() LogTransform {
+	return &TransformFunc{
+		TransformName: "redact",
+		Func: func(log *raft.Log) (TransformAction, string, error) {
+			if !bytes.Contains(log.Data, []byte("secret")) {
+				return TransformKeep, "", nil
+			}
+			log.Data = []byte("redacted")
+			return TransformModify, "removed a secret", nil
+		},
+	}
+}
+
+// dropTypeTransform drops logs of the given type.
+func dropTypeTransform(logType raft.LogType) LogTransform {
+	return &TransformFunc{
+		TransformName: "drop",
+		Func: func(log *raft.Log) (TransformAction, string, error) {
+			if log.Type == logType {
+				return TransformDrop, "", nil
+			}
+			return TransformKeep, "", nil
+		},
+	}
+}
+
+// testTransformStore returns a store with logs 1 to 6, where 2 and 3
+// hold secrets and 5 and 6 are no-ops.
+func testTransformStore(t *testing.T) *inmemStore {
+	src := testValidateStore(t, nil, validStable())
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogCommand, Data: []byte("foo")},
+		{Index: 2, Term: 1, Type: raft.LogCommand, Data: []byte("secret1")},
+		{Index: 3, Term: 1, Type: raft.LogCommand, Data: []byte("secret2")},
+		{Index: 4, Term: 2, Type: raft.LogCommand, Data: []byte("bar")},
+		{Index: 5, Term: 2, Type: raft.LogNoop},
+		{Index: 6, Term: 2, Type: raft.LogNoop, Data: []byte("secret3")},
+	}
+	if err := src.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return src
+}
+
+func TestMigrator_transform(t *testing.T) {
+	m := NewCopier()
+	m.Transforms = []LogTransform{redactTransform(), dropTypeTransform(raft.LogNoop)}
+	dst := &inmemStore{raft.NewInmemStore()}
+	if err := m.Copy(testTransformStore(t), dst); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	log := &raft.Log{}
+	for index, data := range map[uint64]string{1: "foo", 2: "redacted", 3: "redacted", 4: "bar"} {
+		if err := dst.GetLog(index, log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if string(log.Data) != data {
+			t.Fatalf("%d: bad: %q", index, log.Data)
+		}
+	}
+	for _, index := range []uint64{5, 6} {
+		if err := dst.GetLog(index, log); err != raft.ErrLogNotFound {
+			t.Fatalf("%d: bad: %v", index, err)
+		}
+	}
+
+	report := m.Report()
+	if report.LogsCopied != 4 {
+		t.Fatalf("bad: %d", report.LogsCopied)
+	}
+	expect := []*TransformReport{
+		{
+			Name:         "redact",
+			LogsModified: 3,
+			Modified:     []*IndexRange{{2, 3}, {6, 6}},
+			Notes: []*TransformNote{
+				{Index: 2, Note: "removed a secret"},
+				{Index: 3, Note: "removed a secret"},
+				{Index: 6, Note: "removed a secret"},
+			},
+			NoteCount: 3,
+		},
+		{
+			Name:        "drop",
+			LogsDropped: 2,
+			Dropped:     []*IndexRange{{5, 6}},
+		},
+	}
+	if !reflect.DeepEqual(report.Transforms, expect) {
+		t.Fatalf("bad: %#v", report.Transforms)
+	}
+}
+
+func TestMigrator_transform_dropFirst(t *testing.T) {
+	// A dropped log is not passed to later transforms
+	m := NewCopier()
+	m.Transforms = []LogTransform{dropTypeTransform(raft.LogNoop), redactTransform()}
+	if err := m.Copy(testTransformStore(t), &inmemStore{raft.NewInmemStore()}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if r := m.Report().Transforms[1]; r.LogsModified != 2 || r.NoteCount != 2 {
+		t.Fatalf("bad: %#v", r)
+	}
+}
+
+func TestMigrator_transform_fails(t *testing.T) {
+	cases := []struct {
+		name string
+		fn   func(log *raft.Log) (TransformAction, string, error)
+	}{
+		{"error", func(log *raft.Log) (TransformAction, string, error) {
+			if log.Index == 3 {
+				return "", "", fmt.Errorf("bad payload")
+			}
+			return TransformKeep, "", nil
+		}},
+		{"index", func(log *raft.Log) (TransformAction, string, error) {
+			log.Index++
+			return TransformModify, "", nil
+		}},
+		{"action", func(log *raft.Log) (TransformAction, string, error) {
+			return "bogus", "", nil
+		}},
+	}
+	for _, c := range cases {
+		m := NewCopier()
+		m.Transforms = []LogTransform{&TransformFunc{TransformName: c.name, Func: c.fn}}
+		err := m.Copy(testTransformStore(t), &inmemStore{raft.NewInmemStore()})
+		if ErrorClassOf(err) != ErrClassTransform {
+			t.Fatalf("%s: bad: %v", c.name, err)
+		}
+	}
+}
+
+func TestMigrator_transform_dropAll(t *testing.T) {
+	m := NewCopier()
+	m.Transforms = []LogTransform{&TransformFunc{
+		TransformName: "all",
+		Func: func(*raft.Log) (TransformAction, string, error) {
+			return TransformDrop, "", nil
+		},
+	}}
+	err := m.Copy(testTransformStore(t), &inmemStore{raft.NewInmemStore()})
+	if ErrorClassOf(err) != ErrClassLogStore {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestMigrator_transform_maxNotes(t *testing.T) {
+	src := testValidateStore(t, make([]uint64, maxTransformNotes+10), validStable())
+	m := NewCopier()
+	m.Transforms = []LogTransform{&TransformFunc{
+		TransformName: "note",
+		Func: func(*raft.Log) (TransformAction, string, error) {
+			return TransformKeep, "seen", nil
+		},
+	}}
+	if err := m.Copy(src, &inmemStore{raft.NewInmemStore()}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	r := m.Report().Transforms[0]
+	if r.NoteCount != maxTransformNotes+10 || len(r.Notes) != maxTransformNotes {
+		t.Fatalf("bad: %d %d", r.NoteCount, len(r.Notes))
+	}
+	if r.LogsModified != 0 || len(r.Modified) != 0 {
+		t.Fatalf("bad: %#v", r)
+	}
+}
+
+func TestValidTransforms(t *testing.T) {
+	if err := validTransforms([]LogTransform{redactTransform(), dropTypeTransform(raft.LogNoop)}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	bad := [][]LogTransform{
+		{redactTransform(), redactTransform()},
+		{&TransformFunc{}},
+	}
+	for _, transforms := range bad {
+		if err := validTransforms(transforms); err == nil {
+			t.Fatalf("should fail")
+		}
+	}
+}
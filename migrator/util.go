@@ -0,0 +1,40 @@
+package migrator
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// uint64ToBytes converts a uint64 to a byte slice the same way the Raft
+// stores do, so that stable store values are portable between them.
+func uint64ToBytes(u uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, u)
+	return buf
+}
+
+// bytesToUint64 is the inverse of uint64ToBytes.
+func bytesToUint64(b []byte) uint64 {
+	if len(b) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// isNotFound checks if an error returned from a stable store means the
+// key does not exist. The stores do not share an error value, but they
+// all use the same message.
+func isNotFound(err error) bool {
+	return err != nil && err.Error() == errNotFound.Error()
+}
+
+// syncDir syncs a directory, making the files created, renamed or
+// removed in it durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,194 @@
+package migrator
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// Supported modes for validating the source data. ValidateWarn
+	// reports violations of the Raft invariants as warnings and carries
+	// on, ValidateStrict fails the migration on any error, and
+	// ValidateOff skips the checks.
+	ValidateWarn   = "warn"
+	ValidateStrict = "strict"
+	ValidateOff    = "off"
+
+	// maxViolations is the number of violations recorded in detail.
+	// Any more are only counted.
+	maxViolations = 100
+)
+
+var (
+	// errInvalid is returned when strict validation stops a copy
+	errInvalid = fmt.Errorf("Source data violates Raft invariants")
+)
+
+// Severity is how serious a violation of the Raft invariants is. Data
+// with errors will confuse Raft once it is loaded, while warnings are
+// unusual but harmless.
+type Severity string
+
+const (
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// Violation is a problem found while validating the source data. Index
+// is the log it was found at, or zero for the stable store.
+type Violation struct {
+	Severity Severity
+	Index    uint64 `json:",omitempty"`
+	Message  string
+}
+
+func (v *Violation) String() string {
+	if v.Index == 0 {
+		return fmt.Sprintf("%s: %s", v.Severity, v.Message)
+	}
+	return fmt.Sprintf("%s at index %d: %s", v.Severity, v.Index, v.Message)
+}
+
+// validValidation checks if the given validation mode is supported.
+// The empty string is the same as ValidateWarn.
+func validValidation(mode string) bool {
+	switch mode {
+	case "", ValidateWarn, ValidateStrict, ValidateOff:
+		return true
+	}
+	return false
+}
+
+// validator tracks what has been copied so far, to check each log
+// against the ones before it and the stable store against the logs.
+type validator struct {
+	lastIndex uint64
+	lastTerm  uint64
+	stable    map[string][]byte
+	failed    bool
+}
+
+func newValidator() *validator {
+	return &validator{stable: make(map[string][]byte)}
+}
+
+// violation records a violation of the Raft invariants.
+func (m *Migrator) violation(severity Severity, index uint64, format string, args ...interface{}) {
+	v := &Violation{
+		Severity: severity,
+		Index:    index,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	if severity == SeverityError {
+		m.validator.failed = true
+	}
+	m.report.ViolationCount++
+	m.metricCounter("violations", 1)
+	if len(m.report.Violations) < maxViolations {
+		m.report.Violations = append(m.report.Violations, v)
+		m.warn("Raft invariant " + v.String())
+	} else if m.report.ViolationCount == maxViolations+1 {
+		m.warn(fmt.Sprintf("More than %d Raft invariant violations, not reporting any more", maxViolations))
+	}
+}
+
+// validateLog checks that a log follows on from the one before it,
+// without a gap and without going back to an earlier term. Logs which
+// were already checked, while comparing a partial BoltDB file from an
+// earlier run against the source, are skipped.
+func (m *Migrator) validateLog(index uint64, log *raft.Log) {
+	if m.Validation == ValidateOff {
+		return
+	}
+	v := m.validator
+	if index <= v.lastIndex {
+		return
+	}
+	if log.Index != index {
+		m.violation(SeverityError, index, "Log is stored with index %d", log.Index)
+	}
+	if v.lastIndex != 0 && index != v.lastIndex+1 {
+		missing := &IndexRange{First: v.lastIndex + 1, Last: index - 1}
+		m.violation(SeverityError, index, "Logs before it are missing (%s)", missing)
+	}
+	if log.Term < v.lastTerm {
+		m.violation(SeverityError, index, "Term %d is lower than term %d of log %d",
+			log.Term, v.lastTerm, v.lastIndex)
+	}
+	v.lastIndex = index
+	if log.Term > v.lastTerm {
+		v.lastTerm = log.Term
+	}
+}
+
+// validateStable records a stable store value to be checked once all
+// of the logs have been seen.
+func (m *Migrator) validateStable(key, val []byte) {
+	m.validator.stable[string(key)] = val
+}
+
+// validateState checks the stable store against the logs.
+func (m *Migrator) validateState() {
+	if m.Validation == ValidateOff {
+		return
+	}
+	v := m.validator
+
+	_, set := v.stable["CurrentTerm"]
+	currentTerm, ok := m.stableTerm("CurrentTerm")
+	switch {
+	case !set && v.lastTerm > 0:
+		m.violation(SeverityWarning, 0, "CurrentTerm is not set, but logs have term %d", v.lastTerm)
+	case ok && currentTerm < v.lastTerm:
+		m.violation(SeverityError, 0, "CurrentTerm %d is lower than term %d of the last log",
+			currentTerm, v.lastTerm)
+	}
+
+	voteTerm, voted := m.stableTerm("LastVoteTerm")
+	if voted && ok && voteTerm > currentTerm {
+		m.violation(SeverityError, 0, "LastVoteTerm %d is higher than CurrentTerm %d", voteTerm, currentTerm)
+	}
+
+	// The candidate is stored as its address, and is empty if the
+	// server has never voted
+	cand, found := v.stable["LastVoteCand"]
+	switch {
+	case found && len(cand) > 0:
+		if _, _, err := net.SplitHostPort(string(cand)); err != nil {
+			m.violation(SeverityWarning, 0, "LastVoteCand %q can't be decoded: %s", cand, err)
+		}
+	case voted && voteTerm > 0:
+		m.violation(SeverityWarning, 0, "LastVoteTerm is %d, but LastVoteCand is not set", voteTerm)
+	}
+}
+
+// stableTerm decodes a term from the stable store, returning false if
+// the key was not set or is not a uint64, which is a violation.
+func (m *Migrator) stableTerm(key string) (uint64, bool) {
+	val, ok := m.validator.stable[key]
+	if !ok {
+		return 0, false
+	}
+	if len(val) != 8 {
+		m.violation(SeverityError, 0, "%s is %d bytes long, not a uint64", key, len(val))
+		return 0, false
+	}
+	return bytesToUint64(val), true
+}
+
+// invalid returns whether strict validation should stop the copy.
+func (m *Migrator) invalid() bool {
+	return m.Validation == ValidateStrict && m.validator.failed
+}
+
+// invalidError describes why strict validation stopped the copy.
+func (m *Migrator) invalidError() error {
+	for _, v := range m.report.Violations {
+		if v.Severity == SeverityError {
+			return newError(ErrClassValidation, errInvalid, "Source data is not valid (%s)", v)
+		}
+	}
+	return newError(ErrClassValidation, errInvalid, "Source data is not valid")
+}
@@ -0,0 +1,286 @@
+package migrator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// reindexStore returns logs with a different index than they were
+// stored at, as a corrupt store might.
+type reindexStore struct {
+	*inmemStore
+	index map[uint64]uint64
+}
+
+func (r *reindexStore) GetLog(index uint64, log *raft.Log) error {
+	if err := r.inmemStore.GetLog(index, log); err != nil {
+		return err
+	}
+	if i, ok := r.index[index]; ok {
+		log.Index = i
+	}
+	return nil
+}
+
+// testValidateStore returns an in-memory store with a log for each of
+// the given terms, starting at index 1, and the given stable values.
+func testValidateStore(t *testing.T, terms []uint64, stable map[string][]byte) *inmemStore {
+	store := &inmemStore{raft.NewInmemStore()}
+	for i, term := range terms {
+		if err := store.StoreLog(&raft.Log{Index: uint64(i + 1), Term: term}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	for key, val := range stable {
+		if err := store.Set([]byte(key), val); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	return store
+}
+
+// validStable returns stable store values which match logs in term 2.
+func validStable() map[string][]byte {
+	return map[string][]byte{
+		"CurrentTerm":  uint64ToBytes(2),
+		"LastVoteTerm": uint64ToBytes(2),
+		"LastVoteCand": []byte("127.0.0.1:8300"),
+	}
+}
+
+func TestMigrator_validate(t *testing.T) {
+	cases := []struct {
+		name     string
+		terms    []uint64
+		stable   func(map[string][]byte)
+		severity Severity
+		index    uint64
+		msg      string
+	}{
+		{
+			name:     "term goes backwards",
+			terms:    []uint64{1, 2, 1, 2},
+			severity: SeverityError,
+			index:    3,
+			msg:      "Term 1 is lower than term 2 of log 2",
+		},
+		{
+			name:     "current term too low",
+			terms:    []uint64{1, 2, 3},
+			severity: SeverityError,
+			msg:      "CurrentTerm 2 is lower than term 3 of the last log",
+		},
+		{
+			name:     "current term missing",
+			stable:   func(s map[string][]byte) { delete(s, "CurrentTerm") },
+			severity: SeverityWarning,
+			msg:      "CurrentTerm is not set",
+		},
+		{
+			name:     "current term not a uint64",
+			stable:   func(s map[string][]byte) { s["CurrentTerm"] = []byte("2") },
+			severity: SeverityError,
+			msg:      "CurrentTerm is 1 bytes long",
+		},
+		{
+			name:     "vote term too high",
+			stable:   func(s map[string][]byte) { s["LastVoteTerm"] = uint64ToBytes(3) },
+			severity: SeverityError,
+			msg:      "LastVoteTerm 3 is higher than CurrentTerm 2",
+		},
+		{
+			name:     "candidate not decodable",
+			stable:   func(s map[string][]byte) { s["LastVoteCand"] = []byte{0xff, 0} },
+			severity: SeverityWarning,
+			msg:      "LastVoteCand \"\\xff\\x00\" can't be decoded",
+		},
+		{
+			name:     "candidate missing",
+			stable:   func(s map[string][]byte) { delete(s, "LastVoteCand") },
+			severity: SeverityWarning,
+			msg:      "LastVoteTerm is 2, but LastVoteCand is not set",
+		},
+	}
+
+	for _, tc := range cases {
+		terms := tc.terms
+		if terms == nil {
+			terms = []uint64{1, 1, 2}
+		}
+		stable := validStable()
+		if tc.stable != nil {
+			tc.stable(stable)
+		}
+
+		m := NewCopier()
+		if err := m.Copy(testValidateStore(t, terms, stable), &inmemStore{raft.NewInmemStore()}); err != nil {
+			t.Fatalf("%s: err: %s", tc.name, err)
+		}
+		report := m.Report()
+		if len(report.Violations) != 1 || report.ViolationCount != 1 {
+			t.Fatalf("%s: bad: %v", tc.name, report.Violations)
+		}
+		v := report.Violations[0]
+		if v.Severity != tc.severity || v.Index != tc.index || !strings.Contains(v.Message, tc.msg) {
+			t.Fatalf("%s: bad: %s", tc.name, v)
+		}
+	}
+}
+
+func TestMigrator_validate_valid(t *testing.T) {
+	m := NewCopier()
+	src := testValidateStore(t, []uint64{1, 1, 2, 2}, validStable())
+	if err := m.Copy(src, &inmemStore{raft.NewInmemStore()}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(m.Report().Violations) != 0 {
+		t.Fatalf("bad: %v", m.Report().Violations)
+	}
+}
+
+func TestMigrator_validate_index(t *testing.T) {
+	src := &reindexStore{
+		inmemStore: testValidateStore(t, nil, validStable()),
+		index:      map[uint64]uint64{3: 7},
+	}
+	for _, i := range []uint64{1, 2, 3, 4, 6} {
+		if err := src.StoreLog(&raft.Log{Index: i, Term: 1}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	m := NewCopier()
+	m.Salvage = true
+	if err := m.Copy(src, &inmemStore{raft.NewInmemStore()}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if m.Report().LogsCopied != 5 {
+		t.Fatalf("bad: %d", m.Report().LogsCopied)
+	}
+	violations := m.Report().Violations
+	if len(violations) != 2 {
+		t.Fatalf("bad: %v", violations)
+	}
+	if violations[0].Index != 3 || !strings.Contains(violations[0].Message, "stored with index 7") {
+		t.Fatalf("bad: %s", violations[0])
+	}
+	if violations[1].Index != 6 || !strings.Contains(violations[1].Message, "missing (5)") {
+		t.Fatalf("bad: %s", violations[1])
+	}
+}
+
+func TestMigrator_validate_gap(t *testing.T) {
+	src := testValidateStore(t, nil, validStable())
+	for _, i := range []uint64{1, 2, 5, 6} {
+		if err := src.StoreLog(&raft.Log{Index: i, Term: 2}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// A gap fails the copy without salvaging, even with checks off
+	m := NewCopier()
+	m.Validation = ValidateOff
+	err := m.Copy(src, &inmemStore{raft.NewInmemStore()})
+	if ErrorClassOf(err) != ErrClassLogStore || !strings.Contains(err.Error(), "Log 3 is missing") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Salvaging quarantines the missing logs
+	m = NewCopier()
+	m.Validation = ValidateOff
+	m.Salvage = true
+	if err := m.Copy(src, &inmemStore{raft.NewInmemStore()}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if indexes := m.quarantinedIndexes(); !reflect.DeepEqual(indexes, []uint64{3, 4}) {
+		t.Fatalf("bad: %v", indexes)
+	}
+
+	// The gap is still an error when validating strictly
+	m = NewCopier()
+	m.Validation = ValidateStrict
+	m.Salvage = true
+	err = m.Copy(src, &inmemStore{raft.NewInmemStore()})
+	if ErrorClassOf(err) != ErrClassValidation {
+		t.Fatalf("bad: %v", err)
+	}
+	if !strings.Contains(err.Error(), "error at index 5") {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestMigrator_validate_strict(t *testing.T) {
+	terms := make([]uint64, 3*logBatchSize)
+	for i := range terms {
+		terms[i] = 2
+	}
+	terms[10] = 1
+
+	m := NewCopier()
+	m.Validation = ValidateStrict
+	err := m.Copy(testValidateStore(t, terms, validStable()), &inmemStore{raft.NewInmemStore()})
+	if ErrorClassOf(err) != ErrClassValidation {
+		t.Fatalf("bad: %v", err)
+	}
+	if !strings.Contains(err.Error(), "error at index 11") {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// The copy stopped at the bad log
+	if m.Report().LogsCopied != 0 {
+		t.Fatalf("bad: %d", m.Report().LogsCopied)
+	}
+
+	// Warnings alone don't stop it
+	stable := validStable()
+	delete(stable, "LastVoteCand")
+	m = NewCopier()
+	m.Validation = ValidateStrict
+	if err := m.Copy(testValidateStore(t, []uint64{1, 2}, stable), &inmemStore{raft.NewInmemStore()}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if m.Report().ViolationCount != 1 {
+		t.Fatalf("bad: %v", m.Report().Violations)
+	}
+}
+
+func TestMigrator_validate_off(t *testing.T) {
+	m := NewCopier()
+	m.Validation = ValidateOff
+	src := testValidateStore(t, []uint64{3, 2, 1}, nil)
+	if err := m.Copy(src, &inmemStore{raft.NewInmemStore()}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if m.Report().ViolationCount != 0 {
+		t.Fatalf("bad: %v", m.Report().Violations)
+	}
+
+	m = NewCopier()
+	m.Validation = "bogus"
+	err := m.Copy(src, &inmemStore{raft.NewInmemStore()})
+	if ErrorClassOf(err) != ErrClassConfig {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestMigrator_validate_maxViolations(t *testing.T) {
+	terms := make([]uint64, 2*maxViolations+1)
+	for i := range terms {
+		terms[i] = uint64(2 - i%2)
+	}
+	stable := validStable()
+
+	m := NewCopier()
+	obs := &testObserver{}
+	m.Observer = obs
+	if err := m.Copy(testValidateStore(t, terms, stable), &inmemStore{raft.NewInmemStore()}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	report := m.Report()
+	if len(report.Violations) != maxViolations || report.ViolationCount != maxViolations {
+		t.Fatalf("bad: %d %d", len(report.Violations), report.ViolationCount)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-migrate/migrator"
+)
+
+const (
+	// Supported values of the -format flag
+	formatText = "text"
+	formatJSON = "json"
+
+	// Status values of the final JSON result event
+	statusMigrated = "migrated"
+	statusNoop     = "noop"
+	statusFailed   = "failed"
+)
+
+// jsonEvent is a single line of JSON output. Only the fields relevant
+// to each kind of event are included, except for the done and total
+// counts, which are always included since zero is meaningful for them.
+// Durations are in seconds.
+type jsonEvent struct {
+	Event       string  `json:"event"`
+	Time        string  `json:"time"`
+	Phase       string  `json:"phase,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Message     string  `json:"message,omitempty"`
+	Elapsed     float64 `json:"elapsed,omitempty"`
+
+	// Progress event fields
+	Progress *float64 `json:"progress,omitempty"`
+	Done     int      `json:"done"`
+	Total    int      `json:"total"`
+	Bytes    int64    `json:"bytes,omitempty"`
+	Rate     float64  `json:"rate,omitempty"`
+	ByteRate float64  `json:"byte_rate,omitempty"`
+	ETA      float64  `json:"eta,omitempty"`
+
+	// Result event fields
+	Status           string             `json:"status,omitempty"`
+	DataDir          string             `json:"data_dir,omitempty"`
+	FirstIndex       uint64             `json:"first_index,omitempty"`
+	LastIndex        uint64             `json:"last_index,omitempty"`
+	LogsCopied       int                `json:"logs_copied,omitempty"`
+	LogsDropped      int                `json:"logs_dropped,omitempty"`
+	DropReason       string             `json:"drop_reason,omitempty"`
+	StableKeysCopied int                `json:"stable_keys_copied,omitempty"`
+	BytesCopied      int64              `json:"bytes_copied,omitempty"`
+	ArchivePath      string             `json:"archive_path,omitempty"`
+	ArchiveChecksum  string             `json:"archive_checksum,omitempty"`
+	ArchiveKeyID     string             `json:"archive_key_id,omitempty"`
+	SourceChecksum   string             `json:"source_checksum,omitempty"`
+	LogsResumed      int                `json:"logs_resumed,omitempty"`
+	PartialDiscard   string             `json:"partial_discard_reason,omitempty"`
+	Quarantined      []uint64           `json:"quarantined,omitempty"`
+	QuarantinePath   string             `json:"quarantine_path,omitempty"`
+	Violations       []*jsonViolation   `json:"violations,omitempty"`
+	Rewrites         []*jsonRewrite     `json:"rewrites,omitempty"`
+	ManifestPath     string             `json:"manifest_path,omitempty"`
+	Duration         *float64           `json:"duration,omitempty"`
+	PhaseDurations   map[string]float64 `json:"phase_durations,omitempty"`
+	Error            string             `json:"error,omitempty"`
+	ErrorClass       string             `json:"error_class,omitempty"`
+}
+
+// jsonViolation is a Raft invariant violation in the result event.
+type jsonViolation struct {
+	Severity string `json:"severity"`
+	Index    uint64 `json:"index,omitempty"`
+	Message  string `json:"message"`
+}
+
+// jsonRewrite is a rewritten server address in the result event.
+type jsonRewrite struct {
+	Location string `json:"location"`
+	Index    uint64 `json:"index,omitempty"`
+	Old      string `json:"old"`
+	New      string `json:"new"`
+}
+
+// jsonHandler writes newline-delimited JSON events for automation to
+// consume, in place of the human-readable progressHandler output. The
+// final result event is written by the caller using result.
+type jsonHandler struct {
+	enc *json.Encoder
+}
+
+func newJSONHandler(w io.Writer) *jsonHandler {
+	return &jsonHandler{enc: json.NewEncoder(w)}
+}
+
+func (j *jsonHandler) emit(event *jsonEvent) {
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	j.enc.Encode(event)
+}
+
+func (j *jsonHandler) PhaseStarted(phase migrator.Phase) {
+	j.emit(&jsonEvent{
+		Event:       "phase_started",
+		Phase:       string(phase),
+		Description: phase.String(),
+	})
+}
+
+func (j *jsonHandler) Progress(update *migrator.ProgressUpdate) {
+	progress := update.Progress
+	j.emit(&jsonEvent{
+		Event:    "progress",
+		Phase:    string(update.Phase),
+		Progress: &progress,
+		Done:     update.Done,
+		Total:    update.Total,
+		Bytes:    update.Bytes,
+		Elapsed:  update.Elapsed.Seconds(),
+		Rate:     update.Rate,
+		ByteRate: update.ByteRate,
+		ETA:      update.ETA.Seconds(),
+	})
+}
+
+func (j *jsonHandler) PhaseCompleted(phase migrator.Phase, elapsed time.Duration) {
+	j.emit(&jsonEvent{
+		Event:   "phase_completed",
+		Phase:   string(phase),
+		Elapsed: elapsed.Seconds(),
+	})
+}
+
+func (j *jsonHandler) Warning(msg string) {
+	j.emit(&jsonEvent{Event: "warning", Message: msg})
+}
+
+func (j *jsonHandler) Finished(bool, error) {}
+
+// result writes the final event describing the outcome of a run. The
+// report may be nil if the run failed before the migrator was created,
+// in which case errClass describes the failure.
+func (j *jsonHandler) result(dataDir string, migrated bool, report *migrator.Report,
+	err error, errClass migrator.ErrorClass) {
+	event := &jsonEvent{
+		Event:   "result",
+		Status:  statusNoop,
+		DataDir: dataDir,
+	}
+	switch {
+	case err != nil:
+		event.Status = statusFailed
+		event.Error = err.Error()
+		event.ErrorClass = string(errClass)
+	case migrated:
+		event.Status = statusMigrated
+	}
+
+	if report != nil {
+		duration := report.Duration.Seconds()
+		event.Duration = &duration
+		event.FirstIndex = report.FirstIndex
+		event.LastIndex = report.LastIndex
+		event.LogsCopied = report.LogsCopied
+		event.LogsDropped = report.LogsDropped
+		event.DropReason = report.DropReason
+		event.StableKeysCopied = report.StableKeysCopied
+		event.BytesCopied = report.BytesCopied
+		event.ArchivePath = report.ArchivePath
+		event.ArchiveChecksum = report.ArchiveChecksum
+		event.ArchiveKeyID = report.ArchiveKeyID
+		event.SourceChecksum = report.SourceChecksum
+		event.LogsResumed = report.LogsResumed
+		event.PartialDiscard = report.PartialDiscardReason
+		event.QuarantinePath = report.QuarantinePath
+		event.ManifestPath = report.ManifestPath
+		for _, q := range report.Quarantined {
+			event.Quarantined = append(event.Quarantined, q.Index)
+		}
+		for _, v := range report.Violations {
+			event.Violations = append(event.Violations, &jsonViolation{
+				Severity: string(v.Severity),
+				Index:    v.Index,
+				Message:  v.Message,
+			})
+		}
+		for _, r := range report.Rewrites {
+			event.Rewrites = append(event.Rewrites, &jsonRewrite{
+				Location: r.Location,
+				Index:    r.Index,
+				Old:      r.Old,
+				New:      r.New,
+			})
+		}
+		if len(report.PhaseDurations) > 0 {
+			event.PhaseDurations = make(map[string]float64)
+			for phase, d := range report.PhaseDurations {
+				event.PhaseDurations[string(phase)] = d.Seconds()
+			}
+		}
+	}
+	j.emit(event)
+}
+
+// outputLevel controls how much the progressHandler prints.
+type outputLevel int
+
+const (
+	levelQuiet outputLevel = iota
+	levelNormal
+	levelVerbose
+)
+
+const (
+	// barWidth is the number of characters inside the progress bar
+	barWidth = 30
+
+	// barInterval limits how often the progress bar is redrawn
+	barInterval = 100 * time.Millisecond
+)
+
+// progressHandler is used to dump progress information to the console
+// while a migration is in flight. This allows the user to monitor a
+// migration. It is called synchronously by the migrator, so the final
+// update of every phase is always printed.
+//
+// When stdout is a terminal, a single progress bar line is redrawn in
+// place. Otherwise, progress is printed periodically on separate lines
+// so that logs are not flooded.
+type progressHandler struct {
+	out   io.Writer
+	level outputLevel
+	tty   bool
+
+	lastProgress float64
+	lastFlush    time.Time
+
+	// Width of the progress bar line currently on screen, if any
+	barLen int
+}
+
+func newProgressHandler(level outputLevel) *progressHandler {
+	return &progressHandler{
+		out:   os.Stdout,
+		level: level,
+		tty:   isTerminal(os.Stdout),
+	}
+}
+
+// isTerminal checks if the given file is a character device, which is
+// how a TTY shows up without resorting to platform-specific ioctls.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// useBar checks if the progress bar should be drawn.
+func (p *progressHandler) useBar() bool {
+	return p.tty && p.level == levelNormal
+}
+
+func (p *progressHandler) PhaseStarted(phase migrator.Phase) {
+	p.lastProgress = -1
+	if p.level == levelQuiet || p.useBar() {
+		return
+	}
+	fmt.Fprintln(p.out, phase)
+}
+
+func (p *progressHandler) Progress(update *migrator.ProgressUpdate) {
+	switch {
+	case p.level == levelQuiet:
+		return
+
+	case p.level == levelVerbose:
+		fmt.Fprintln(p.out, formatProgress(update))
+		return
+
+	case p.useBar():
+		if p.lastProgress >= 0 && update.Progress != 100 &&
+			time.Now().Sub(p.lastFlush) < barInterval {
+			return
+		}
+		p.lastFlush = time.Now()
+		p.lastProgress = update.Progress
+		p.drawBar(renderBar(update))
+		return
+	}
+
+	switch {
+	case p.lastProgress < 0:
+		fallthrough
+
+	case update.Progress-p.lastProgress >= 5:
+		fallthrough
+
+	case time.Now().Sub(p.lastFlush) > time.Second:
+		fallthrough
+
+	case update.Progress == 100:
+		p.lastFlush = time.Now()
+		p.lastProgress = update.Progress
+		fmt.Fprintln(p.out, formatProgress(update))
+	}
+}
+
+func (p *progressHandler) PhaseCompleted(phase migrator.Phase, elapsed time.Duration) {
+	p.endBar()
+	if p.level == levelVerbose {
+		fmt.Fprintf(p.out, "Completed %s in %s\n", phase, elapsed)
+	}
+}
+
+func (p *progressHandler) Warning(msg string) {
+	p.clearBar()
+	fmt.Fprintf(p.out, "Warning: %s\n", msg)
+}
+
+func (p *progressHandler) Finished(bool, error) {
+	p.endBar()
+}
+
+// drawBar replaces the current progress bar line with a new one.
+func (p *progressHandler) drawBar(line string) {
+	pad := ""
+	if len(line) < p.barLen {
+		pad = strings.Repeat(" ", p.barLen-len(line))
+	}
+	fmt.Fprintf(p.out, "\r%s%s", line, pad)
+	p.barLen = len(line)
+}
+
+// clearBar blanks out the progress bar line so other output can be
+// printed in its place. The bar is redrawn on the next update.
+func (p *progressHandler) clearBar() {
+	if p.barLen == 0 {
+		return
+	}
+	fmt.Fprintf(p.out, "\r%s\r", strings.Repeat(" ", p.barLen))
+	p.barLen = 0
+	p.lastProgress = -1
+}
+
+// endBar leaves the progress bar on screen and moves to the next line.
+func (p *progressHandler) endBar() {
+	if p.barLen == 0 {
+		return
+	}
+	fmt.Fprintln(p.out)
+	p.barLen = 0
+}
+
+// renderBar renders a progress update as a progress bar line with the
+// phase, counts, throughput and ETA.
+func renderBar(update *migrator.ProgressUpdate) string {
+	filled := int(update.Progress / 100 * barWidth)
+	if filled > barWidth {
+		filled = barWidth
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+
+	line := fmt.Sprintf("[%s] %6.2f%% %s %d/%d", bar, update.Progress,
+		update.Op, update.Done, update.Total)
+	if update.Rate > 0 {
+		line += fmt.Sprintf(" %.0f/s", update.Rate)
+	}
+	if update.ETA > 0 {
+		line += fmt.Sprintf(" ETA %s", update.ETA.Truncate(time.Second))
+	}
+	return line
+}
+
+// formatProgress renders a progress update as a single line with the
+// percentage, the item counts, and the throughput and ETA once known.
+func formatProgress(update *migrator.ProgressUpdate) string {
+	line := fmt.Sprintf("%.2f%% (%d/%d", update.Progress, update.Done, update.Total)
+	if update.Rate > 0 {
+		line += fmt.Sprintf(", %.0f/s", update.Rate)
+	}
+	if update.ByteRate > 0 {
+		line += fmt.Sprintf(", %s/s", formatBytes(update.ByteRate))
+	}
+	if update.ETA > 0 {
+		line += fmt.Sprintf(", ETA %s", update.ETA.Truncate(time.Second))
+	}
+	return line + ")"
+}
+
+// formatBytes renders a byte count using binary units.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul-migrate/migrator"
+)
+
+func TestRenderBar(t *testing.T) {
+	update := &migrator.ProgressUpdate{
+		Op:       "Migrating log store",
+		Progress: 50,
+		Done:     50,
+		Total:    100,
+		Rate:     10,
+		ETA:      5 * time.Second,
+	}
+	line := renderBar(update)
+	expect := "[===============>              ]  50.00% Migrating log store 50/100 10/s ETA 5s"
+	if line != expect {
+		t.Fatalf("bad: %q", line)
+	}
+
+	// A full bar has no arrow
+	update.Progress = 100
+	update.ETA = 0
+	if line := renderBar(update); !strings.HasPrefix(line, "["+strings.Repeat("=", barWidth)+"]") {
+		t.Fatalf("bad: %q", line)
+	}
+}
+
+func TestProgressHandler_bar(t *testing.T) {
+	var buf bytes.Buffer
+	p := &progressHandler{out: &buf, level: levelNormal, tty: true}
+
+	p.PhaseStarted(migrator.PhaseLogStore)
+	p.Progress(&migrator.ProgressUpdate{Op: "Migrating log store", Progress: 10, Done: 1, Total: 10})
+	p.Warning("careful")
+	p.Progress(&migrator.ProgressUpdate{Op: "Migrating log store", Progress: 100, Done: 10, Total: 10})
+	p.PhaseCompleted(migrator.PhaseLogStore, time.Second)
+
+	out := buf.String()
+	if !strings.HasPrefix(out, "\r[") {
+		t.Fatalf("bad: %q", out)
+	}
+	if !strings.Contains(out, "\rWarning: careful\n\r[") {
+		t.Fatalf("bad: %q", out)
+	}
+	if !strings.HasSuffix(out, "10/10\n") {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
+func TestProgressHandler_levels(t *testing.T) {
+	updates := []*migrator.ProgressUpdate{
+		{Op: "Migrating log store", Progress: 1, Done: 1, Total: 100},
+		{Op: "Migrating log store", Progress: 2, Done: 2, Total: 100},
+		{Op: "Migrating log store", Progress: 3, Done: 3, Total: 100},
+	}
+	run := func(level outputLevel) string {
+		var buf bytes.Buffer
+		p := &progressHandler{out: &buf, level: level}
+		p.PhaseStarted(migrator.PhaseLogStore)
+		for _, update := range updates {
+			p.Progress(update)
+		}
+		p.PhaseCompleted(migrator.PhaseLogStore, time.Second)
+		p.Finished(true, nil)
+		return buf.String()
+	}
+
+	// Quiet prints nothing at all
+	if out := run(levelQuiet); out != "" {
+		t.Fatalf("bad: %q", out)
+	}
+
+	// Normal output throttles the small updates
+	if out := run(levelNormal); strings.Count(out, "%") != 1 {
+		t.Fatalf("bad: %q", out)
+	}
+
+	// Verbose prints every update and the phase timing
+	out := run(levelVerbose)
+	if strings.Count(out, "%") != 3 || !strings.Contains(out, "Completed Migrating log store in 1s") {
+		t.Fatalf("bad: %q", out)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/hashicorp/consul-migrate/migrator"
+)
+
+// verifyMain runs the verify command, which checks a migrated BoltDB
+// store against the manifest written by the migration.
+func verifyMain(args []string) int {
+	var manifestPath, keyFile, keyEnv string
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(verifyUsage()) }
+	flags.StringVar(&manifestPath, "manifest", "", "")
+	flags.StringVar(&keyFile, "key-file", "", "")
+	flags.StringVar(&keyEnv, "key-env", "", "")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+
+	// The manifest is found in the data-dir unless given explicitly
+	switch {
+	case flags.NArg() == 1 && manifestPath == "":
+		manifestPath = filepath.Join(flags.Arg(0), "raft", migrator.ManifestFile)
+	case flags.NArg() == 0 && manifestPath != "":
+	default:
+		fmt.Println(verifyUsage())
+		return 1
+	}
+
+	key, err := loadKey(keyFile, keyEnv)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	result, err := migrator.VerifyManifestWithKey(manifestPath, key)
+	if err != nil {
+		fmt.Printf("Verification failed: %s\n", err)
+		return 1
+	}
+
+	man := result.Manifest
+	fmt.Printf("Manifest written by consul-migrate %s on %s at %s\n",
+		man.ToolVersion, man.Host, man.CompletedAt.Format("2006-01-02 15:04:05 MST"))
+	fmt.Printf("Checked %d stable store keys, %d log ranges (indexes %d to %d) and %d files\n",
+		result.StableKeys, result.LogRanges, firstLogIndex(man), man.LastIndex, result.Files)
+	for _, path := range result.FilesMissing {
+		fmt.Printf("File '%s' no longer exists, skipped\n", path)
+	}
+	for _, path := range result.FilesModified {
+		fmt.Printf("File '%s' has been modified since the migration\n", path)
+	}
+	for _, path := range result.FilesNotDecrypted {
+		fmt.Printf("File '%s' is encrypted and no key was given, only its checksum was checked\n", path)
+	}
+	if result.FilesDecrypted > 0 {
+		fmt.Printf("Decrypted and read back %d encrypted files\n", result.FilesDecrypted)
+	}
+	if !result.OK() {
+		for _, problem := range result.Problems {
+			fmt.Printf("Problem: %s\n", problem)
+		}
+		fmt.Printf("Verification failed with %d problems\n", len(result.Problems))
+		return 1
+	}
+
+	fmt.Println("Verification passed")
+	return 0
+}
+
+// firstLogIndex returns the first index covered by the manifest, which
+// is above the first index of the source if logs were compacted.
+func firstLogIndex(man *migrator.Manifest) uint64 {
+	if len(man.LogRanges) == 0 {
+		return man.FirstIndex
+	}
+	return man.LogRanges[0].First
+}
+
+func verifyUsage() string {
+	return `Usage: consul-migrate verify [options] [<data-dir>]
+
+Checks the BoltDB store created by a migration against the manifest which
+was written alongside it. Every log and stable store value is hashed and
+compared, so the original LMDB data is not needed. The store is opened
+read-only, and Consul must not be running while it is verified.
+
+Backups which have since been deleted are skipped. The BoltDB file itself
+is expected to change once Consul has used it, which is reported but is
+not an error as long as the migrated data is still intact.
+
+An encrypted backup is decrypted and read back if its key is given, and
+otherwise only its checksum is checked.
+
+Returns 0 if the data matches the manifest, 1 otherwise.
+
+Options:
+
+  -manifest=<path>       Path to the manifest. Defaults to
+                         "raft/migration-manifest.json" in the data-dir.
+
+  -key-file=<path>       File holding the key an encrypted backup was
+                         written with.
+
+  -key-env=<name>        Environment variable holding the key.
+`
+}